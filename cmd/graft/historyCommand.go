@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/audit"
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/deploy"
+)
+
+// projectServices returns the sorted service names of a project
+func projectServices(p *deploy.Project) []string {
+	var services []string
+	for name := range p.Services {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// recordModeChange adds a mode change to the server's audit log. The change itself is
+// local, so a server that cannot be reached only produces a warning.
+func recordModeChange(project, oldMode, newMode string) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return
+	}
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("⚠️  Could not record the mode change in the server's audit log: %v\n", err)
+		return
+	}
+	defer client.Close()
+	if oldMode == "" {
+		oldMode = "direct-serverbuild"
+	}
+	audit.Start(project, "mode", nil, oldMode, newMode).Finish(client, nil)
+}
+
+// parseSince accepts a duration back from now (90m, 24h, 7d) or a date (2006-01-02, RFC 3339)
+func parseSince(value string) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value '%s', use e.g. 24h, 7d or 2006-01-02", value)
+}
+
+// runHistory shows the audit log of the server, across all of its projects
+func runHistory(registryContext string, args []string) {
+	var filter audit.Filter
+	limit := 50
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue && i+1 < len(args) && (arg == "--service" || arg == "--since" || arg == "--project" || arg == "-n") {
+			value = args[i+1]
+			hasValue = true
+			i++
+		}
+		if !hasValue {
+			fmt.Println("Usage: graft history [--service <name>] [--since <24h|7d|2006-01-02>] [--project <name>] [-n <count>]")
+			return
+		}
+		switch name {
+		case "--service":
+			filter.Service = value
+		case "--project":
+			filter.Project = value
+		case "--since":
+			since, err := parseSince(value)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			filter.Since = since
+		case "-n":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				fmt.Printf("Error: invalid -n value '%s'\n", value)
+				return
+			}
+			limit = n
+		default:
+			fmt.Printf("Error: unknown flag '%s'\n", name)
+			return
+		}
+	}
+
+	var srv config.ServerConfig
+	if registryContext != "" {
+		gCfg, _ := config.LoadGlobalConfig()
+		if gCfg == nil || gCfg.Servers == nil {
+			fmt.Println("Error: Could not load global registry.")
+			return
+		}
+		s, exists := gCfg.Servers[registryContext]
+		if !exists {
+			fmt.Printf("Error: Registry '%s' not found.\n", registryContext)
+			return
+		}
+		srv = s
+	} else {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Println("Error: No config found. Run 'graft init' first or use 'graft -r <registry> history'")
+			return
+		}
+		srv = cfg.Server
+	}
+
+	client, err := newClient(srv)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	events, err := audit.Read(client, filter)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(events) == 0 {
+		fmt.Println("No matching events in the audit log.")
+		return
+	}
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+
+	fmt.Printf("\n📜 Deployment history of %s:\n", srv.DisplayHost())
+	fmt.Printf("  %-19s %-16s %-14s %-22s %-8s %-9s %-8s %s\n", "Time", "Project", "Command", "User", "Commit", "Duration", "Outcome", "Services")
+	fmt.Println("  " + strings.Repeat("-", 118))
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		marker := "✅"
+		if e.Outcome != audit.Success {
+			marker = "❌"
+		}
+		command := e.Command
+		if len(e.Args) > 0 {
+			command += " " + strings.Join(e.Args, " ")
+		}
+		commit := e.GitCommit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		if commit == "" {
+			commit = "-"
+		}
+		project := e.Project
+		if project == "" {
+			project = "-"
+		}
+		duration := (time.Duration(e.DurationMS) * time.Millisecond).Round(time.Second)
+		fmt.Printf("%s %-19s %-16s %-14s %-22s %-8s %-9s %-8s %s\n", marker, e.Time.Local().Format("2006-01-02 15:04:05"), project, command, e.User+"@"+e.Host, commit, duration, e.Outcome, strings.Join(e.Services, ", "))
+		if e.Error != "" {
+			fmt.Printf("     ↳ %s\n", strings.SplitN(e.Error, "\n", 2)[0])
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/deploy"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+// parseWaitFlag handles --wait and --wait=<duration> for commands that take the deploy lock
+func parseWaitFlag(arg string) (time.Duration, bool, error) {
+	if arg == "--wait" {
+		return deploy.DefaultLockWait, true, nil
+	}
+	if !strings.HasPrefix(arg, "--wait=") {
+		return 0, false, nil
+	}
+	wait, err := time.ParseDuration(strings.TrimPrefix(arg, "--wait="))
+	if err != nil || wait <= 0 {
+		return 0, true, fmt.Errorf("invalid --wait value '%s', use e.g. --wait=5m", strings.TrimPrefix(arg, "--wait="))
+	}
+	return wait, true, nil
+}
+
+// lockProject takes the project's deploy lock on the server, printing why when it cannot
+func lockProject(client *ssh.Client, remoteDir, command string, wait time.Duration) *deploy.Lock {
+	lock, err := deploy.AcquireLock(client, remoteDir, command, wait, os.Stdout)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return nil
+	}
+	// A forced exit (second Ctrl+C) releases it as well
+	openMu.Lock()
+	heldLocks = append(heldLocks, lock)
+	openMu.Unlock()
+	return lock
+}
+
+// runLock shows or breaks the deploy lock of the current project
+func runLock(args []string) {
+	if len(args) < 1 || (args[0] != "status" && args[0] != "break") {
+		fmt.Println("Usage: graft lock [status|break]")
+		return
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("Error: No config found.")
+		return
+	}
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return
+	}
+
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	if args[0] == "break" {
+		holder, err := deploy.BreakLock(client, meta.RemotePath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if holder == nil {
+			fmt.Printf("🔓 Project '%s' is not locked\n", meta.Name)
+			return
+		}
+		fmt.Printf("🔓 Removed deploy lock of %s\n", holder)
+		fmt.Println("⚠️  If that deploy is still running, it keeps going and may clash with the next one.")
+		return
+	}
+
+	holder, err := deploy.ReadLock(client, meta.RemotePath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if holder == nil {
+		fmt.Printf("🔓 Project '%s' is not locked\n", meta.Name)
+		return
+	}
+	fmt.Printf("🔒 Project '%s' is locked by %s\n", meta.Name, holder)
+	fmt.Printf("   Last heartbeat: %s ago\n", holder.Idle.Round(time.Second))
+	if holder.Stale() {
+		fmt.Println("   The lock is stale and will be taken over by the next deploy.")
+	}
+}
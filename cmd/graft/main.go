@@ -2,29 +2,127 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/skssmd/graft/internal/audit"
 	"github.com/skssmd/graft/internal/config"
 	"github.com/skssmd/graft/internal/deploy"
 	"github.com/skssmd/graft/internal/git"
 	"github.com/skssmd/graft/internal/hostinit"
 	"github.com/skssmd/graft/internal/infra"
+	"github.com/skssmd/graft/internal/shell"
 	"github.com/skssmd/graft/internal/ssh"
+	"golang.org/x/term"
 )
 
+// rootCtx is cancelled on SIGINT/SIGTERM so running remote commands are stopped as well
+var rootCtx = context.Background()
+
+// commandTimeout limits every remote command (--timeout), overriding the server's command_timeout
+var commandTimeout time.Duration
+
+// Open connections and held deploy locks, cleaned up when graft has to exit right away
+var (
+	openMu      sync.Mutex
+	openClients []*ssh.Client
+	heldLocks   []*deploy.Lock
+)
+
+// watchSignals cancels rootCtx on the first SIGINT/SIGTERM while a remote command runs or a
+// deploy lock is held, so the command stops and graft returns through the normal path,
+// releasing its lock. Otherwise, or on a second signal, graft cleans up and exits right away.
+func watchSignals() {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	rootCtx = ctx
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		openMu.Lock()
+		locked := len(heldLocks) > 0
+		openMu.Unlock()
+		if ssh.CommandRunning() || locked {
+			fmt.Fprintf(os.Stderr, "\n🛑 Stopping remote command (press Ctrl+C again to force quit)...\n")
+			cancel(&ssh.SignalError{Signal: sig})
+			sig = <-sigs
+		}
+		releaseAll()
+		if sig == os.Interrupt {
+			os.Exit(130)
+		}
+		os.Exit(143)
+	}()
+}
+
+// releaseAll gives up the held deploy locks and closes the open connections before a forced exit
+func releaseAll() {
+	openMu.Lock()
+	defer openMu.Unlock()
+	for _, lock := range heldLocks {
+		lock.Release()
+	}
+	for _, client := range openClients {
+		client.Close()
+	}
+}
+
+// newClient connects to srv with the CLI's signal context and command timeout
+func newClient(srv config.ServerConfig) (*ssh.Client, error) {
+	client, err := ssh.NewClient(srv)
+	if err != nil {
+		return nil, err
+	}
+	client.SetContext(rootCtx)
+	if commandTimeout > 0 {
+		client.SetTimeout(commandTimeout)
+	}
+	openMu.Lock()
+	openClients = append(openClients, client)
+	openMu.Unlock()
+	return client, nil
+}
+
 func main() {
+	// graft re-executes itself as SSH_ASKPASS to hand passwords to external ssh
+	if ssh.ServeAskpass() {
+		return
+	}
+
 	if len(os.Args) < 2 {
 		printUsage()
 		return
 	}
 
 	args := os.Args[1:]
+	watchSignals()
+
+	// Handle command timeout flag: graft --timeout 10m ...
+	if args[0] == "--timeout" {
+		if len(args) < 3 {
+			fmt.Println("Usage: graft --timeout <duration> <command>")
+			return
+		}
+		timeout, err := time.ParseDuration(args[1])
+		if err != nil {
+			fmt.Printf("Error: invalid timeout '%s' (use e.g. 90s, 10m, 1h)\n", args[1])
+			return
+		}
+		commandTimeout = timeout
+		args = args[2:]
+	}
 
 	// Handle target registry flag: graft -r registryname ...
 	var registryContext string
@@ -67,6 +165,31 @@ func main() {
 		fmt.Printf("📂 Context: %s (%s)\n", projectName, projectPath)
 	}
 
+	// Handle environment flag: graft -e staging ...
+	if args[0] == "-e" || args[0] == "--env" {
+		if len(args) < 3 {
+			fmt.Println("Usage: graft -e <environment> <command>")
+			return
+		}
+		if err := config.SetEnvironment(args[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args = args[2:]
+
+		meta, err := config.LoadProjectMetadata()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("🌍 Environment: %s (%s on %s)\n", meta.Environment, meta.Name, cfg.Server.DisplayHost())
+	}
+
 	command := args[0]
 
 	switch command {
@@ -128,7 +251,7 @@ func main() {
 		}
 	case "registry":
 		if len(args) < 2 {
-			fmt.Println("Usage: graft registry [ls|add|del]")
+			fmt.Println("Usage: graft registry [ls|add|del|trust|import-ssh-config]")
 			return
 		}
 		switch args[1] {
@@ -142,8 +265,20 @@ func main() {
 				return
 			}
 			runRegistryDel(args[2])
+		case "trust":
+			if len(args) < 3 {
+				fmt.Println("Usage: graft registry trust <name>")
+				return
+			}
+			runRegistryTrust(args[2])
+		case "import-ssh-config":
+			path := ""
+			if len(args) > 2 {
+				path = args[2]
+			}
+			runRegistryImportSSHConfig(path)
 		default:
-			fmt.Println("Usage: graft registry [ls|add|del]")
+			fmt.Println("Usage: graft registry [ls|add|del|trust|import-ssh-config]")
 		}
 	case "projects":
 		if len(args) > 1 && args[1] == "ls" {
@@ -161,6 +296,23 @@ func main() {
 			return
 		}
 		runPull(registryContext, args[1])
+	case "tunnel":
+		runTunnel(registryContext, args[1:])
+	case "releases":
+		runReleases(args[1:])
+	case "rollback":
+		runRollback(args[1:])
+	case "lock":
+		runLock(args[1:])
+	case "history":
+		runHistory(registryContext, args[1:])
+	case "preview":
+		runPreview(args[1:])
+	case "task":
+		// The task container's exit code becomes graft's own
+		if code := runTaskCommand(args[1:]); code != 0 {
+			os.Exit(code)
+		}
 	case "mode":
 		runMode()
 	case "map":
@@ -204,16 +356,31 @@ func printUsage() {
 	fmt.Println("  -p, --project <name>      Run command in specific project context")
 	fmt.Println("  -r, --registry <name>     Target a specific server context")
 	fmt.Println("  -sh, --sh [cmd]           Execute shell command on target (or start SSH session)")
+	fmt.Println("  --timeout <duration>      Limit each remote command, e.g. 10m (must come first)")
+	fmt.Println("  -e, --env <name>          Work on a named environment, e.g. staging (after -p)")
 	fmt.Println("\nCommands:")
 	fmt.Println("  init [-f]                 Initialize a new project")
 	fmt.Println("  registry [ls|add|del]     Manage registered servers")
+	fmt.Println("  registry trust <name>     Re-pin the SSH host key of a registered server")
+	fmt.Println("  tunnel <target> [port]    Forward a local port to graft-postgres, graft-redis or service:port")
+	fmt.Println("  registry import-ssh-config [path]  Add registry entries for ~/.ssh/config hosts")
 	fmt.Println("  projects ls               List local projects")
 	fmt.Println("  pull <project>            Pull/Clone project from remote")
 	fmt.Println("  host [init|clean|sh|self-destruct]  Manage current project's host context")
 	fmt.Println("  infra [db|redis] ports:<v> Change infra port mapping (null to hide)")
 	fmt.Println("  infra reload              Pull and reload infrastructure services")
 	fmt.Println("  db/redis <name> init      Initialize shared infrastructure")
-	fmt.Println("  sync [service] [-h]       Deploy project to server")
+	fmt.Println("  sync [service] [-h]       Deploy project to server (--parallel <n> for concurrent services)")
+	fmt.Println("  sync [service] --dry-run  Show what a sync would change without touching the server")
+	fmt.Println("  sync --force              Also upload and rebuild services whose build context is unchanged")
+	fmt.Println("  releases [keep <n>]       List deployed releases (or set how many are kept)")
+	fmt.Println("  rollback [release-id]     Reactivate a previous release")
+	fmt.Println("  lock [status|break]       Show or remove the project's deploy lock")
+	fmt.Println("  history [--service <name>] [--since <time>]  Show the deployment audit log of the server")
+	fmt.Println("  preview [up|down] <branch> Deploy or remove a branch preview at <branch>.<domain>")
+	fmt.Println("  preview [ls|workflow]     List previews or generate their pull request workflow")
+	fmt.Println("  task <name> [args...]     Run a task from x-graft-tasks in a fresh container, exiting with its code")
+	fmt.Println("  task [ls|history|logs]    List tasks, show their recorded runs or the log of a run")
 	fmt.Println("  logs <service>            Stream service logs")
 	fmt.Println("  mode                      Change project deployment mode")
 	fmt.Println("  map                       Map all service domains to Cloudflare DNS")
@@ -273,6 +440,7 @@ func runMode() {
 	}
 
 	// Update project metadata
+	oldMode := meta.DeploymentMode
 	meta.DeploymentMode = newMode
 	meta.Initialized = false // Reset to false when mode changes
 	if err := config.SaveProjectMetadata(meta); err != nil {
@@ -280,6 +448,15 @@ func runMode() {
 		return
 	}
 
+	// An environment only overrides the mode, graft-compose.yml is shared
+	if meta.Environment != "" {
+		recordModeChange(meta.Name, oldMode, newMode)
+		fmt.Printf("\n✅ Deployment mode of environment '%s' changed to: %s\n", meta.Environment, newMode)
+		fmt.Println("📝 Updated files:")
+		fmt.Println("   - .graft/project.json")
+		return
+	}
+
 	// Regenerate compose file with new mode
 	fmt.Println("\n🔄 Regenerating graft-compose.yml with new deployment mode...")
 	
@@ -297,6 +474,8 @@ func runMode() {
 		}
 	}
 
+	recordModeChange(meta.Name, oldMode, newMode)
+
 	fmt.Printf("\n✅ Deployment mode changed to: %s\n", newMode)
 	fmt.Println("📝 Updated files:")
 	fmt.Println("   - .graft/project.json")
@@ -339,8 +518,7 @@ func runInit(args []string) {
 	// Load global registry
 	gCfg, _ := config.LoadGlobalConfig()
 	
-	var host, user, keyPath string
-	var port int
+	var server config.ServerConfig
 	var registryName string
 
 	if gCfg != nil && len(gCfg.Servers) > 0 {
@@ -348,7 +526,7 @@ func runInit(args []string) {
 		var keys []string
 		i := 1
 		for name, srv := range gCfg.Servers {
-			fmt.Printf("  [%d] %s (%s)\n", i, name, srv.Host)
+			fmt.Printf("  [%d] %s (%s)\n", i, name, srv.DisplayHost())
 			keys = append(keys, name)
 			i++
 		}
@@ -358,23 +536,19 @@ func runInit(args []string) {
 		input = strings.TrimSpace(input)
 		
 		if input == "/new" {
-			host, port, user, keyPath = promptNewServer(reader)
+			server = promptNewServer(reader)
 			fmt.Print("Registry Name (e.g. prod-us): ")
 			registryName, _ = reader.ReadString('\n')
 			registryName = strings.TrimSpace(registryName)
 		} else {
 			idx, err := strconv.Atoi(input)
 			if err == nil && idx > 0 && idx <= len(keys) {
-				selected := gCfg.Servers[keys[idx-1]]
-				host = selected.Host
-				user = selected.User
-				port = selected.Port
-				keyPath = selected.KeyPath
-				registryName = selected.RegistryName
+				server = gCfg.Servers[keys[idx-1]]
+				registryName = server.RegistryName
 				fmt.Printf("✅ Using server: %s\n", registryName)
 			} else {
 				fmt.Println("Invalid selection, entering new server details...")
-				host, port, user, keyPath = promptNewServer(reader)
+				server = promptNewServer(reader)
 				fmt.Print("Registry Name (e.g. prod-us): ")
 				registryName, _ = reader.ReadString('\n')
 				registryName = strings.TrimSpace(registryName)
@@ -382,7 +556,7 @@ func runInit(args []string) {
 		}
 	} else {
 		fmt.Println("No servers found in registry. Enter new server details:")
-		host, port, user, keyPath = promptNewServer(reader)
+		server = promptNewServer(reader)
 		fmt.Print("Registry Name (e.g. prod-us): ")
 		registryName, _ = reader.ReadString('\n')
 		registryName = strings.TrimSpace(registryName)
@@ -393,13 +567,8 @@ func runInit(args []string) {
 		if gCfg.Servers == nil {
 			gCfg.Servers = make(map[string]config.ServerConfig)
 		}
-		gCfg.Servers[registryName] = config.ServerConfig{
-			RegistryName: registryName,
-			Host:         host,
-			Port:         port,
-			User:         user,
-			KeyPath:      keyPath,
-		}
+		server.RegistryName = registryName
+		gCfg.Servers[registryName] = server
 		config.SaveGlobalConfig(gCfg)
 	}
 
@@ -434,7 +603,7 @@ func runInit(args []string) {
 			if data, err := os.ReadFile(localCfgPath); err == nil {
 				var exCfg config.GraftConfig
 				if err := json.Unmarshal(data, &exCfg); err == nil {
-					fmt.Printf("   Target Host: %s (%s)\n", exCfg.Server.RegistryName, exCfg.Server.Host)
+					fmt.Printf("   Target Host: %s (%s)\n", exCfg.Server.RegistryName, exCfg.Server.DisplayHost())
 				}
 			}
 			
@@ -450,8 +619,8 @@ func runInit(args []string) {
 	}
 
 	// Remote Conflict Check
-	fmt.Printf("🔍 Checking for conflicts on remote server '%s'...\n", host)
-	client, err := ssh.NewClient(host, port, user, keyPath)
+	fmt.Printf("🔍 Checking for conflicts on remote server '%s'...\n", server.DisplayHost())
+	client, err := newClient(server)
 	if err != nil {
 		fmt.Printf("⚠️  Warning: Could not connect to host to check for conflicts: %v\n", err)
 	} else {
@@ -482,6 +651,12 @@ func runInit(args []string) {
 					fmt.Printf("❌ Host initialization failed: %v\n", err)
 					return
 				}
+				// Remember the detected docker privilege mode for this server
+				server.DockerMode = client.DockerMode()
+				if gCfg != nil {
+					gCfg.Servers[registryName] = server
+					config.SaveGlobalConfig(gCfg)
+				}
 				fmt.Println("✅ Host initialized.")
 			} else {
 				fmt.Println("⏭️  Skipping host initialization. Some features may not work.")
@@ -489,7 +664,11 @@ func runInit(args []string) {
 		}
 		
 		// Ensure config dir exists
-		client.RunCommand("sudo mkdir -p /opt/graft/config && sudo chown $USER:$USER /opt/graft/config", os.Stdout, os.Stderr)
+		if err := client.CheckBaseDir(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		client.RunCommand(client.MkdirOwned("/opt/graft/config").String(), os.Stdout, os.Stderr)
 
 		tmpFile := filepath.Join(os.TempDir(), "remote_projects.json")
 		var remoteProjects map[string]string // Name -> Path
@@ -616,6 +795,7 @@ func runInit(args []string) {
 					installHook = true
 				} else {
 					fmt.Println("\n✅ graft-hook is already installed on the server.")
+					installLockScript(client)
 					// Fetch existing hook URL from global registry if available
 					if srv, exists := gCfg.Servers[registryName]; exists {
 						currentHookURL = srv.GraftHookURL
@@ -646,21 +826,23 @@ services:
       - "traefik.http.routers.graft-hook.entrypoints=websecure"
       - "traefik.http.routers.graft-hook.tls.certresolver=letsencrypt"
     volumes:
-      - /var/run/docker.sock:/var/run/docker.sock
+      - %s:/var/run/docker.sock
       - /opt/graft:/opt/graft/
     networks:
       - graft-public
     restart: always
 networks:
   graft-public:
-    external: true`, hookDomain)
+    external: true`, hookDomain, client.DockerSocket())
 
-				client.RunCommand("sudo mkdir -p /opt/graft/webhook && sudo chown $USER:$USER /opt/graft/webhook", nil, nil)
+				client.RunCommand(client.MkdirOwned("/opt/graft/webhook").String(), nil, nil)
 				tmpFile := filepath.Join(os.TempDir(), "hook-compose.yml")
 				os.WriteFile(tmpFile, []byte(hookCompose), 0644)
 				client.UploadFile(tmpFile, "/opt/graft/webhook/docker-compose.yml")
 				os.Remove(tmpFile)
-				client.RunCommand("sudo docker compose -f /opt/graft/webhook/docker-compose.yml up -d", os.Stdout, os.Stderr)
+
+				installLockScript(client)
+				client.RunCommand(client.Docker("compose", "-f", "/opt/graft/webhook/docker-compose.yml", "up", "-d").String(), os.Stdout, os.Stderr)
 				fmt.Println("✅ graft-hook deployed.")
 				currentHookURL = fmt.Sprintf("https://%s", hookDomain)
 
@@ -678,7 +860,7 @@ networks:
 	if client != nil {
 		remoteProjPath := fmt.Sprintf("/opt/graft/projects/%s", projName)
 		fmt.Printf("📂 Setting up remote project directory: %s\n", remoteProjPath)
-		client.RunCommand(fmt.Sprintf("sudo mkdir -p %s && sudo chown $USER:$USER %s", remoteProjPath, remoteProjPath), nil, nil)
+		client.RunCommand(client.MkdirOwned(remoteProjPath).String(), nil, nil)
 
 		if strings.HasPrefix(deploymentMode, "git") {
 			// Ensure git is installed
@@ -694,16 +876,14 @@ networks:
 
 			// Init git repo on server
 			fmt.Println("🔧 Initializing git repository on server...")
-			client.RunCommand(fmt.Sprintf("cd %s && git init && git remote add origin %s", remoteProjPath, gitRemote), os.Stdout, os.Stderr)
+			client.RunCommand(shell.Cd(remoteProjPath).And(shell.New("git", "init")).And(shell.New("git", "remote", "add", "origin", gitRemote)).String(), os.Stdout, os.Stderr)
 		}
 	}
 
 	// Save local config
+	server.RegistryName = registryName
 	cfg := &config.GraftConfig{
-		Server: config.ServerConfig{
-			RegistryName: registryName,
-			Host:         host, Port: port, User: user, KeyPath: keyPath,
-		},
+		Server: server,
 	}
 	config.SaveConfig(cfg, true) // local
 
@@ -718,6 +898,7 @@ networks:
 		RemotePath:     fmt.Sprintf("/opt/graft/projects/%s", projName),
 		DeploymentMode: deploymentMode,
 		GraftHookURL:   currentHookURL,
+		Domain:         domain,
 	}
 	if err := config.SaveProjectMetadata(meta); err != nil {
 		fmt.Printf("Warning: Could not save project metadata: %v\n", err)
@@ -738,7 +919,7 @@ func runHostInit() {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -825,6 +1006,14 @@ func runHostInit() {
 		return
 	}
 
+	// Remember the detected docker privilege mode locally and in the registry
+	cfg.Server.DockerMode = client.DockerMode()
+	config.SaveConfig(cfg, true)
+	if gCfg != nil {
+		gCfg.Servers[cfg.Server.RegistryName] = cfg.Server
+		config.SaveGlobalConfig(gCfg)
+	}
+
 	fmt.Println("\n✅ Host initialized successfully!")
 }
 
@@ -835,7 +1024,7 @@ func runHostClean() {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -848,11 +1037,11 @@ func runHostClean() {
 		name string
 		cmd  string
 	}{
-		{"Stopped containers", "sudo docker container prune -f"},
-		{"Dangling images", "sudo docker image prune -f"},
-		{"Build cache", "sudo docker builder prune -f"},
-		{"Unused volumes", "sudo docker volume prune -f"},
-		{"Unused networks", "sudo docker network prune -f"},
+		{"Stopped containers", client.Docker("container", "prune", "-f").String()},
+		{"Dangling images", client.Docker("image", "prune", "-f").String()},
+		{"Build cache", client.Docker("builder", "prune", "-f").String()},
+		{"Unused volumes", client.Docker("volume", "prune", "-f").String()},
+		{"Unused networks", client.Docker("network", "prune", "-f").String()},
 	}
 
 	for _, cleanup := range cleanupCmds {
@@ -878,19 +1067,30 @@ func runInfraInit(typ, name string) {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 	defer client.Close()
 
+	command := "redis init"
+	if typ == "postgres" {
+		command = "db init"
+	}
+	project := ""
+	if meta, err := config.LoadProjectMetadata(); err == nil {
+		project = meta.Name
+	}
+	event := audit.Start(project, command, []string{name}, name)
+
 	var url string
 	if typ == "postgres" {
 		url, err = infra.InitPostgres(client, name, cfg, os.Stdout, os.Stderr)
 	} else {
 		url, err = infra.InitRedis(client, name, os.Stdout, os.Stderr)
 	}
+	event.Finish(client, err)
 
 	if err != nil {
 		fmt.Printf("Error initializing %s: %v\n", typ, err)
@@ -911,16 +1111,46 @@ func runSync(args []string) {
 	// Check if a specific service is specified
 	var serviceName string
 	var noCache bool
+	var force bool
 	var heave bool
 	var useGit bool
 	var gitBranch string
 	var gitCommit string
+	var dryRun bool
+	var lockWait time.Duration
+	parallel := 1
 	
-	// Parse arguments: [service] [--no-cache] [-h|--heave] [--git] [--branch <name>] [--commit <hash>]
+	// Parse arguments: [service] [--no-cache] [--force] [-h|--heave] [--git] [--branch <name>] [--commit <hash>] [--parallel <n>] [--dry-run] [--wait[=<duration>]]
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
-		if arg == "--no-cache" {
+		if wait, ok, err := parseWaitFlag(arg); ok {
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			lockWait = wait
+		} else if arg == "--parallel" || strings.HasPrefix(arg, "--parallel=") {
+			value := strings.TrimPrefix(arg, "--parallel=")
+			if arg == "--parallel" {
+				if i+1 >= len(args) {
+					fmt.Println("Error: --parallel needs a number of services, e.g. --parallel 4")
+					return
+				}
+				value = args[i+1]
+				i++
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				fmt.Printf("Error: invalid --parallel value '%s'\n", value)
+				return
+			}
+			parallel = n
+		} else if arg == "--no-cache" {
 			noCache = true
+		} else if arg == "--force" {
+			force = true
+		} else if arg == "--dry-run" {
+			dryRun = true
 		} else if arg == "-h" || arg == "--heave" {
 			heave = true
 		} else if arg == "--git" {
@@ -962,6 +1192,20 @@ func runSync(args []string) {
 		p.DeploymentMode = meta.DeploymentMode
 	}
 
+	// Dry run: show what would change and leave the server untouched
+	if dryRun {
+		client, err := newClient(cfg.Server)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer client.Close()
+		if err := deploy.Plan(client, p, serviceName, noCache, force, useGit, gitBranch, gitCommit, os.Stdout); err != nil {
+			fmt.Printf("Error during dry run: %v\n", err)
+		}
+		return
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
 	// New Initialization flow for Git modes
@@ -982,12 +1226,18 @@ func runSync(args []string) {
 		
 		fmt.Println("✅ GitHub Workflows created in .github/workflows/")
 
+		fmt.Print("❓ Deploy a preview for every pull request (graft preview)? (y/n): ")
+		ansPreview, _ := reader.ReadString('\n')
+		if strings.TrimSpace(strings.ToLower(ansPreview)) == "y" {
+			runPreviewWorkflow()
+		}
+
 		// Ask for compose generation and transfer
 		
 		
 			
 			
-			client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+			client, err := newClient(cfg.Server)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
@@ -1025,14 +1275,23 @@ func runSync(args []string) {
 		doEnv := strings.TrimSpace(strings.ToLower(ansEnv)) == "y"
 
 		if doCompose || doEnv {
-			client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+			client, err := newClient(cfg.Server)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
 			}
 			defer client.Close()
 
-			if err := deploy.SyncComposeOnly(client, p, true, os.Stdout, os.Stderr ,doCompose, doEnv ); err != nil {
+			lock := lockProject(client, fmt.Sprintf("/opt/graft/projects/%s", p.Name), "sync compose", lockWait)
+			if lock == nil {
+				return
+			}
+			defer lock.Release()
+
+			event := audit.Start(p.Name, "sync compose", nil, args...)
+			err = deploy.SyncComposeOnly(client, p, true, os.Stdout, os.Stderr ,doCompose, doEnv )
+			event.Finish(client, err)
+			if err != nil {
 				fmt.Printf("Error during sync: %v\n", err)
 				return
 			}
@@ -1050,13 +1309,31 @@ func runSync(args []string) {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 	defer client.Close()
 
+	// Only one deploy per project at a time
+	lockCommand := "sync"
+	if serviceName != "" {
+		lockCommand = "sync " + serviceName
+	}
+	lock := lockProject(client, fmt.Sprintf("/opt/graft/projects/%s", p.Name), lockCommand, lockWait)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	touched := []string{serviceName}
+	if serviceName == "" {
+		touched = projectServices(p)
+	}
+	event := audit.Start(p.Name, "sync", touched, args...)
+	event.GitCommit = deploy.CurrentCommit(useGit, gitBranch, gitCommit)
+
 	if serviceName != "" {
 		fmt.Printf("🎯 Syncing service: %s\n", serviceName)
 		if useGit {
@@ -1076,11 +1353,15 @@ func runSync(args []string) {
 		if noCache {
 			fmt.Println("🔥 No-cache mode enabled")
 		}
+		if force {
+			fmt.Println("💪 Force mode enabled (rebuild unchanged services)")
+		}
 		if heave {
 			fmt.Println("🚀 Heave sync enabled (upload only)")
 		}
-		err = deploy.Sync(client, p, noCache, heave, useGit, gitBranch, gitCommit, os.Stdout, os.Stderr)
+		err = deploy.Sync(client, p, noCache, force, heave, useGit, gitBranch, gitCommit, parallel, os.Stdout, os.Stderr)
 	}
+	event.Finish(client, err)
 
 	if err != nil {
 		fmt.Printf("Error during sync: %v\n", err)
@@ -1094,11 +1375,18 @@ func runSync(args []string) {
 
 func runSyncCompose(args []string) {
 	var heave bool
-	// Parse arguments: compose [-h|--heave]
+	var lockWait time.Duration
+	// Parse arguments: compose [-h|--heave] [--wait[=<duration>]]
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 		if arg == "-h" || arg == "--heave" {
 			heave = true
+		} else if wait, ok, err := parseWaitFlag(arg); ok {
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			lockWait = wait
 		}
 	}
 
@@ -1121,18 +1409,26 @@ func runSyncCompose(args []string) {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 	defer client.Close()
 
+	lock := lockProject(client, fmt.Sprintf("/opt/graft/projects/%s", p.Name), "sync compose", lockWait)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
 	if heave {
 		fmt.Println("📄 Heave sync enabled (config upload only)")
 	}
 
+	event := audit.Start(p.Name, "sync compose", projectServices(p), args...)
 	err = deploy.SyncComposeOnly(client, p, heave, os.Stdout, os.Stderr,true, true)
+	event.Finish(client, err)
 	if err != nil {
 		fmt.Printf("Error during sync: %v\n", err)
 		return
@@ -1157,7 +1453,7 @@ func runLogs(serviceName string) {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1169,8 +1465,8 @@ func runLogs(serviceName string) {
 	fmt.Println("---")
 
 	// Run docker compose logs with follow flag
-	logsCmd := fmt.Sprintf("cd %s && sudo docker compose logs -f --tail=100 %s", meta.RemotePath, serviceName)
-	if err := client.RunCommand(logsCmd, os.Stdout, os.Stderr); err != nil {
+	logsCmd := client.Compose(meta.RemotePath, "logs", "-f", "--tail=100", serviceName)
+	if err := client.RunCommand(logsCmd.String(), os.Stdout, os.Stderr); err != nil {
 		fmt.Printf("\nError: %v\n", err)
 	}
 }
@@ -1188,22 +1484,100 @@ func runDockerCompose(args []string) {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 	defer client.Close()
 
-	// Build the docker compose command
-	cmdStr := strings.Join(args, " ")
-	composeCmd := fmt.Sprintf("cd %s && sudo docker compose %s", meta.RemotePath, cmdStr)
-	
-	if err := client.RunCommand(composeCmd, os.Stdout, os.Stderr); err != nil {
+	// Build the docker compose command; every argument is quoted so it reaches compose unchanged
+	composeCmd := client.Compose(meta.RemotePath, args...).String()
+
+	// Interactive commands (exec -it, run -it, attach) need a real terminal on the server
+	if needsTTY(args) {
+		if err := client.RunCommandPTY(composeCmd); err != nil {
+			fmt.Printf("\nError: %v\n", err)
+		}
+		return
+	}
+
+	// up and down change what runs on the server, so they are recorded in the audit log
+	var event *audit.Event
+	if args[0] == "up" || args[0] == "down" {
+		var services []string
+		for _, arg := range args[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				services = append(services, arg)
+			}
+		}
+		event = audit.Start(meta.Name, args[0], services, args[1:]...)
+	}
+
+	err = client.RunCommand(composeCmd, os.Stdout, os.Stderr)
+	if event != nil {
+		event.Finish(client, err)
+	}
+	if err != nil {
 		fmt.Printf("\nError: %v\n", err)
 	}
 }
 
+// composeValueFlags are docker compose exec/run flags that take a separate value
+var composeValueFlags = map[string]bool{
+	"-e": true, "--env": true, "-u": true, "--user": true, "-w": true, "--workdir": true,
+	"--index": true, "--name": true, "--entrypoint": true, "--publish": true,
+	"-v": true, "--volume": true, "-l": true, "--label": true, "--detach-keys": true,
+	"--env-from-file": true, "--cap-add": true, "--cap-drop": true, "--pull": true,
+}
+
+// needsTTY reports whether a passthrough compose command should run in a remote PTY.
+// Only exec, run and attach are considered; they get one when -t/-it is given, or when
+// stdin is a terminal and neither -T nor -d was passed. Flags after the service name
+// belong to the container command and are ignored.
+func needsTTY(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "exec", "run", "attach":
+	default:
+		return false
+	}
+
+	explicit := false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break // service name reached
+		}
+		if composeValueFlags[arg] {
+			i++
+			continue
+		}
+		switch {
+		case arg == "-T" || arg == "--no-TTY" || arg == "-d" || arg == "--detach" || arg == "--no-stdin":
+			return false
+		case arg == "--tty" || arg == "--interactive":
+			explicit = true
+		case strings.HasPrefix(arg, "--") || strings.Contains(arg, "="):
+			continue
+		case composeValueFlags[arg[:2]]:
+			continue // value attached, e.g. -uroot
+		default:
+			// Short flag cluster such as -it or -ti
+			if strings.ContainsAny(arg[1:], "dT") {
+				return false
+			}
+			if strings.ContainsAny(arg[1:], "ti") {
+				explicit = true
+			}
+		}
+	}
+
+	return explicit || term.IsTerminal(int(os.Stdin.Fd()))
+}
+
 func runHook(args []string) {
 	cfg, err := config.LoadConfig()
 	if err != nil {
@@ -1213,7 +1587,7 @@ func runHook(args []string) {
 
 
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1221,14 +1595,42 @@ func runHook(args []string) {
 	defer client.Close()
 
 	// Build the docker compose command
-	cmdStr := strings.Join(args, " ")
-	composeCmd := fmt.Sprintf("cd %s && sudo docker compose %s", "/opt/graft/webhook/", cmdStr)
+	composeCmd := client.Compose("/opt/graft/webhook/", args...).String()
 	
 	if err := client.RunCommand(composeCmd, os.Stdout, os.Stderr); err != nil {
 		fmt.Printf("\nError: %v\n", err)
 	}
 }
-func promptNewServer(reader *bufio.Reader) (string, int, string, string) {
+// installLockScript puts graft-lock on the server, or updates it, so scripts there can run
+// under the deploy lock of a project
+func installLockScript(client *ssh.Client) {
+	lockScript := filepath.Join(os.TempDir(), "graft-lock")
+	os.WriteFile(lockScript, []byte(deploy.LockScript()), 0755)
+	defer os.Remove(lockScript)
+	client.RunCommand(client.MkdirOwned(path.Dir(deploy.HookLockPath)).String(), nil, nil)
+	if err := client.UploadFile(lockScript, deploy.HookLockPath); err != nil {
+		fmt.Printf("⚠️  Could not install %s: %v\n", deploy.HookLockPath, err)
+		return
+	}
+	client.RunCommand(shell.New("chmod", "+x", deploy.HookLockPath).String(), nil, nil)
+}
+
+func promptNewServer(reader *bufio.Reader) config.ServerConfig {
+	// Offer hosts already described in ~/.ssh/config
+	if sshCfg, err := ssh.LoadSSHConfig(ssh.SSHConfigPath()); err == nil {
+		if aliases := sshCfg.Aliases(); len(aliases) > 0 {
+			fmt.Printf("Hosts in ~/.ssh/config: %s\n", strings.Join(aliases, ", "))
+			fmt.Print("SSH config alias (leave empty to enter details manually): ")
+			alias, _ := reader.ReadString('\n')
+			alias = strings.TrimSpace(alias)
+			if alias != "" {
+				resolved := sshCfg.Resolve(alias)
+				fmt.Printf("✅ Using %s@%s:%d from ~/.ssh/config\n", resolved.User, resolved.HostName, resolved.Port)
+				return config.ServerConfig{SSHAlias: alias}
+			}
+		}
+	}
+
 	fmt.Print("Host IP: ")
 	host, _ := reader.ReadString('\n')
 	host = strings.TrimSpace(host)
@@ -1242,11 +1644,47 @@ func promptNewServer(reader *bufio.Reader) (string, int, string, string) {
 	user, _ := reader.ReadString('\n')
 	user = strings.TrimSpace(user)
 
-	fmt.Print("Key Path: ")
-	keyPath, _ := reader.ReadString('\n')
-	keyPath = strings.TrimSpace(keyPath)
+	fmt.Println("Authentication:")
+	fmt.Println("  [1] key (private key file, prompts for passphrase if encrypted)")
+	fmt.Println("  [2] agent (ssh-agent via SSH_AUTH_SOCK)")
+	fmt.Println("  [3] password (password / keyboard-interactive)")
+	fmt.Print("Select authentication [1-3] (1): ")
+	authInput, _ := reader.ReadString('\n')
 
-	return host, port, user, keyPath
+	var authMethod, keyPath string
+	switch strings.TrimSpace(authInput) {
+	case "2":
+		authMethod = config.AuthAgent
+	case "3":
+		authMethod = config.AuthPassword
+	default:
+		authMethod = config.AuthKey
+		fmt.Print("Key Path: ")
+		keyPath, _ = reader.ReadString('\n')
+		keyPath = strings.TrimSpace(keyPath)
+	}
+
+	var jumps []config.JumpHost
+	for {
+		fmt.Print("Jump hosts (user@host:port, comma separated, leave empty for none): ")
+		jumpInput, _ := reader.ReadString('\n')
+		parsed, err := config.ParseJumpHosts(strings.TrimSpace(jumpInput))
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			continue
+		}
+		jumps = parsed
+		break
+	}
+
+	return config.ServerConfig{
+		Host:       host,
+		Port:       port,
+		User:       user,
+		KeyPath:    keyPath,
+		AuthMethod: authMethod,
+		JumpHosts:  jumps,
+	}
 }
 
 func runRegistryLs() {
@@ -1257,10 +1695,34 @@ func runRegistryLs() {
 	}
 
 	fmt.Println("\n📋 Registered Servers:")
-	fmt.Printf("%-15s %-20s %-10s %-10s\n", "Name", "Host", "User", "Port")
-	fmt.Println(strings.Repeat("-", 60))
+	fmt.Printf("%-15s %-20s %-10s %-10s %-10s %-12s\n", "Name", "Host", "User", "Port", "Auth", "Docker")
+	fmt.Println(strings.Repeat("-", 83))
 	for name, srv := range gCfg.Servers {
-		fmt.Printf("%-15s %-20s %-10s %-10d\n", name, srv.Host, srv.User, srv.Port)
+		if srv.SSHAlias != "" {
+			if resolved, err := ssh.ResolveServer(srv); err == nil {
+				srv = resolved
+			}
+		}
+		auth := srv.AuthMethod
+		if auth == "" {
+			auth = config.AuthKey
+		}
+		dockerMode := srv.DockerMode
+		if dockerMode == "" {
+			dockerMode = config.DockerSudo
+		}
+		fmt.Printf("%-15s %-20s %-10s %-10d %-10s %-12s\n", name, srv.Host, srv.User, srv.Port, auth, dockerMode)
+		for _, jump := range srv.JumpHosts {
+			hop := jump.Server(srv)
+			fmt.Printf("%-15s ↳ via %s@%s:%d\n", "", hop.User, hop.Host, hop.Port)
+		}
+		if srv.SSHAlias != "" {
+			source := "~/.ssh/config"
+			if srv.SSHConfigFile != "" {
+				source = srv.SSHConfigFile
+			}
+			fmt.Printf("%-15s ↳ from %s alias '%s'\n", "", source, srv.SSHAlias)
+		}
 	}
 	fmt.Println()
 }
@@ -1280,8 +1742,8 @@ func runProjectsLs(registryName string) {
 			return
 		}
 
-		fmt.Printf("\n🔍 Fetching projects from remote server '%s' (%s)...\n", registryName, srv.Host)
-		client, err := ssh.NewClient(srv.Host, srv.Port, srv.User, srv.KeyPath)
+		fmt.Printf("\n🔍 Fetching projects from remote server '%s' (%s)...\n", registryName, srv.DisplayHost())
+		client, err := newClient(srv)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			return
@@ -1350,7 +1812,7 @@ func runPull(registryName, projectName string) {
 	}
 
 	fmt.Printf("\n📥 Pulling project '%s' from '%s'...\n", projectName, registryName)
-	client, err := ssh.NewClient(srv.Host, srv.Port, srv.User, srv.KeyPath)
+	client, err := newClient(srv)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1382,7 +1844,7 @@ func runPull(registryName, projectName string) {
 	}
 
 	fmt.Printf("🚀 Syncing files to %s...\n", localBase)
-	if err := client.PullRsync(remotePath, localBase, os.Stdout, os.Stderr); err != nil {
+	if err := client.PullDirectory(remotePath, localBase, os.Stdout, os.Stderr); err != nil {
 		fmt.Printf("Error during pull: %v\n", err)
 		return
 	}
@@ -1415,7 +1877,7 @@ func runPull(registryName, projectName string) {
 func runRegistryAdd() {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("\n➕ Add New Server to Global Registry")
-	host, port, user, keyPath := promptNewServer(reader)
+	server := promptNewServer(reader)
 	
 	fmt.Print("Registry Name (e.g. prod-us): ")
 	registryName, _ := reader.ReadString('\n')
@@ -1436,13 +1898,8 @@ func runRegistryAdd() {
 	
 	if gCfg.Servers == nil { gCfg.Servers = make(map[string]config.ServerConfig) }
 	
-	gCfg.Servers[registryName] = config.ServerConfig{
-		RegistryName: registryName,
-		Host:         host,
-		Port:         port,
-		User:         user,
-		KeyPath:      keyPath,
-	}
+	server.RegistryName = registryName
+	gCfg.Servers[registryName] = server
 	
 	if err := config.SaveGlobalConfig(gCfg); err != nil {
 		fmt.Printf("Error saving registry: %v\n", err)
@@ -1483,6 +1940,104 @@ func runRegistryDel(name string) {
 	fmt.Printf("✅ Registry '%s' deleted.\n", name)
 }
 
+// runRegistryImportSSHConfig imports the aliases of path, or of ~/.ssh/config when path is empty
+func runRegistryImportSSHConfig(path string) {
+	// Entries from another file remember it, so connects resolve the alias against the same file
+	configFile := ""
+	if path == "" {
+		path = ssh.SSHConfigPath()
+	} else if abs, err := filepath.Abs(path); err == nil && abs != ssh.SSHConfigPath() {
+		configFile = abs
+		path = abs
+	}
+
+	sshCfg, err := ssh.LoadSSHConfig(path)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", path, err)
+		return
+	}
+
+	aliases := sshCfg.Aliases()
+	if len(aliases) == 0 {
+		fmt.Printf("No Host aliases found in %s\n", path)
+		return
+	}
+
+	gCfg, _ := config.LoadGlobalConfig()
+	if gCfg == nil {
+		gCfg = &config.GlobalConfig{
+			Servers: make(map[string]config.ServerConfig),
+			Projects: make(map[string]string),
+		}
+	}
+	if gCfg.Servers == nil { gCfg.Servers = make(map[string]config.ServerConfig) }
+
+	fmt.Printf("\n📥 Importing hosts from %s\n", path)
+	imported := 0
+	for _, alias := range aliases {
+		if _, exists := gCfg.Servers[alias]; exists {
+			fmt.Printf("⏭️  %s: already in registry, skipping\n", alias)
+			continue
+		}
+
+		resolved := sshCfg.Resolve(alias)
+		if _, err := resolved.ServerConfig(sshCfg); err != nil {
+			fmt.Printf("⚠️  %s: %v, skipping\n", alias, err)
+			continue
+		}
+
+		// Only the alias is stored so later edits to the ssh config are picked up
+		gCfg.Servers[alias] = config.ServerConfig{
+			RegistryName:  alias,
+			SSHAlias:      alias,
+			SSHConfigFile: configFile,
+		}
+		fmt.Printf("✅ %s -> %s@%s:%d\n", alias, resolved.User, resolved.HostName, resolved.Port)
+		imported++
+	}
+
+	if imported == 0 {
+		fmt.Println("Nothing to import.")
+		return
+	}
+
+	if err := config.SaveGlobalConfig(gCfg); err != nil {
+		fmt.Printf("Error saving registry: %v\n", err)
+		return
+	}
+	fmt.Printf("✅ Imported %d server(s) into the registry.\n", imported)
+}
+
+func runRegistryTrust(name string) {
+	gCfg, err := config.LoadGlobalConfig()
+	if err != nil || gCfg == nil {
+		fmt.Println("Error: Could not load global registry.")
+		return
+	}
+
+	srv, exists := gCfg.Servers[name]
+	if !exists {
+		fmt.Printf("Error: Registry '%s' not found.\n", name)
+		return
+	}
+
+	srv, err = ssh.ResolveServer(srv)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("🔐 Re-pinning host key for '%s' (%s:%d)\n", name, srv.Host, srv.Port)
+	fmt.Printf("⚠️  Only continue if you know the server was rebuilt or its host key was rotated.\n")
+	// The old pin is only replaced once the new key was fetched and confirmed
+	if err := ssh.RepinHost(srv); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("✅ Host key for '%s' trusted.\n", name)
+}
+
 func runRegistryShell(registryName string, commandArgs []string) {
 	gCfg, _ := config.LoadGlobalConfig()
 	if gCfg == nil {
@@ -1495,7 +2050,7 @@ func runRegistryShell(registryName string, commandArgs []string) {
 		return
 	}
 
-	client, err := ssh.NewClient(srv.Host, srv.Port, srv.User, srv.KeyPath)
+	client, err := newClient(srv)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1504,12 +2059,12 @@ func runRegistryShell(registryName string, commandArgs []string) {
 
 	if len(commandArgs) == 0 {
 		// Interactive SSH
-		fmt.Printf("💻 Starting interactive SSH session on '%s' (%s)...\n", registryName, srv.Host)
+		fmt.Printf("💻 Starting interactive SSH session on '%s' (%s)...\n", registryName, srv.DisplayHost())
 		if err := client.InteractiveSession(); err != nil {
 			fmt.Printf("SSH session error: %v\n", err)
 		}
 	} else {
-		// Non-interactive command
+		// Non-interactive command, handed to the remote shell exactly as typed
 		cmdStr := strings.Join(commandArgs, " ")
 		fmt.Printf("🚀 Executing on '%s': %s\n", registryName, cmdStr)
 		if err := client.RunCommand(cmdStr, os.Stdout, os.Stderr); err != nil {
@@ -1525,7 +2080,7 @@ func runHostShell(commandArgs []string) {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1534,12 +2089,12 @@ func runHostShell(commandArgs []string) {
 
 	if len(commandArgs) == 0 {
 		// Interactive SSH
-		fmt.Printf("💻 Starting interactive SSH session on '%s' (%s)...\n", cfg.Server.RegistryName, cfg.Server.Host)
+		fmt.Printf("💻 Starting interactive SSH session on '%s' (%s)...\n", cfg.Server.RegistryName, cfg.Server.DisplayHost())
 		if err := client.InteractiveSession(); err != nil {
 			fmt.Printf("SSH session error: %v\n", err)
 		}
 	} else {
-		// Non-interactive command
+		// Non-interactive command, handed to the remote shell exactly as typed
 		cmdStr := strings.Join(commandArgs, " ")
 		fmt.Printf("🚀 Executing on '%s': %s\n", cfg.Server.RegistryName, cmdStr)
 		if err := client.RunCommand(cmdStr, os.Stdout, os.Stderr); err != nil {
@@ -1569,7 +2124,7 @@ func runInfra(args []string) {
 			return
 		}
 
-		client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+		client, err := newClient(cfg.Server)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			return
@@ -1602,7 +2157,7 @@ func runInfra(args []string) {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1643,7 +2198,7 @@ func runInfraReload() {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1653,8 +2208,8 @@ func runInfraReload() {
 	fmt.Println("🔄 Reloading infrastructure (pulling latest images)...")
 	
 	// Use docker compose up -d --pull always to pull and reload
-	reloadCmd := "cd /opt/graft/infra && sudo docker compose up -d --pull always"
-	if err := client.RunCommand(reloadCmd, os.Stdout, os.Stderr); err != nil {
+	reloadCmd := client.Compose("/opt/graft/infra", "up", "-d", "--pull", "always")
+	if err := client.RunCommand(reloadCmd.String(), os.Stdout, os.Stderr); err != nil {
 		fmt.Printf("Error reloading infrastructure: %v\n", err)
 		return
 	}
@@ -1674,7 +2229,7 @@ func runHostSelfDestruct() {
 	fmt.Println("\n⚠️  WARNING: DESTRUCTIVE OPERATION ⚠️")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Printf("This will PERMANENTLY DELETE all Graft infrastructure on:\n")
-	fmt.Printf("  Host: %s\n", cfg.Server.Host)
+	fmt.Printf("  Host: %s\n", cfg.Server.DisplayHost())
 	fmt.Printf("  Registry: %s\n\n", cfg.Server.RegistryName)
 	fmt.Println("The following will be destroyed:")
 	fmt.Println("  • Gateway (Traefik) - including SSL certificates")
@@ -1703,7 +2258,7 @@ func runHostSelfDestruct() {
 		return
 	}
 
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -1741,8 +2296,8 @@ func runHostSelfDestruct() {
 			projectPath := fmt.Sprintf("/opt/graft/projects/%s", project)
 			
 			// Stop and remove all containers, volumes, and networks for this project
-			destroyCmd := fmt.Sprintf("cd %s && sudo docker compose down -v --remove-orphans 2>/dev/null || true", projectPath)
-			client.RunCommand(destroyCmd, os.Stdout, os.Stderr)
+			destroyCmd := client.Compose(projectPath, "down", "-v", "--remove-orphans").Append("2>/dev/null").Or(shell.New("true"))
+			client.RunCommand(destroyCmd.String(), os.Stdout, os.Stderr)
 		}
 	} else {
 		fmt.Println("\n[2/7] ⏭️  Skipping projects (none found)")
@@ -1750,28 +2305,32 @@ func runHostSelfDestruct() {
 	
 	// Step 3: Tear down infrastructure (Postgres, Redis)
 	fmt.Println("\n[3/7] 🗄️  Destroying infrastructure (Postgres, Redis)...")
-	infraCmd := "cd /opt/graft/infra && sudo docker compose down -v --remove-orphans 2>/dev/null || true"
-	client.RunCommand(infraCmd, os.Stdout, os.Stderr)
+	infraCmd := client.Compose("/opt/graft/infra", "down", "-v", "--remove-orphans").Append("2>/dev/null").Or(shell.New("true"))
+	client.RunCommand(infraCmd.String(), os.Stdout, os.Stderr)
 	
 	// Step 4: Tear down gateway (Traefik)
 	fmt.Println("\n[4/7] 🌐 Destroying gateway (Traefik)...")
-	gatewayCmd := "cd /opt/graft/gateway && sudo docker compose down -v --remove-orphans 2>/dev/null || true"
-	client.RunCommand(gatewayCmd, os.Stdout, os.Stderr)
+	gatewayCmd := client.Compose("/opt/graft/gateway", "down", "-v", "--remove-orphans").Append("2>/dev/null").Or(shell.New("true"))
+	client.RunCommand(gatewayCmd.String(), os.Stdout, os.Stderr)
 	
 	// Step 5: Remove all Graft-related images
 	fmt.Println("\n[5/7] 🖼️  Removing all Docker images...")
-	pruneImagesCmd := "sudo docker image prune -af"
-	client.RunCommand(pruneImagesCmd, os.Stdout, os.Stderr)
+	pruneImagesCmd := client.Docker("image", "prune", "-af")
+	client.RunCommand(pruneImagesCmd.String(), os.Stdout, os.Stderr)
 	
 	// Step 6: Remove Graft networks
 	fmt.Println("\n[6/7] 🔌 Removing Graft networks...")
-	removeNetworkCmd := "sudo docker network rm graft-public 2>/dev/null || true"
-	client.RunCommand(removeNetworkCmd, os.Stdout, os.Stderr)
+	removeNetworkCmd := client.Docker("network", "rm", "graft-public").Append("2>/dev/null").Or(shell.New("true"))
+	client.RunCommand(removeNetworkCmd.String(), os.Stdout, os.Stderr)
 	
 	// Step 7: Remove all Graft files
 	fmt.Println("\n[7/7] 📁 Removing all Graft files...")
-	removeFilesCmd := "sudo rm -rf /opt/graft"
-	if err := client.RunCommand(removeFilesCmd, os.Stdout, os.Stderr); err != nil {
+	removeFilesCmd := client.Privileged("rm", "-rf", ssh.BaseDir)
+	if client.DockerMode() != config.DockerSudo {
+		// /opt belongs to root: without sudo only the contents can go, the directory stays
+		removeFilesCmd = shell.New("find", ssh.BaseDir, "-mindepth", "1", "-delete")
+	}
+	if err := client.RunCommand(removeFilesCmd.String(), os.Stdout, os.Stderr); err != nil {
 		fmt.Printf("      ⚠️  Warning: %v\n", err)
 	}
 	
@@ -10,7 +10,6 @@ import (
 	"github.com/skssmd/graft/internal/config"
 	"github.com/skssmd/graft/internal/deploy"
 	"github.com/skssmd/graft/internal/dns"
-	"github.com/skssmd/graft/internal/ssh"
 )
 
 func runMap(args []string) {
@@ -61,7 +60,7 @@ func runMap(args []string) {
 
 	// Get server IP
 	fmt.Println("\n🌐 Detecting server IP...")
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: Could not connect to server: %v\n", err)
 		return
@@ -210,7 +209,7 @@ func runMapService(serviceName string) {
 
 	// Get server IP
 	fmt.Println("\n🌐 Detecting server IP...")
-	client, err := ssh.NewClient(cfg.Server.Host, cfg.Server.Port, cfg.Server.User, cfg.Server.KeyPath)
+	client, err := newClient(cfg.Server)
 	if err != nil {
 		fmt.Printf("Error: Could not connect to server: %v\n", err)
 		return
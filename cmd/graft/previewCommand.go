@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/audit"
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/deploy"
+	"github.com/skssmd/graft/internal/infra"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+// postgresSecret matches the secrets written by graft db <name> init
+var postgresSecret = regexp.MustCompile(`^GRAFT_POSTGRES_(.+)_URL$`)
+
+// runPreview manages the per-branch preview environments of the current project
+func runPreview(args []string) {
+	if len(args) < 1 {
+		printPreviewUsage()
+		return
+	}
+	if config.ActiveEnvironment() != "" {
+		fmt.Println("Error: previews are created from the project's default environment, drop -e")
+		return
+	}
+
+	switch args[0] {
+	case "up":
+		runPreviewUp(args[1:])
+	case "down":
+		runPreviewDown(args[1:])
+	case "ls":
+		runPreviewLs()
+	case "workflow":
+		runPreviewWorkflow()
+	default:
+		printPreviewUsage()
+	}
+}
+
+func printPreviewUsage() {
+	fmt.Println("Usage: graft preview up <branch> [--commit <hash>] [--wait[=<duration>]]")
+	fmt.Println("       graft preview down <branch> [--wait[=<duration>]]")
+	fmt.Println("       graft preview ls")
+	fmt.Println("       graft preview workflow")
+}
+
+// parsePreviewArgs reads <branch> [--commit <hash>] [--wait[=<duration>]]
+func parsePreviewArgs(args []string, allowCommit bool) (branch, commit string, wait time.Duration, ok bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if w, isWait, err := parseWaitFlag(arg); isWait {
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return "", "", 0, false
+			}
+			wait = w
+		} else if allowCommit && arg == "--commit" && i+1 < len(args) {
+			commit = args[i+1]
+			i++
+		} else if branch == "" && !strings.HasPrefix(arg, "-") {
+			branch = arg
+		} else {
+			printPreviewUsage()
+			return "", "", 0, false
+		}
+	}
+	if branch == "" {
+		printPreviewUsage()
+		return "", "", 0, false
+	}
+	if deploy.PreviewSlug(branch) == "" {
+		fmt.Printf("Error: branch '%s' has no characters usable in a host name\n", branch)
+		return "", "", 0, false
+	}
+	return branch, commit, wait, true
+}
+
+// previewDomain returns the domain previews are served under: the project's own
+func previewDomain(meta *config.ProjectMetadata) (string, error) {
+	if meta.Domain != "" {
+		return meta.Domain, nil
+	}
+	p, err := deploy.LoadProject("graft-compose.yml")
+	if err != nil {
+		return "", fmt.Errorf("error loading project: %v", err)
+	}
+	if p.Domain == "" {
+		return "", fmt.Errorf("the project has no domain to create preview hosts under\n👉 Add \"domain\": \"<domain used in graft-compose.yml>\" to .graft/project.json")
+	}
+	return p.Domain, nil
+}
+
+// runPreviewUp deploys a branch as <project>_pr_<branch>, served at <branch>.<domain>
+func runPreviewUp(args []string) {
+	branch, commit, lockWait, ok := parsePreviewArgs(args, true)
+	if !ok {
+		return
+	}
+	if _, err := os.Stat("graft-compose.yml"); err != nil {
+		fmt.Println("Error: graft-compose.yml not found. Run 'graft init' first.")
+		return
+	}
+
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return
+	}
+	domain, err := previewDomain(meta)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	secrets, err := config.LoadSecrets()
+	if err != nil {
+		fmt.Printf("Error: could not read secrets: %v\n", err)
+		return
+	}
+
+	// The preview is an environment of its own that is never written to project.json.
+	// Branches are built on the server from the exported commit, whatever the project's mode.
+	slug := deploy.PreviewSlug(branch)
+	env := &config.Environment{
+		Domain:         slug + "." + domain,
+		DeploymentMode: "direct-serverbuild",
+		Env:            make(map[string]string),
+	}
+	config.SetPreview(deploy.PreviewEnvironmentName(slug), env)
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("Error: No config found.")
+		return
+	}
+	p, err := deploy.LoadProject("graft-compose.yml")
+	if err != nil {
+		fmt.Printf("Error loading project: %v\n", err)
+		return
+	}
+	p.DeploymentMode = env.DeploymentMode
+
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	remoteDir := fmt.Sprintf("/opt/graft/projects/%s", p.Name)
+	lock := lockProject(client, remoteDir, "preview up", lockWait)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	fmt.Printf("🔍 Preview of branch '%s' as %s\n", branch, p.Name)
+	event := audit.Start(p.Name, "preview up", projectServices(p), branch)
+	event.GitCommit = deploy.CurrentCommit(true, branch, commit)
+	err = deployPreview(client, cfg, p, remoteDir, branch, commit, event, env, secrets)
+	event.Finish(client, err)
+
+	if err != nil {
+		fmt.Printf("Error during preview deploy: %v\n", err)
+		return
+	}
+	fmt.Printf("\n✅ Preview is up: https://%s\n", env.Domain)
+}
+
+// deployPreview provisions the preview's databases and deploys the branch
+func deployPreview(client *ssh.Client, cfg *config.GraftConfig, p *deploy.Project, remoteDir, branch, commit string, event *audit.Event, env *config.Environment, secrets map[string]string) error {
+	info, err := deploy.LoadPreviewInfo(client, remoteDir)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		info = &deploy.PreviewInfo{Name: p.Name, CreatedAt: time.Now().UTC()}
+	}
+	info.Branch = branch
+	info.Commit = event.GitCommit
+	info.Host = env.Domain
+	info.User = event.User
+	info.UpdatedAt = time.Now().UTC()
+
+	// Every Postgres database of the project gets a throwaway copy for the preview,
+	// which the ${GRAFT_POSTGRES_<NAME>_URL} references then point at
+	var keys []string
+	for key := range secrets {
+		if postgresSecret.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ToLower(postgresSecret.FindStringSubmatch(key)[1]) + "_" + config.ActiveEnvironment()
+		url, err := infra.InitPostgres(client, name, cfg, os.Stdout, os.Stderr)
+		if err != nil {
+			return err
+		}
+		env.Env[key] = url
+		if !slices.Contains(info.Databases, name) {
+			info.Databases = append(info.Databases, name)
+		}
+	}
+
+	// Recorded before deploying, so a failed preview can still be taken down
+	if err := deploy.SavePreviewInfo(client, remoteDir, info); err != nil {
+		return err
+	}
+	return deploy.Sync(client, p, false, false, false, true, branch, commit, 1, os.Stdout, os.Stderr)
+}
+
+// runPreviewDown removes the preview of a branch with its containers, volumes and databases
+func runPreviewDown(args []string) {
+	branch, _, lockWait, ok := parsePreviewArgs(args, false)
+	if !ok {
+		return
+	}
+
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return
+	}
+	config.SetPreview(deploy.PreviewEnvironmentName(deploy.PreviewSlug(branch)), &config.Environment{})
+	name := config.EnvironmentProjectName(meta.Name)
+	remoteDir := fmt.Sprintf("/opt/graft/projects/%s", name)
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("Error: No config found.")
+		return
+	}
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	info, err := deploy.LoadPreviewInfo(client, remoteDir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if info == nil {
+		fmt.Printf("No preview of branch '%s' found on the server.\n", branch)
+		return
+	}
+
+	lock := lockProject(client, remoteDir, "preview down", lockWait)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	event := audit.Start(name, "preview down", nil, branch)
+	event.GitCommit = info.Commit
+	err = deploy.RemovePreview(client, remoteDir, os.Stdout, os.Stderr)
+	for _, db := range info.Databases {
+		if err != nil {
+			break
+		}
+		err = infra.DropPostgres(client, db, cfg, os.Stdout, os.Stderr)
+	}
+	event.Finish(client, err)
+
+	if err != nil {
+		fmt.Printf("Error removing preview: %v\n", err)
+		return
+	}
+	fmt.Printf("\n✅ Preview of branch '%s' removed\n", branch)
+}
+
+// runPreviewLs lists the previews of the current project on its server
+func runPreviewLs() {
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return
+	}
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("Error: No config found.")
+		return
+	}
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	previews, err := deploy.ListPreviews(client, meta.Name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(previews) == 0 {
+		fmt.Printf("No previews of '%s' on %s.\n", meta.Name, cfg.Server.DisplayHost())
+		return
+	}
+
+	fmt.Printf("\n🔍 Previews of '%s':\n", meta.Name)
+	fmt.Printf("  %-24s %-8s %-36s %-19s %s\n", "Branch", "Commit", "Host", "Updated", "Databases")
+	fmt.Println("  " + strings.Repeat("-", 105))
+	for _, p := range previews {
+		commit := p.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		if commit == "" {
+			commit = "-"
+		}
+		fmt.Printf("  %-24s %-8s %-36s %-19s %s\n", p.Branch, commit, p.Host, p.UpdatedAt.Local().Format("2006-01-02 15:04:05"), strings.Join(p.Databases, ", "))
+	}
+	fmt.Println()
+}
+
+// runPreviewWorkflow generates the GitHub workflow that runs previews for pull requests
+func runPreviewWorkflow() {
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return
+	}
+	domain, err := previewDomain(meta)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if err := deploy.GeneratePreviewWorkflow(&deploy.Project{Name: meta.Name}, domain); err != nil {
+		fmt.Printf("Error generating workflow: %v\n", err)
+		return
+	}
+	fmt.Println("✅ Preview workflow created in .github/workflows/preview.yml")
+	fmt.Println("👉 Add the GRAFT_HOST, GRAFT_USER, GRAFT_SSH_KEY, GRAFT_KNOWN_HOSTS, GRAFT_SECRETS and GRAFT_COMPOSE repository secrets")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/audit"
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/deploy"
+)
+
+// runReleases lists the releases of the project on the server, or sets how many are kept
+func runReleases(args []string) {
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return
+	}
+
+	if len(args) > 0 && args[0] == "keep" {
+		if len(args) < 2 {
+			fmt.Println("Usage: graft releases keep <n>")
+			return
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			fmt.Printf("Error: invalid number of releases '%s'\n", args[1])
+			return
+		}
+		meta.KeepReleases = n
+		if err := config.SaveProjectMetadata(meta); err != nil {
+			fmt.Printf("Error: Could not save project metadata: %v\n", err)
+			return
+		}
+		fmt.Printf("✅ Keeping the %d most recent releases (applied on the next sync)\n", n)
+		return
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("Error: No config found.")
+		return
+	}
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	releases, current, err := deploy.ListReleases(client, meta.RemotePath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(releases) == 0 {
+		fmt.Println("No releases recorded yet. Every 'graft sync' records one.")
+		return
+	}
+
+	keep := meta.KeepReleases
+	if keep == 0 {
+		keep = deploy.DefaultKeepReleases
+	}
+	fmt.Printf("\n📦 Releases of %s (keeping %d):\n", meta.Name, keep)
+	fmt.Printf("  %-22s %-20s %-9s %s\n", "ID", "Created", "Commit", "Services")
+	fmt.Println("  " + strings.Repeat("-", 75))
+	for i := len(releases) - 1; i >= 0; i-- {
+		r := releases[i]
+		marker := " "
+		if r.ID == current {
+			marker = "*"
+		}
+		commit := r.GitCommit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		if commit == "" {
+			commit = "-"
+		}
+		var services []string
+		for name := range r.Services {
+			services = append(services, name)
+		}
+		sort.Strings(services)
+		fmt.Printf("%s %-22s %-20s %-9s %s\n", marker, r.ID, r.CreatedAt.Local().Format("2006-01-02 15:04:05"), commit, strings.Join(services, ", "))
+	}
+	fmt.Println("\n* active release. Roll back with: graft rollback [release-id]")
+}
+
+// runRollback reactivates a previous release on the server
+func runRollback(args []string) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("Error: No config found.")
+		return
+	}
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return
+	}
+
+	var id string
+	var lockWait time.Duration
+	for _, arg := range args {
+		if wait, ok, err := parseWaitFlag(arg); ok {
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			lockWait = wait
+		} else if id == "" {
+			id = arg
+		}
+	}
+
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	lock := lockProject(client, meta.RemotePath, "rollback", lockWait)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	event := audit.Start(meta.Name, "rollback", nil, args...)
+	err = deploy.RollbackRelease(client, meta.RemotePath, id, os.Stdout, os.Stderr)
+	event.Finish(client, err)
+	if err != nil {
+		fmt.Printf("Error during rollback: %v\n", err)
+		return
+	}
+	fmt.Println("\n✅ Rollback complete!")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/audit"
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/deploy"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+func printTaskUsage() {
+	fmt.Println("Usage: graft task <name> [args...]")
+	fmt.Println("       graft task ls")
+	fmt.Println("       graft task history [<name>] [-n <count>]")
+	fmt.Println("       graft task logs [<name>|<run-id>]")
+}
+
+// runTaskCommand dispatches graft task and returns the exit code graft should exit with:
+// the task container's own when a task ran
+func runTaskCommand(args []string) int {
+	if len(args) < 1 {
+		printTaskUsage()
+		return 1
+	}
+
+	tasks, err := deploy.LoadTasks("graft-compose.yml")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if args[0] == "ls" {
+		listTasks(tasks)
+		return 0
+	}
+
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+		return 1
+	}
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Println("Error: No config found.")
+		return 1
+	}
+	client, err := newClient(cfg.Server)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	defer client.Close()
+
+	switch args[0] {
+	case "history":
+		return showTaskHistory(client, meta, args[1:])
+	case "logs":
+		return showTaskLog(client, meta, args[1:])
+	}
+
+	name := args[0]
+	task, ok := tasks[name]
+	if !ok {
+		fmt.Printf("Error: no task '%s' in graft-compose.yml\n", name)
+		if len(tasks) > 0 {
+			fmt.Printf("👉 Available tasks: %s\n", strings.Join(deploy.TaskNames(tasks), ", "))
+		}
+		return 1
+	}
+
+	fmt.Printf("🧰 Running task '%s' in a fresh %s container: %s\n", name, task.Service, task.Command)
+	event := audit.Start(meta.Name, "task", []string{task.Service}, args...)
+	run := &deploy.TaskRun{
+		User:      event.User,
+		Host:      event.Host,
+		GitCommit: event.GitCommit,
+		StartedAt: event.Time,
+	}
+	err = deploy.RunTask(client, meta.RemotePath, name, task, args[1:], run, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Printf("⚠️  Could not record the run in the task history: %v\n", err)
+	}
+
+	var outcome error
+	if run.Error != "" {
+		outcome = fmt.Errorf("%s", run.Error)
+	} else if run.ExitCode != 0 {
+		outcome = fmt.Errorf("exit code %d", run.ExitCode)
+	}
+	event.Finish(client, outcome)
+
+	duration := (time.Duration(run.DurationMS) * time.Millisecond).Round(time.Second)
+	switch {
+	case run.Error != "":
+		fmt.Printf("\n❌ Task '%s' did not complete after %s: %s\n", name, duration, run.Error)
+	case run.ExitCode != 0:
+		fmt.Printf("\n❌ Task '%s' exited with code %d after %s (run %s)\n", name, run.ExitCode, duration, run.ID)
+	default:
+		fmt.Printf("\n✅ Task '%s' finished in %s (run %s)\n", name, duration, run.ID)
+	}
+	return run.ExitCode
+}
+
+// listTasks prints the tasks declared in graft-compose.yml
+func listTasks(tasks map[string]deploy.Task) {
+	if len(tasks) == 0 {
+		fmt.Println("No tasks declared. Add them to graft-compose.yml under x-graft-tasks:")
+		fmt.Println("  x-graft-tasks:")
+		fmt.Println("    migrate:")
+		fmt.Println("      service: backend")
+		fmt.Println("      command: ./migrate up")
+		return
+	}
+	fmt.Println("\n🧰 Tasks:")
+	for _, name := range deploy.TaskNames(tasks) {
+		task := tasks[name]
+		fmt.Printf("  %-16s %-16s %s\n", name, task.Service, task.Command)
+		if task.Description != "" {
+			fmt.Printf("  %-16s %-16s ↳ %s\n", "", "", task.Description)
+		}
+	}
+}
+
+// showTaskHistory lists the recorded task runs, newest first
+func showTaskHistory(client *ssh.Client, meta *config.ProjectMetadata, args []string) int {
+	var task string
+	limit := 20
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-n" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				fmt.Printf("Error: invalid -n value '%s'\n", args[i+1])
+				return 1
+			}
+			limit = n
+			i++
+		} else if task == "" && !strings.HasPrefix(args[i], "-") {
+			task = args[i]
+		} else {
+			printTaskUsage()
+			return 1
+		}
+	}
+
+	runs, err := deploy.ListTaskRuns(client, meta.RemotePath, task)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if len(runs) == 0 {
+		fmt.Println("No task runs recorded yet.")
+		return 0
+	}
+	if len(runs) > limit {
+		runs = runs[len(runs)-limit:]
+	}
+
+	fmt.Printf("\n🧰 Task runs of %s:\n", meta.Name)
+	fmt.Printf("  %-35s %-19s %-22s %-8s %-9s %s\n", "Run", "Started", "User", "Commit", "Duration", "Exit")
+	fmt.Println("  " + strings.Repeat("-", 105))
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		marker := "✅"
+		exit := strconv.Itoa(r.ExitCode)
+		if r.Error != "" {
+			marker = "❌"
+			exit += " (" + strings.SplitN(r.Error, "\n", 2)[0] + ")"
+		} else if r.ExitCode != 0 {
+			marker = "❌"
+		}
+		commit := r.GitCommit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		if commit == "" {
+			commit = "-"
+		}
+		duration := (time.Duration(r.DurationMS) * time.Millisecond).Round(time.Second)
+		fmt.Printf("%s %-35s %-19s %-22s %-8s %-9s %s\n", marker, r.ID, r.StartedAt.Local().Format("2006-01-02 15:04:05"), r.User+"@"+r.Host, commit, duration, exit)
+	}
+	return 0
+}
+
+// showTaskLog prints the captured output of a run: the given one, the last run of the
+// given task, or the last run of any task
+func showTaskLog(client *ssh.Client, meta *config.ProjectMetadata, args []string) int {
+	if len(args) > 1 {
+		printTaskUsage()
+		return 1
+	}
+	runs, err := deploy.ListTaskRuns(client, meta.RemotePath, "")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	var run *deploy.TaskRun
+	for i := len(runs) - 1; i >= 0 && run == nil; i-- {
+		if len(args) == 0 || runs[i].ID == args[0] || runs[i].Task == args[0] {
+			run = &runs[i]
+		}
+	}
+	if run == nil {
+		if len(args) == 0 {
+			fmt.Println("No task runs recorded yet.")
+		} else {
+			fmt.Printf("Error: no run of '%s' recorded\n", args[0])
+		}
+		return 1
+	}
+
+	fmt.Printf("📜 Run %s of '%s' (exit code %d):\n\n", run.ID, run.Task, run.ExitCode)
+	if err := deploy.TaskLog(client, meta.RemotePath, run.ID, os.Stdout); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
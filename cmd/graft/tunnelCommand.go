@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+// Default ports of the shared infrastructure containers
+var infraTunnelPorts = map[string]int{
+	"graft-postgres": 5432,
+	"graft-redis":    6379,
+}
+
+func runTunnel(registryContext string, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: graft tunnel <graft-postgres|graft-redis|service:port> [local-port]")
+		return
+	}
+	target := args[0]
+
+	// Resolve the container and port to forward to
+	var service string
+	remotePort, isInfra := infraTunnelPorts[target]
+	if !isInfra {
+		idx := strings.LastIndex(target, ":")
+		if idx <= 0 {
+			fmt.Println("Error: target must be graft-postgres, graft-redis or <service>:<port>")
+			return
+		}
+		port, err := strconv.Atoi(target[idx+1:])
+		if err != nil || port <= 0 || port > 65535 {
+			fmt.Printf("Error: invalid port in '%s'\n", target)
+			return
+		}
+		service = target[:idx]
+		remotePort = port
+	}
+
+	localPort := remotePort
+	if len(args) > 1 {
+		port, err := strconv.Atoi(args[1])
+		if err != nil || port <= 0 || port > 65535 {
+			fmt.Printf("Error: invalid local port '%s'\n", args[1])
+			return
+		}
+		localPort = port
+	}
+
+	// Infra tunnels work against any registered server, service tunnels need the project
+	var srv config.ServerConfig
+	var remotePath string
+	if registryContext != "" {
+		if !isInfra {
+			fmt.Println("Error: service tunnels need a project context, use 'graft -p <project> tunnel ...'")
+			return
+		}
+		gCfg, _ := config.LoadGlobalConfig()
+		if gCfg == nil || gCfg.Servers == nil {
+			fmt.Println("Error: Could not load global registry.")
+			return
+		}
+		s, exists := gCfg.Servers[registryContext]
+		if !exists {
+			fmt.Printf("Error: Registry '%s' not found.\n", registryContext)
+			return
+		}
+		srv = s
+	} else {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Println("Error: No config found. Run 'graft init' first or use 'graft -r <registry> tunnel ...'")
+			return
+		}
+		srv = cfg.Server
+		if !isInfra {
+			meta, err := config.LoadProjectMetadata()
+			if err != nil {
+				fmt.Println("Error: Could not load project metadata. Run 'graft init' first.")
+				return
+			}
+			remotePath = meta.RemotePath
+		}
+	}
+
+	client, err := newClient(srv)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	container := target
+	if !isInfra {
+		container, err = serviceContainer(client, remotePath, service)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
+	ip, network, err := containerAddress(client, container)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	localAddr := fmt.Sprintf("127.0.0.1:%d", localPort)
+	remoteAddr := fmt.Sprintf("%s:%d", ip, remotePort)
+	fmt.Printf("🚇 Tunnel open: %s -> %s (%s on %s)\n", localAddr, target, remoteAddr, network)
+	printTunnelHint(client, target, localPort)
+	fmt.Println("   Press Ctrl+C to close the tunnel.")
+
+	if err := client.ForwardLocal(rootCtx, localAddr, remoteAddr, os.Stdout); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// serviceContainer returns the id of the first running container of a project service
+func serviceContainer(client *ssh.Client, remotePath, service string) (string, error) {
+	var out, errOut bytes.Buffer
+	cmd := client.Compose(remotePath, "ps", "-q", service)
+	if err := client.RunCommand(cmd.String(), &out, &errOut); err != nil {
+		return "", fmt.Errorf("failed to find container for '%s': %v %s", service, err, strings.TrimSpace(errOut.String()))
+	}
+	ids := strings.Fields(out.String())
+	if len(ids) == 0 {
+		return "", fmt.Errorf("service '%s' has no running container", service)
+	}
+	return ids[0], nil
+}
+
+// containerAddress returns the container's IP on graft-public, or on its first network otherwise
+func containerAddress(client *ssh.Client, container string) (string, string, error) {
+	var out, errOut bytes.Buffer
+	format := `{{range $name, $net := .NetworkSettings.Networks}}{{$name}} {{$net.IPAddress}}{{"\n"}}{{end}}`
+	cmd := client.Docker("inspect", "-f", format, container)
+	if err := client.RunCommand(cmd.String(), &out, &errOut); err != nil {
+		return "", "", fmt.Errorf("failed to inspect container '%s': %v %s", container, err, strings.TrimSpace(errOut.String()))
+	}
+
+	var fallbackIP, fallbackNet string
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[0] == "graft-public" {
+			return fields[1], fields[0], nil
+		}
+		if fallbackIP == "" {
+			fallbackIP, fallbackNet = fields[1], fields[0]
+		}
+	}
+	if fallbackIP == "" {
+		return "", "", fmt.Errorf("container '%s' has no network address (is it running?)", container)
+	}
+	return fallbackIP, fallbackNet, nil
+}
+
+// printTunnelHint shows how to connect a client to an infra tunnel
+func printTunnelHint(client *ssh.Client, target string, localPort int) {
+	switch target {
+	case "graft-redis":
+		fmt.Printf("   Connect with: redis-cli -h 127.0.0.1 -p %d\n", localPort)
+	case "graft-postgres":
+		user, db := "<user>", "<database>"
+		tmpFile := filepath.Join(os.TempDir(), "tunnel_infra.config")
+		if err := client.DownloadFile(config.RemoteInfraPath, tmpFile); err == nil {
+			data, _ := os.ReadFile(tmpFile)
+			var infraCfg config.InfraConfig
+			if json.Unmarshal(data, &infraCfg) == nil && infraCfg.PostgresUser != "" {
+				user, db = infraCfg.PostgresUser, infraCfg.PostgresDB
+			}
+			os.Remove(tmpFile)
+		}
+		fmt.Printf("   Connect with: psql -h 127.0.0.1 -p %d -U %s %s\n", localPort, user, db)
+	}
+}
@@ -0,0 +1,146 @@
+// Package audit records every change graft makes to a server in an append-only log of
+// JSON lines, shared by all projects on that server.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/git"
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+// LogDir holds the audit log on the server. It is owned by the deploying user so
+// events can be appended without sudo.
+const LogDir = "/opt/graft/audit"
+
+// LogPath is the audit log on the server
+var LogPath = path.Join(LogDir, "events.log")
+
+// Outcomes of an event
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is one mutating graft command
+type Event struct {
+	Time       time.Time `json:"time"`
+	Project    string    `json:"project"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args,omitempty"`
+	User       string    `json:"user"`
+	Host       string    `json:"host"`
+	GitCommit  string    `json:"git_commit,omitempty"`
+	Services   []string  `json:"services,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Start begins an event for command on project. The git commit is HEAD of the working
+// directory when it is a git repository; callers deploying another commit overwrite it.
+func Start(project, command string, services []string, args ...string) *Event {
+	e := &Event{
+		Time:     time.Now().UTC(),
+		Project:  project,
+		Command:  command,
+		Args:     args,
+		Services: services,
+	}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	e.Host, _ = os.Hostname()
+	if git.HasGitRepo(".") {
+		e.GitCommit, _ = git.GetLatestCommit(".", "HEAD")
+	}
+	return e
+}
+
+// Finish records the outcome of the event in the server's audit log. Failing to write the
+// log never fails the command itself, it only prints a warning.
+func (e *Event) Finish(client *ssh.Client, err error) {
+	e.DurationMS = time.Since(e.Time).Milliseconds()
+	e.Outcome = Success
+	if err != nil {
+		e.Outcome = Failure
+		e.Error = err.Error()
+	}
+	if werr := Append(client, e); werr != nil {
+		fmt.Fprintf(os.Stderr, "⚠️  Could not write audit log: %v\n", werr)
+	}
+}
+
+// Append writes an event to the audit log on the server
+func Append(client *ssh.Client, e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cmd := shell.New("test", "-w", LogDir).Or(client.MkdirOwned(LogDir)).
+		And(shell.New("printf", "%s\\n", string(data)).Append(">> " + shell.Quote(LogPath)))
+	// Not bound to the command context, so interrupted deploys are recorded too
+	return client.RunCommandContext(context.Background(), cmd.String(), nil, nil)
+}
+
+// Filter selects events from the log; zero values match everything
+type Filter struct {
+	Project string
+	Service string
+	Since   time.Time
+}
+
+func (f Filter) match(e Event) bool {
+	if f.Project != "" && e.Project != f.Project {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if f.Service != "" {
+		// Events without services touched the whole project
+		if len(e.Services) == 0 {
+			return true
+		}
+		for _, s := range e.Services {
+			if s == f.Service {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Read returns the events of the server's audit log matching filter, oldest first
+func Read(client *ssh.Client, filter Filter) ([]Event, error) {
+	var out bytes.Buffer
+	read := shell.New("cat", LogPath).Append("2>/dev/null").Or(shell.New("true"))
+	if err := client.RunCommand(read.String(), &out, nil); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+
+	var events []Event
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			continue // skip a line cut short by a concurrent write
+		}
+		if filter.match(e) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
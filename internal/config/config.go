@@ -4,21 +4,115 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 const RemoteInfraPath = "/opt/graft/infra/.config"
 const RemoteProjectsPath = "/opt/graft/config/projects.json"
 
+// SSH authentication methods for a server
+const (
+	AuthKey      = "key"      // private key file (prompts for the passphrase if encrypted)
+	AuthAgent    = "agent"    // keys held by the ssh-agent at SSH_AUTH_SOCK
+	AuthPassword = "password" // password / keyboard-interactive, prompted on connect
+)
+
+// Docker privilege modes: how docker is invoked on a server
+const (
+	DockerSudo     = "sudo"         // sudo docker (default)
+	DockerGroup    = "docker-group" // deploy user is in the docker group
+	DockerRootless = "rootless"     // rootless Docker daemon owned by the deploy user
+)
+
 type ServerConfig struct {
-	RegistryName string `json:"registry_name,omitempty"`
-	Host         string `json:"host"`
-	Port         int    `json:"port"`
-	User         string `json:"user"`
-	KeyPath      string `json:"key_path"`
-	GraftHookURL string `json:"graft_hook_url,omitempty"`
+	RegistryName   string     `json:"registry_name,omitempty"`
+	Host           string     `json:"host"`
+	Port           int        `json:"port"`
+	User           string     `json:"user"`
+	KeyPath        string     `json:"key_path"`
+	AuthMethod     string     `json:"auth_method,omitempty"`     // "key" (default), "agent" or "password"
+	JumpHosts      []JumpHost `json:"jump_hosts,omitempty"`      // bastions to hop through, in order
+	SSHAlias       string     `json:"ssh_alias,omitempty"`       // ~/.ssh/config Host alias, fills unset fields on connect
+	SSHConfigFile  string     `json:"ssh_config,omitempty"`      // ssh_config file the alias comes from (empty = ~/.ssh/config)
+	CommandTimeout string     `json:"command_timeout,omitempty"` // limit for each remote command, e.g. "30m" (empty = none)
+	DockerMode     string     `json:"docker_mode,omitempty"`     // "sudo" (default), "docker-group" or "rootless"
+	GraftHookURL   string     `json:"graft_hook_url,omitempty"`
+}
+
+// DisplayHost returns the host for messages, falling back to the ssh_config alias
+func (s ServerConfig) DisplayHost() string {
+	if s.Host == "" && s.SSHAlias != "" {
+		return s.SSHAlias + " (ssh config)"
+	}
+	return s.Host
+}
+
+// JumpHost is a bastion the SSH connection has to pass through (like ssh -J)
+type JumpHost struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port,omitempty"`
+	User       string `json:"user,omitempty"`
+	KeyPath    string `json:"key_path,omitempty"`
+	AuthMethod string `json:"auth_method,omitempty"`
+}
+
+// Server returns the jump host as a server config, filling defaults from the target server
+func (j JumpHost) Server(target ServerConfig) ServerConfig {
+	srv := ServerConfig{
+		Host:       j.Host,
+		Port:       j.Port,
+		User:       j.User,
+		KeyPath:    j.KeyPath,
+		AuthMethod: j.AuthMethod,
+	}
+	if srv.Port == 0 {
+		srv.Port = 22
+	}
+	if srv.User == "" {
+		srv.User = target.User
+	}
+	if srv.KeyPath == "" && srv.AuthMethod == "" {
+		srv.KeyPath = target.KeyPath
+		srv.AuthMethod = target.AuthMethod
+	}
+	return srv
+}
+
+// ParseJumpHosts parses a ProxyJump style list ("user@host:port,host2") into jump hosts
+func ParseJumpHosts(spec string) ([]JumpHost, error) {
+	var jumps []JumpHost
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var jump JumpHost
+		if at := strings.LastIndex(part, "@"); at >= 0 {
+			jump.User = part[:at]
+			part = part[at+1:]
+		}
+		host, portStr, err := net.SplitHostPort(part)
+		if err != nil {
+			// No port given
+			host = strings.Trim(part, "[]")
+		} else {
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in jump host %q", part)
+			}
+			jump.Port = port
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid jump host %q", part)
+		}
+		jump.Host = host
+		jumps = append(jumps, jump)
+	}
+	return jumps, nil
 }
 
 type InfraConfig struct {
@@ -70,7 +164,24 @@ func GetLocalConfigPath() string {
 	return filepath.Join(".graft", "config.json")
 }
 
+// LoadConfig loads the project configuration. With an active environment that has its own
+// server, that server is used.
 func LoadConfig() (*GraftConfig, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return cfg, err
+	}
+	srv, err := environmentServer()
+	if err != nil {
+		return nil, err
+	}
+	if srv != nil {
+		cfg.Server = *srv
+	}
+	return cfg, nil
+}
+
+func loadConfig() (*GraftConfig, error) {
 	// Try local first
 	localPath := GetLocalConfigPath()
 	cfg, err := loadFile(localPath)
@@ -165,6 +276,15 @@ func SaveConfig(cfg *GraftConfig, local bool) error {
 		path = GetLocalConfigPath()
 	}
 
+	// The server of an environment lives in the registry, keep the project's own server
+	if local && activeEnvironment != "" {
+		if base, err := loadFile(path); err == nil {
+			merged := *cfg
+			merged.Server = base.Server
+			cfg = &merged
+		}
+	}
+
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
@@ -204,7 +324,9 @@ func SaveSecret(key, value string) error {
 		return err
 	}
 	
-	path := filepath.Join(dir, "secrets.env")
+	// With an active environment, secrets belong to that environment
+	files := secretsFiles()
+	path := files[len(files)-1]
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
@@ -215,18 +337,28 @@ func SaveSecret(key, value string) error {
 	return err
 }
 
+// LoadSecrets reads .graft/secrets.env and, with an active environment, its
+// .graft/secrets.<environment>.env on top
 func LoadSecrets() (map[string]string, error) {
-	path := filepath.Join(".graft", "secrets.env")
+	secrets := make(map[string]string)
+	for _, path := range secretsFiles() {
+		if err := readSecrets(path, secrets); err != nil {
+			return nil, err
+		}
+	}
+	return secrets, nil
+}
+
+func readSecrets(path string, secrets map[string]string) error {
 	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return make(map[string]string), nil
+			return nil
 		}
-		return nil, err
+		return err
 	}
 	defer file.Close()
 
-	secrets := make(map[string]string)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -236,7 +368,7 @@ func LoadSecrets() (map[string]string, error) {
 		}
 	}
 
-	return secrets, scanner.Err()
+	return scanner.Err()
 }
 
 // ProjectMetadata stores local project information
@@ -246,10 +378,24 @@ type ProjectMetadata struct {
 	Initialized    bool   `json:"initialized"`
 	DeploymentMode string `json:"deployment_mode,omitempty"` // "git-images", "git-repo-serverbuild", "git-manual", "direct-serverbuild", "direct-localbuild"
 	GraftHookURL   string `json:"graft_hook_url,omitempty"`
+	KeepReleases   int    `json:"keep_releases,omitempty"` // releases kept on the server, 0 = default
+	Domain         string `json:"domain,omitempty"`        // domain used in graft-compose.yml
+
+	// Named environments (graft -e <name>), each deployed as <name>_<environment>
+	Environments map[string]Environment `json:"environments,omitempty"`
+	Environment  string                 `json:"-"` // environment applied by LoadProjectMetadata
 }
 
 // SaveProjectMetadata saves project metadata to .graft/project.json and registers it globally
 func SaveProjectMetadata(meta *ProjectMetadata) error {
+	if meta.Environment != "" {
+		base, err := mergeEnvironment(meta)
+		if err != nil {
+			return err
+		}
+		meta = base
+	}
+
 	dir := ".graft"
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
@@ -277,18 +423,15 @@ func SaveProjectMetadata(meta *ProjectMetadata) error {
 	return nil
 }
 
-// LoadProjectMetadata loads project metadata from .graft/project.json
+// LoadProjectMetadata loads project metadata from .graft/project.json. With an active
+// environment, the metadata of that environment is returned.
 func LoadProjectMetadata() (*ProjectMetadata, error) {
-	path := filepath.Join(".graft", "project.json")
-	data, err := os.ReadFile(path)
+	meta, err := readProjectMetadata()
 	if err != nil {
 		return nil, err
 	}
-
-	var meta ProjectMetadata
-	if err := json.Unmarshal(data, &meta); err != nil {
+	if err := meta.applyEnvironment(); err != nil {
 		return nil, err
 	}
-
-	return &meta, nil
+	return meta, nil
 }
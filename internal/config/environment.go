@@ -0,0 +1,176 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// activeEnvironment is the environment selected with graft -e <name>, empty for the default
+var activeEnvironment string
+
+// environmentName is the form environment names must have: they end up in the project
+// name on the server, remote paths and secrets file names
+var environmentName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// SetEnvironment selects the environment every command of this run works on. The name
+// must be defined in .graft/project.json.
+func SetEnvironment(name string) error {
+	if !environmentName.MatchString(name) {
+		return fmt.Errorf("invalid environment name '%s': use lower case letters, digits, '-' and '_'", name)
+	}
+	meta, err := readProjectMetadata()
+	if err != nil {
+		return err
+	}
+	if _, ok := meta.Environments[name]; !ok {
+		return fmt.Errorf("environment '%s' is not defined in .graft/project.json", name)
+	}
+	activeEnvironment = name
+	return nil
+}
+
+// previewEnvironment holds the settings of a branch preview. Previews are set up by graft
+// preview and never stored in .graft/project.json.
+var previewEnvironment *Environment
+
+// SetPreview selects a branch preview as the environment of this run
+func SetPreview(name string, env *Environment) {
+	activeEnvironment = name
+	previewEnvironment = env
+}
+
+// ActiveEnvironment returns the environment selected with -e, or "" for the default
+func ActiveEnvironment() string {
+	return activeEnvironment
+}
+
+// Environment is a named deployment of a project, e.g. staging, kept in .graft/project.json
+type Environment struct {
+	Server         string            `json:"server,omitempty"`          // registry name of the server, defaults to the project's
+	Domain         string            `json:"domain,omitempty"`          // replaces the project's domain in labels
+	DeploymentMode string            `json:"deployment_mode,omitempty"` // defaults to the project's
+	Env            map[string]string `json:"env,omitempty"`             // overrides service environment variables
+	Initialized    bool              `json:"initialized,omitempty"`
+}
+
+// EnvironmentProjectName returns the name a project has on the server in the active
+// environment: <project>_<environment>
+func EnvironmentProjectName(project string) string {
+	if activeEnvironment == "" {
+		return project
+	}
+	return project + "_" + activeEnvironment
+}
+
+// CurrentEnvironment returns the settings of the active environment, nil without one
+func (m *ProjectMetadata) CurrentEnvironment() *Environment {
+	if m.Environment == "" {
+		return nil
+	}
+	if previewEnvironment != nil {
+		return previewEnvironment
+	}
+	env := m.Environments[m.Environment]
+	return &env
+}
+
+// applyEnvironment turns the project metadata into that of the active environment
+func (m *ProjectMetadata) applyEnvironment() error {
+	if activeEnvironment == "" {
+		return nil
+	}
+	env, ok := m.Environments[activeEnvironment]
+	if previewEnvironment != nil {
+		env, ok = *previewEnvironment, true
+	}
+	if !ok {
+		return fmt.Errorf("environment '%s' is not defined in .graft/project.json", activeEnvironment)
+	}
+	m.Environment = activeEnvironment
+	m.Name = EnvironmentProjectName(m.Name)
+	m.RemotePath = fmt.Sprintf("/opt/graft/projects/%s", m.Name)
+	if env.DeploymentMode != "" {
+		m.DeploymentMode = env.DeploymentMode
+	}
+	m.Initialized = env.Initialized
+	return nil
+}
+
+// mergeEnvironment stores what a command changed in environment metadata back into the
+// project metadata it came from
+func mergeEnvironment(meta *ProjectMetadata) (*ProjectMetadata, error) {
+	base, err := readProjectMetadata()
+	if err != nil {
+		return nil, err
+	}
+	base.GraftHookURL = meta.GraftHookURL
+	base.KeepReleases = meta.KeepReleases
+	if previewEnvironment != nil {
+		return base, nil
+	}
+	env := base.Environments[meta.Environment]
+	if env.DeploymentMode != "" || meta.DeploymentMode != base.DeploymentMode {
+		env.DeploymentMode = meta.DeploymentMode
+	}
+	env.Initialized = meta.Initialized
+	if base.Environments == nil {
+		base.Environments = make(map[string]Environment)
+	}
+	base.Environments[meta.Environment] = env
+	return base, nil
+}
+
+// environmentServer returns the server of the active environment, if it has its own
+func environmentServer() (*ServerConfig, error) {
+	if activeEnvironment == "" {
+		return nil, nil
+	}
+	if previewEnvironment != nil {
+		return nil, nil // previews run on the project's server
+	}
+	meta, err := readProjectMetadata()
+	if err != nil {
+		return nil, err
+	}
+	env, ok := meta.Environments[activeEnvironment]
+	if !ok {
+		return nil, fmt.Errorf("environment '%s' is not defined in .graft/project.json", activeEnvironment)
+	}
+	if env.Server == "" {
+		return nil, nil
+	}
+	gCfg, err := LoadGlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	srv, ok := gCfg.Servers[env.Server]
+	if !ok {
+		return nil, fmt.Errorf("registry '%s' of environment '%s' not found, add it with 'graft registry add'", env.Server, activeEnvironment)
+	}
+	return &srv, nil
+}
+
+// readProjectMetadata reads .graft/project.json as stored, without the active environment
+func readProjectMetadata() (*ProjectMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(".graft", "project.json"))
+	if err != nil {
+		return nil, err
+	}
+	var meta ProjectMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// secretsFiles are read in order, later files override earlier ones
+func secretsFiles() []string {
+	files := []string{filepath.Join(".graft", "secrets.env")}
+	if activeEnvironment != "" {
+		files = append(files, filepath.Join(".graft", "secrets."+activeEnvironment+".env"))
+	}
+	return files
+}
@@ -0,0 +1,118 @@
+package deploy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// buildRecord is what the last deployed server build of a service was made from
+type buildRecord struct {
+	Hash  string `json:"hash"`  // content hash of the build context, Dockerfile and build settings
+	Image string `json:"image"` // id of the image built from it
+}
+
+// buildRecordsPath is where the build records of a project are kept on the server
+func buildRecordsPath(remoteDir string) string {
+	return path.Join(remoteDir, ".graft", "builds.json")
+}
+
+// buildHash hashes everything a server build of a service depends on: the files of its
+// build context (with the upload's exclusions), its Dockerfile, which may live outside the
+// context, and the build section itself (dockerfile, args, target, ...)
+func buildHash(contextPath, dockerfilePath string, build *BuildConfig) (string, error) {
+	contextHash, err := ssh.HashDirectory(contextPath)
+	if err != nil {
+		return "", err
+	}
+	dockerfile, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", dockerfilePath, err)
+	}
+	settings, err := yaml.Marshal(build)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "context %s\n", contextHash)
+	h.Write([]byte("dockerfile\n"))
+	h.Write(dockerfile)
+	h.Write([]byte("\nbuild\n"))
+	h.Write(settings)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadBuildRecords reads the build records of the last deploy; none when missing or unreadable
+func loadBuildRecords(client *ssh.Client, remoteDir string) map[string]buildRecord {
+	records := make(map[string]buildRecord)
+	var out bytes.Buffer
+	if err := client.RunCommand(shell.New("cat", buildRecordsPath(remoteDir)).String(), &out, nil); err == nil {
+		json.Unmarshal(out.Bytes(), &records)
+	}
+	return records
+}
+
+// saveBuildRecords stores the hashes of the deployed server builds with their image ids
+func saveBuildRecords(client *ssh.Client, remoteDir string, compose *DockerComposeFile, hashes map[string]string) error {
+	records := make(map[string]buildRecord)
+	for name, hash := range hashes {
+		if id := imageID(client, builtImageRef(remoteDir, name, compose.Services[name])); id != "" {
+			records[name] = buildRecord{Hash: hash, Image: id}
+		}
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	cmd := shell.New("mkdir", "-p", path.Dir(buildRecordsPath(remoteDir))).
+		And(shell.New("cat").Append("> " + shell.Quote(buildRecordsPath(remoteDir))))
+	return client.RunCommandStdin(cmd.String(), bytes.NewReader(data), nil, nil)
+}
+
+// unchangedBuild reports whether the image of the last deploy was built from the same
+// content and is still what the service's image name points at. A rollback, a single
+// service sync or a pruned image all make the service build again.
+func unchangedBuild(client *ssh.Client, remoteDir, serviceName string, service ComposeService, record buildRecord, hash string) bool {
+	if record.Hash != hash || record.Image == "" {
+		return false
+	}
+	return imageID(client, builtImageRef(remoteDir, serviceName, service)) == record.Image
+}
+
+// builtImageRef is the image compose tags a server build with
+func builtImageRef(remoteDir, serviceName string, service ComposeService) string {
+	if service.Image != "" {
+		return service.Image
+	}
+	return composeProjectName(remoteDir) + "-" + serviceName
+}
+
+// imageID returns the id of an image on the server, "" when it does not exist
+func imageID(client *ssh.Client, ref string) string {
+	var out bytes.Buffer
+	if err := client.RunCommand(client.Docker("image", "inspect", "-f", "{{.Id}}", ref).String(), &out, nil); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// changedBuilds leaves out the services whose build was skipped
+func changedBuilds(services []string, skipped map[string]bool) []string {
+	var changed []string
+	for _, name := range services {
+		if !skipped[name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,167 @@
+package deploy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Labels are the labels of a compose service. Compose accepts a list of "key=value" strings
+// or a mapping; both are read into the list form graft works with, and written back in the
+// form they were read in (see ComposeService).
+type Labels []string
+
+func (l *Labels) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		var list []string
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		*l = list
+		return nil
+	}
+	var labels Labels
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, val := value.Content[i], value.Content[i+1]
+		if val.Tag == "!!null" {
+			labels = append(labels, key.Value+"=")
+			continue
+		}
+		labels = append(labels, key.Value+"="+val.Value)
+	}
+	*l = labels
+	return nil
+}
+
+// mapping returns the labels in mapping form, in their order
+func (l Labels) mapping() *yaml.Node {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, label := range l {
+		key, value, _ := strings.Cut(label, "=")
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+	}
+	return node
+}
+
+// UnmarshalYAML remembers whether the labels were written as a mapping
+func (s *ComposeService) UnmarshalYAML(value *yaml.Node) error {
+	type plain ComposeService
+	if err := value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if value.Content[i].Value == "labels" {
+			s.labelsMapping = value.Content[i+1].Kind == yaml.MappingNode
+		}
+	}
+	return nil
+}
+
+// MarshalYAML writes labels read from a mapping back as a mapping
+func (s ComposeService) MarshalYAML() (interface{}, error) {
+	type plain ComposeService
+	if !s.labelsMapping || len(s.Labels) == 0 {
+		return plain(s), nil
+	}
+	var node yaml.Node
+	if err := node.Encode(plain(s)); err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "labels" {
+			node.Content[i+1] = s.Labels.mapping()
+		}
+	}
+	return &node, nil
+}
+
+// BuildConfig is the build section of a compose service. Graft reads the context and
+// Dockerfile; every other key (secrets, ssh, cache_from, ...) is kept as written.
+type BuildConfig struct {
+	Context     string                 `yaml:"context,omitempty"`
+	Dockerfile  string                 `yaml:"dockerfile,omitempty"`
+	Args        interface{}            `yaml:"args,omitempty"`
+	Target      string                 `yaml:"target,omitempty"`
+	OtherFields map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML also accepts the short form, build: ./dir
+func (b *BuildConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*b = BuildConfig{Context: value.Value}
+		return nil
+	}
+	type plain BuildConfig
+	return value.Decode((*plain)(b))
+}
+
+// buildArgFlags turns the build args of a service (mapping or list) into docker build flags.
+// docker build does not interpolate, so $$ left by interpolateCompose becomes $ again.
+func (b *BuildConfig) buildArgFlags() []string {
+	var args []string
+	switch a := b.Args.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(a))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if a[k] == nil {
+				args = append(args, "--build-arg", k) // taken from the environment
+			} else {
+				args = append(args, "--build-arg", unescapeDollars(fmt.Sprintf("%s=%v", k, a[k])))
+			}
+		}
+	case []interface{}:
+		for _, v := range a {
+			args = append(args, "--build-arg", unescapeDollars(fmt.Sprintf("%v", v)))
+		}
+	}
+	return args
+}
+
+// EnvFile is an entry of env_file: a path, or a mapping with path, required and format
+type EnvFile struct {
+	Path     string `yaml:"path"`
+	Required *bool  `yaml:"required,omitempty"`
+	Format   string `yaml:"format,omitempty"`
+}
+
+func (f *EnvFile) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*f = EnvFile{Path: value.Value}
+		return nil
+	}
+	type plain EnvFile
+	return value.Decode((*plain)(f))
+}
+
+// MarshalYAML writes plain entries in the short form
+func (f EnvFile) MarshalYAML() (interface{}, error) {
+	if f.Required == nil && f.Format == "" {
+		return f.Path, nil
+	}
+	type plain EnvFile
+	return plain(f), nil
+}
+
+// EnvFiles is the env_file of a compose service, a single path or a list
+type EnvFiles []EnvFile
+
+func (e *EnvFiles) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*e = EnvFiles{{Path: value.Value}}
+		return nil
+	}
+	var list []EnvFile
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*e = list
+	return nil
+}
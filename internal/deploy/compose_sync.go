@@ -8,8 +8,8 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/skssmd/graft/internal/config"
 	"github.com/skssmd/graft/internal/git"
+	"github.com/skssmd/graft/internal/shell"
 	"github.com/skssmd/graft/internal/ssh"
 	"gopkg.in/yaml.v3"
 )
@@ -36,7 +36,7 @@ func SyncComposeOnly(client *ssh.Client, p *Project, heave bool, stdout, stderr
 	// Ensure remote projects directory exists and is owned by the user
 	// We do this once at the beginning to handle both compose and env sync cases
 	// Use -R to ensure existing files (like docker-compose.yml) are also owned by the user
-	if err := client.RunCommand(fmt.Sprintf("sudo mkdir -p %s && sudo chown -R $USER:$USER %s", remoteDir, remoteDir), stdout, stderr); err != nil {
+	if err := client.RunCommand(client.Privileged("mkdir", "-p", remoteDir).And(client.Privileged("chown", "-R").Append("$USER:$USER").Arg(remoteDir)).String(), stdout, stderr); err != nil {
 		return fmt.Errorf("failed to prepare remote directory: %v", err)
 	}
 
@@ -53,13 +53,19 @@ func SyncComposeOnly(client *ssh.Client, p *Project, heave bool, stdout, stderr
 			return fmt.Errorf("failed to parse compose file: %v", err)
 		}
 
-		// Load secrets
-		secrets, _ := config.LoadSecrets()
+		// Resolve variable references from secrets, the environment and .env
+		vars, err := LoadVariables()
+		if err != nil {
+			return err
+		}
+		if err := interpolateCompose(compose, vars); err != nil {
+			return err
+		}
 
 		// Process environments and handle git-images mode transformation
 		for sName := range compose.Services {
 			sPtr := compose.Services[sName]
-			ProcessServiceEnvironment(sName, &sPtr, secrets)
+			ProcessServiceEnvironment(sName, &sPtr)
 			
 			// If in git-images mode and has build, replace with GHCR image
 			mode := getGraftMode(sPtr.Labels)
@@ -96,7 +102,7 @@ func SyncComposeOnly(client *ssh.Client, p *Project, heave bool, stdout, stderr
 		}
 
 		// Save the actual docker-compose.yml locally
-		if err := os.WriteFile("docker-compose.yml", updatedComposeData, 0644); err != nil {
+		if err := os.WriteFile(localComposeFile(), updatedComposeData, 0644); err != nil {
 			return fmt.Errorf("failed to save docker-compose.yml: %v", err)
 		}
 
@@ -106,18 +112,18 @@ func SyncComposeOnly(client *ssh.Client, p *Project, heave bool, stdout, stderr
 	
 	// Upload env directory if it exists
 	if doEnv {
-		if _, err := os.Stat("env"); err == nil {
+		if _, err := os.Stat(localEnvDir()); err == nil {
 			fmt.Fprintf(stdout, "📤 Uploading environment files...\n")
 			remoteEnvDir := path.Join(remoteDir, "env")
 			// Create env dir with proper permissions
-			if err := client.RunCommand(fmt.Sprintf("mkdir -p %s", remoteEnvDir), stdout, stderr); err != nil {
+			if err := client.RunCommand(shell.New("mkdir", "-p", remoteEnvDir).String(), stdout, stderr); err != nil {
 				return fmt.Errorf("failed to create remote env directory: %v", err)
 			}
 			
-			files, _ := os.ReadDir("env")
+			files, _ := os.ReadDir(localEnvDir())
 			for _, f := range files {
 				if !f.IsDir() {
-					localEnvPath := filepath.Join("env", f.Name())
+					localEnvPath := filepath.Join(localEnvDir(), f.Name())
 					remoteEnvPath := path.Join(remoteEnvDir, f.Name())
 					if err := client.UploadFile(localEnvPath, remoteEnvPath); err != nil {
 						return fmt.Errorf("failed to upload environment file %s: %v", f.Name(), err)
@@ -130,13 +136,13 @@ func SyncComposeOnly(client *ssh.Client, p *Project, heave bool, stdout, stderr
 	if doCompose {
 		// Upload the generated docker-compose.yml
 		remoteCompose := path.Join(remoteDir, "docker-compose.yml")
-		fmt.Fprintf(stdout, "🔍 Verifying local %s exists...\n", "docker-compose.yml")
-		if _, err := os.Stat("docker-compose.yml"); err != nil {
+		fmt.Fprintf(stdout, "🔍 Verifying local %s exists...\n", localComposeFile())
+		if _, err := os.Stat(localComposeFile()); err != nil {
 			return fmt.Errorf("local docker-compose.yml was not generated: %v", err)
 		}
 
 		fmt.Fprintf(stdout, "📤 Uploading generated docker-compose.yml to %s...\n", remoteCompose)
-		if err := client.UploadFile("docker-compose.yml", remoteCompose); err != nil {
+		if err := client.UploadFile(localComposeFile(), remoteCompose); err != nil {
 			return fmt.Errorf("failed to upload docker-compose.yml: %v", err)
 		}
 		
@@ -150,7 +156,7 @@ func SyncComposeOnly(client *ssh.Client, p *Project, heave bool, stdout, stderr
 	if !heave {
 		// Restart services without rebuilding
 		fmt.Fprintln(stdout, "🔄 Restarting services...")
-		if err := client.RunCommand(fmt.Sprintf("cd %s && sudo docker compose up -d --remove-orphans", remoteDir), stdout, stderr); err != nil {
+		if err := client.RunCommand(client.Compose(remoteDir, "up", "-d", "--remove-orphans").String(), stdout, stderr); err != nil {
 			return err
 		}
 	}
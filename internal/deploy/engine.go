@@ -1,41 +1,41 @@
 package deploy
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/skssmd/graft/internal/config"
 	"github.com/skssmd/graft/internal/git"
+	"github.com/skssmd/graft/internal/shell"
 	"github.com/skssmd/graft/internal/ssh"
 	"gopkg.in/yaml.v3"
 )
 
-// DockerComposeFile represents the structure we need from docker-compose.yml
+// DockerComposeFile represents the structure we need from docker-compose.yml. Top-level
+// keys graft does not use (configs, secrets, include, x-*) are kept in OtherFields.
 type DockerComposeFile struct {
-	Version  string                       `yaml:"version"`
-	Services map[string]ComposeService    `yaml:"services"`
-	Networks map[string]interface{}       `yaml:"networks,omitempty"`
-	Volumes  map[string]interface{}       `yaml:"volumes,omitempty"`
+	Version     string                       `yaml:"version,omitempty"`
+	Services    map[string]ComposeService    `yaml:"services"`
+	Networks    map[string]interface{}       `yaml:"networks,omitempty"`
+	Volumes     map[string]interface{}       `yaml:"volumes,omitempty"`
+	OtherFields map[string]interface{}       `yaml:",inline"`
 }
 
 type ComposeService struct {
 	Build       *BuildConfig           `yaml:"build,omitempty"`
 	Image       string                 `yaml:"image,omitempty"`
 	Environment interface{}            `yaml:"environment,omitempty"`
-	EnvFiles    []string               `yaml:"env_file,omitempty"`
-	Labels      []string               `yaml:"labels,omitempty"`
+	EnvFiles    EnvFiles               `yaml:"env_file,omitempty"`
+	Labels      Labels                 `yaml:"labels,omitempty"`
 	OtherFields map[string]interface{} `yaml:",inline"`
-}
 
-type BuildConfig struct {
-	Context    string `yaml:"context"`
-	Dockerfile string `yaml:"dockerfile,omitempty"`
+	labelsMapping bool // labels were written as a mapping and are written back as one
 }
 
 func LoadProject(path string) (*Project, error) {
@@ -54,6 +54,15 @@ func LoadProject(path string) (*Project, error) {
 		if err == nil {
 			p.Name = meta.Name
 		}
+	} else {
+		p.Name = config.EnvironmentProjectName(p.Name)
+	}
+
+	// An environment deploys under its own name and domain
+	if meta, err := config.LoadProjectMetadata(); err == nil {
+		if env := meta.CurrentEnvironment(); env != nil && env.Domain != "" {
+			p.Domain = env.Domain
+		}
 	}
 
 	return &p, nil
@@ -69,6 +78,12 @@ func ParseComposeFile(path string) (*DockerComposeFile, error) {
 	if err := yaml.Unmarshal(data, &compose); err != nil {
 		return nil, err
 	}
+	// domain is graft's own setting, docker compose rejects unknown top-level keys
+	domain, _ := compose.OtherFields["domain"].(string)
+	delete(compose.OtherFields, "domain")
+	if err := applyEnvironment(&compose, domain, data); err != nil {
+		return nil, err
+	}
 	return &compose, nil
 }
 
@@ -82,107 +97,85 @@ func getGraftMode(labels []string) string {
 	return "localbuild" // default
 }
 
-// ProcessServiceEnvironment extracts environment variables, resolves secrets, and writes to an .env file
-func ProcessServiceEnvironment(serviceName string, service *ComposeService, secrets map[string]string) ([]string, error) {
-	var envLines []string
-
-	// Handle environment as interface{} (could be map or slice)
-	switch env := service.Environment.(type) {
-	case map[string]interface{}:
-		for k, v := range env {
-			val := fmt.Sprintf("%v", v)
-			envLines = append(envLines, fmt.Sprintf("%s=%s", k, val))
-		}
-	case []interface{}:
-		for _, v := range env {
-			envLines = append(envLines, fmt.Sprintf("%v", v))
+// prepareServerService points a service at what is on the server after the upload: serverbuild
+// contexts at the synced code, locally built services at their shipped image
+func prepareServerService(serviceName string, service *ComposeService, localImages map[string]string) {
+	mode := getGraftMode(service.Labels)
+	if mode == "serverbuild" && service.Build != nil {
+		contextName := filepath.Base(service.Build.Context)
+		if contextName == "." || contextName == "/" {
+			contextName = serviceName
 		}
+		service.Build.Context = "./" + contextName
 	}
-
-	if len(envLines) == 0 {
-		return nil, nil
+	if tag, ok := localImages[serviceName]; ok {
+		service.Image = tag
+		service.Build = nil
 	}
+}
 
-	// Resolve secrets in environment variables
-	for i := range envLines {
-		for key, value := range secrets {
-			envLines[i] = strings.ReplaceAll(envLines[i], fmt.Sprintf("${%s}", key), value)
-		}
+// ProcessServiceEnvironment moves the environment of a service, already interpolated with
+// interpolateCompose, into an .env file. Values keep $ escaped as $$, since docker compose
+// interpolates env files too.
+func ProcessServiceEnvironment(serviceName string, service *ComposeService) ([]string, error) {
+	envFileRelPath, content := renderServiceEnvironment(serviceName, service)
+	if envFileRelPath == "" {
+		return nil, nil
 	}
 
 	// Create env directory
-	if err := os.MkdirAll("env", 0755); err != nil {
+	if err := os.MkdirAll(localEnvDir(), 0755); err != nil {
 		return nil, err
 	}
 
-	// Write to env/service.env
-	envFileRelPath := filepath.Join("env", serviceName+".env")
-	err := os.WriteFile(envFileRelPath, []byte(strings.Join(envLines, "\n")), 0644)
-	if err != nil {
+	// Write to env/service.env (env/<environment>/service.env for an environment)
+	localPath := filepath.Join(localEnvDir(), filepath.Base(envFileRelPath))
+	if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
 		return nil, err
 	}
 
-	// Update service to use env_file and clear environment
-	service.Environment = nil
-	
-	// Keep existing env_files if any
-	service.EnvFiles = append(service.EnvFiles, "./"+filepath.ToSlash(envFileRelPath))
-
-	return []string{envFileRelPath}, nil
+	return []string{localPath}, nil
 }
 
-// Create a tarball of a directory
-func createTarball(sourceDir, tarballPath string) error {
-	file, err := os.Create(tarballPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
-
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+// renderServiceEnvironment moves the environment of a service into env/<service>.env and
+// returns that file's path and content without writing it ("" when there is no environment)
+func renderServiceEnvironment(serviceName string, service *ComposeService) (string, string) {
+	var envLines []string
 
-	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	// Handle environment as interface{} (could be map or slice)
+	switch env := service.Environment.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(env))
+		for k := range env {
+			keys = append(keys, k)
 		}
-
-		// Skip .git, node_modules, etc.
-		if info.IsDir() && (info.Name() == ".git" || info.Name() == "node_modules" || info.Name() == ".next") {
-			return filepath.SkipDir
+		sort.Strings(keys)
+		for _, k := range keys {
+			if env[k] == nil {
+				envLines = append(envLines, k) // value comes from the server's environment
+				continue
+			}
+			envLines = append(envLines, fmt.Sprintf("%s=%v", k, env[k]))
 		}
-
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return err
+	case []interface{}:
+		for _, v := range env {
+			envLines = append(envLines, fmt.Sprintf("%v", v))
 		}
+	}
 
-		relPath, err := filepath.Rel(sourceDir, path)
-		if err != nil {
-			return err
-		}
-		// Convert Windows backslashes to Unix forward slashes for tar archive
-		header.Name = filepath.ToSlash(relPath)
+	if len(envLines) == 0 {
+		return "", ""
+	}
 
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return err
-		}
+	envFileRelPath := filepath.Join("env", serviceName+".env")
 
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(tarWriter, file)
-			return err
-		}
+	// Update service to use env_file and clear environment
+	service.Environment = nil
+	
+	// Keep existing env_files if any
+	service.EnvFiles = append(service.EnvFiles, EnvFile{Path: "./" + filepath.ToSlash(envFileRelPath)})
 
-		return nil
-	})
+	return envFileRelPath, strings.Join(envLines, "\n")
 }
 
 // SyncService syncs only a specific service
@@ -191,11 +184,13 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 
 	remoteDir := fmt.Sprintf("/opt/graft/projects/%s", p.Name)
 	
-	// Update project metadata with current remote path
-	meta := &config.ProjectMetadata{
-		Name:       p.Name,
-		RemotePath: remoteDir,
+	// Update project metadata with current remote path, keeping the other settings
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		meta = &config.ProjectMetadata{}
 	}
+	meta.Name = p.Name
+	meta.RemotePath = remoteDir
 	if err := config.SaveProjectMetadata(meta); err != nil {
 		fmt.Fprintf(stdout, "Warning: Could not save project metadata: %v\n", err)
 	}
@@ -212,6 +207,15 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 		return fmt.Errorf("failed to parse compose file: %v", err)
 	}
 
+	// Resolve variable references before anything is built or uploaded
+	vars, err := LoadVariables()
+	if err != nil {
+		return err
+	}
+	if err := interpolateCompose(compose, vars); err != nil {
+		return err
+	}
+
 	// Check if service exists
 	service, exists := compose.Services[serviceName]
 	if !exists {
@@ -220,18 +224,64 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 
 	mode := getGraftMode(service.Labels)
 	fmt.Fprintf(stdout, "📦 Mode: %s\n", mode)
+	strategy := getDeployStrategy(service.Labels)
+	if strategy == StrategyBlueGreen {
+		fmt.Fprintf(stdout, "🔁 Deploy strategy: %s\n", strategy)
+	}
 
 	// Check if this is an image-based service (no build context)
 	isImageBased := service.Image != "" && service.Build == nil
-	
-	// Load secrets
-	secrets, _ := config.LoadSecrets()
+
+	// Other locally built services keep the image of their last local build. Without one the
+	// server would get their build: section and no source to build from.
+	var unbuilt []string
+	for _, sName := range serviceNames(compose) {
+		s := compose.Services[sName]
+		if sName == serviceName || s.Build == nil || getGraftMode(s.Labels) != "localbuild" {
+			continue
+		}
+		tag := LocalImageTag(p.Name, sName)
+		if tag == "" {
+			unbuilt = append(unbuilt, sName)
+			continue
+		}
+		s.Image = tag
+		s.Build = nil
+		compose.Services[sName] = s
+	}
+	if len(unbuilt) > 0 {
+		return fmt.Errorf("localbuild services %s have no local image yet\n👉 Run a full `graft sync` first, then sync single services", strings.Join(unbuilt, ", "))
+	}
+
+	// Locally built services are built here and shipped to the server as an image
+	isLocalBuild := mode == "localbuild" && service.Build != nil
+	if isLocalBuild {
+		contextPath := filepath.Clean(service.Build.Context)
+		if useGit {
+			exportDir, cleanup, err := exportGitContext(gitBranch, gitCommit, contextPath, stdout)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			contextPath = filepath.Join(exportDir, contextPath)
+		}
+		if _, err := os.Stat(contextPath); os.IsNotExist(err) {
+			return fmt.Errorf("build context directory not found: %s\n👉 Please ensure the directory exists or update 'context' in your graft.yml file.", contextPath)
+		}
+		tag, err := BuildLocalImage(client, p.Name, serviceName, service.Build, contextPath, noCache, stdout, stderr)
+		if err != nil {
+			return err
+		}
+		service.Image = tag
+		service.Build = nil
+		compose.Services[serviceName] = service
+	}
 
 	// Process environments for ALL services to ensure consistency in the generated docker-compose.yml
 	for sName := range compose.Services {
 		// Use a pointer to update the service in the map
 		sPtr := compose.Services[sName]
-		ProcessServiceEnvironment(sName, &sPtr, secrets)
+		ProcessServiceEnvironment(sName, &sPtr)
 		compose.Services[sName] = sPtr
 	}
 
@@ -242,7 +292,7 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 	}
 
 	// Save the actual docker-compose.yml locally
-	if err := os.WriteFile("docker-compose.yml", updatedComposeData, 0644); err != nil {
+	if err := os.WriteFile(localComposeFile(), updatedComposeData, 0644); err != nil {
 		return fmt.Errorf("failed to save docker-compose.yml: %v", err)
 	}
 
@@ -250,21 +300,28 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 	EnsureGitignore(".")
 
 	// Ensure remote projects directory exists
-	if err := client.RunCommand(fmt.Sprintf("sudo mkdir -p %s && sudo chown $USER:$USER %s", remoteDir, remoteDir), stdout, stderr); err != nil {
+	if err := client.RunCommand(client.MkdirOwned(remoteDir).String(), stdout, stderr); err != nil {
 		return err
 	}
 
+	// Remember what is running now, before the new env files and compose file replace it,
+	// to restore it if a pre-deploy hook fails or the new version is not healthy
+	var snapshot *deploySnapshot
+	if !heave {
+		snapshot = snapshotDeploy(client, remoteDir)
+	}
+
 	// Upload env directory if it exists
-	if _, err := os.Stat("env"); err == nil {
+	if _, err := os.Stat(localEnvDir()); err == nil {
 		fmt.Fprintf(stdout, "📤 Uploading environment files...\n")
 		remoteEnvDir := path.Join(remoteDir, "env")
-		client.RunCommand(fmt.Sprintf("mkdir -p %s", remoteEnvDir), stdout, stderr)
+		client.RunCommand(shell.New("mkdir", "-p", remoteEnvDir).String(), stdout, stderr)
 		
 		// Map local env/* to remote env/*
-		files, _ := os.ReadDir("env")
+		files, _ := os.ReadDir(localEnvDir())
 		for _, f := range files {
 			if !f.IsDir() {
-				localEnvPath := filepath.Join("env", f.Name())
+				localEnvPath := filepath.Join(localEnvDir(), f.Name())
 				remoteEnvPath := path.Join(remoteEnvDir, f.Name())
 				client.UploadFile(localEnvPath, remoteEnvPath)
 			}
@@ -274,7 +331,7 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 	// Upload the generated docker-compose.yml
 	remoteCompose := path.Join(remoteDir, "docker-compose.yml")
 	fmt.Fprintf(stdout, "📤 Uploading generated docker-compose.yml...\n")
-	if err := client.UploadFile("docker-compose.yml", remoteCompose); err != nil {
+	if err := client.UploadFile(localComposeFile(), remoteCompose); err != nil {
 		return err
 	}
 
@@ -286,33 +343,55 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 			return nil // Heave sync ends here
 		}
 
-		// Stop the old container
-		fmt.Fprintf(stdout, "🛑 Stopping old container...\n")
-		stopCmd := fmt.Sprintf("cd %s && sudo docker compose stop %s && sudo docker compose rm -f %s", remoteDir, serviceName, serviceName)
-		client.RunCommand(stopCmd, stdout, stderr) // Ignore errors if container doesn't exist
-
 		// Pull the latest image
 		fmt.Fprintf(stdout, "📥 Pulling latest image...\n")
-		pullCmd := fmt.Sprintf("cd %s && sudo docker compose pull %s", remoteDir, serviceName)
+		pullCmd := client.Compose(remoteDir, "pull", serviceName).String()
 		if err := client.RunCommand(pullCmd, stdout, stderr); err != nil {
 			return fmt.Errorf("image pull failed: %v", err)
 		}
 
+		// The pre-deploy hook runs against the new image while the old container still serves
+		if err := runPreDeployHooks(client, compose, remoteDir, []string{serviceName}, nil, stdout, stderr); err != nil {
+			return preDeployFailed(client, snapshot, err, stdout, stderr)
+		}
+
+		// Stop the old container (blue-green keeps it serving until the new one is healthy)
+		if strategy != StrategyBlueGreen {
+			fmt.Fprintf(stdout, "🛑 Stopping old container...\n")
+			stopCmd := client.Compose(remoteDir, "stop", serviceName).And(client.Docker("compose", "rm", "-f", serviceName)).String()
+			client.RunCommand(stopCmd, stdout, stderr) // Ignore errors if container doesn't exist
+		}
+
 		// Start the service with the new image
-		fmt.Fprintf(stdout, "🚀 Starting %s...\n", serviceName)
-		upCmd := fmt.Sprintf("cd %s && sudo docker compose up -d %s", remoteDir, serviceName)
-		if err := client.RunCommand(upCmd, stdout, stderr); err != nil {
-			return err
+		if strategy == StrategyBlueGreen {
+			if err := blueGreenDeploy(client, compose, remoteDir, serviceName, stdout, stderr); err != nil {
+				return deployFailed(client, snapshot, []string{serviceName}, err, stdout, stderr)
+			}
+		} else {
+			fmt.Fprintf(stdout, "🚀 Starting %s...\n", serviceName)
+			upCmd := client.Compose(remoteDir, "up", "-d", serviceName).String()
+			if err := client.RunCommand(upCmd, stdout, stderr); err != nil {
+				return deployFailed(client, snapshot, []string{serviceName}, err, stdout, stderr)
+			}
+			if err := verifyServices(client, compose, remoteDir, []string{serviceName}, stdout, stderr); err != nil {
+				return deployFailed(client, snapshot, []string{serviceName}, err, stdout, stderr)
+			}
+		}
+		hookErr := runPostDeployHooks(client, compose, remoteDir, []string{serviceName}, stdout, stderr)
+
+		// Record the deploy as a release; its images stay tagged, so the prune below keeps them
+		if _, err := RecordRelease(client, remoteDir, CurrentCommit(useGit, gitBranch, gitCommit), meta.KeepReleases, stdout); err != nil {
+			fmt.Fprintf(stdout, "⚠️  Could not record release: %v\n", err)
 		}
 
 		// Cleanup old images
 		fmt.Fprintln(stdout, "🧹 Cleaning up old images...")
-		cleanupCmd := "sudo docker image prune -f"
+		cleanupCmd := client.Docker("image", "prune", "-f").String()
 		if err := client.RunCommand(cleanupCmd, stdout, stderr); err != nil {
 			fmt.Fprintf(stdout, "⚠️  Cleanup warning: %v\n", err)
 		}
 
-		return nil
+		return hookErr
 	}
 
 	if mode == "serverbuild" && service.Build != nil {
@@ -406,53 +485,18 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 			actualContextPath = contextPath
 		}
 
-		fmt.Fprintf(stdout, "📦 Syncing source code with rsync (incremental)...\n")
+		fmt.Fprintf(stdout, "📦 Syncing source code (incremental)...\n")
 		contextName := filepath.Base(contextPath)
 		if contextName == "." || contextName == "/" {
 			contextName = serviceName
 		}
 
-		// Use rsync to sync the directory
 		serviceDir := path.Join(remoteDir, contextName)
-		
-		// Ensure remote directory exists
-		if err := client.RunCommand(fmt.Sprintf("mkdir -p %s", serviceDir), stdout, stderr); err != nil {
-			return fmt.Errorf("failed to create remote directory: %v", err)
-		}
-		
-		// Try rsync first, fall back to tarball if rsync is not available
-		fmt.Fprintf(stdout, "📤 Uploading changes from %s...\n", actualContextPath)
-		rsyncErr := client.RsyncDirectory(actualContextPath, serviceDir, stdout, stderr)
-		
-		if rsyncErr != nil {
-			// Check if error is due to rsync not being found
-			if strings.Contains(rsyncErr.Error(), "rsync not found") {
-				fmt.Fprintf(stdout, "⚠️  Rsync not available, falling back to tarball method...\n")
-				
-				// Fall back to tarball method
-				tarballPath := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%s.tar.gz", p.Name, contextName))
-				if err := createTarball(actualContextPath, tarballPath); err != nil {
-					return fmt.Errorf("failed to create tarball: %v", err)
-				}
-				defer os.Remove(tarballPath)
-
-				// Upload tarball to server
-				remoteTarball := path.Join(remoteDir, fmt.Sprintf("%s.tar.gz", contextName))
-				fmt.Fprintf(stdout, "📤 Uploading tarball...\n")
-				if err := client.UploadFile(tarballPath, remoteTarball); err != nil {
-					return fmt.Errorf("failed to upload tarball: %v", err)
-				}
 
-				// Extract on server
-				extractCmd := fmt.Sprintf("rm -rf %s && mkdir -p %s && tar -xzf %s -C %s && rm %s", 
-					serviceDir, serviceDir, remoteTarball, serviceDir, remoteTarball)
-				fmt.Fprintf(stdout, "📂 Extracting on server...\n")
-				if err := client.RunCommand(extractCmd, stdout, stderr); err != nil {
-					return fmt.Errorf("failed to extract tarball: %v", err)
-				}
-			} else {
-				return fmt.Errorf("failed to sync directory: %v", rsyncErr)
-			}
+		// Delta sync over SFTP: only changed files are uploaded, removed files are deleted
+		fmt.Fprintf(stdout, "📤 Uploading changes from %s...\n", actualContextPath)
+		if err := client.SyncDirectory(actualContextPath, serviceDir, stdout, stderr); err != nil {
+			return fmt.Errorf("failed to sync directory: %v", err)
 		}
 
 		if heave {
@@ -460,63 +504,97 @@ func SyncService(client *ssh.Client, p *Project, serviceName string, noCache, he
 		}
 	}
 
-	// Stop and remove the old container
-	fmt.Fprintf(stdout, "🛑 Stopping old container...\n")
-	stopCmd := fmt.Sprintf("cd %s && sudo docker compose stop %s && sudo docker compose rm -f %s", remoteDir, serviceName, serviceName)
-	client.RunCommand(stopCmd, stdout, stderr) // Ignore errors if container doesn't exist
+	if isLocalBuild && heave {
+		return nil // Heave sync ends here
+	}
 
-	// Conditionally clear build cache
-	if noCache {
+	// Conditionally clear build cache (locally built images were built without it already)
+	if noCache && !isLocalBuild {
 		fmt.Fprintf(stdout, "🧹 Clearing build cache for fresh build...\n")
-		pruneCmd := "sudo docker builder prune -f"
+		pruneCmd := client.Docker("builder", "prune", "-f").String()
 		client.RunCommand(pruneCmd, stdout, stderr) // Ignore errors
 	}
 	
 	// Build the service (separate command to show build logs)
-	fmt.Fprintf(stdout, "🔨 Building %s...\n", serviceName)
-	var buildCmd string
-	if noCache {
-		buildCmd = fmt.Sprintf("cd %s && sudo docker compose build --no-cache %s", remoteDir, serviceName)
-	} else {
-		buildCmd = fmt.Sprintf("cd %s && sudo docker compose build %s", remoteDir, serviceName)
+	if !isLocalBuild {
+		fmt.Fprintf(stdout, "🔨 Building %s...\n", serviceName)
+		var buildCmd string
+		if noCache {
+			buildCmd = client.Compose(remoteDir, "build", "--no-cache", serviceName).String()
+		} else {
+			buildCmd = client.Compose(remoteDir, "build", serviceName).String()
+		}
+
+		if err := client.RunCommand(buildCmd, stdout, stderr); err != nil {
+			return fmt.Errorf("build failed: %v", err)
+		}
 	}
-	
-	if err := client.RunCommand(buildCmd, stdout, stderr); err != nil {
-		return fmt.Errorf("build failed: %v", err)
+
+	// The pre-deploy hook runs against the new image while the old container still serves
+	if err := runPreDeployHooks(client, compose, remoteDir, []string{serviceName}, nil, stdout, stderr); err != nil {
+		return preDeployFailed(client, snapshot, err, stdout, stderr)
+	}
+
+	// Stop and remove the old container (blue-green keeps it serving until the new one is healthy)
+	if strategy != StrategyBlueGreen {
+		fmt.Fprintf(stdout, "🛑 Stopping old container...\n")
+		stopCmd := client.Compose(remoteDir, "stop", serviceName).And(client.Docker("compose", "rm", "-f", serviceName)).String()
+		client.RunCommand(stopCmd, stdout, stderr) // Ignore errors if container doesn't exist
 	}
 	
 	// Start the service
-	fmt.Fprintf(stdout, "� Starting %s...\n", serviceName)
-	upCmd := fmt.Sprintf("cd %s && sudo docker compose up -d %s", remoteDir, serviceName)
-	if err := client.RunCommand(upCmd, stdout, stderr); err != nil {
-		return err
+	if strategy == StrategyBlueGreen {
+		if err := blueGreenDeploy(client, compose, remoteDir, serviceName, stdout, stderr); err != nil {
+			return deployFailed(client, snapshot, []string{serviceName}, err, stdout, stderr)
+		}
+	} else {
+		fmt.Fprintf(stdout, "� Starting %s...\n", serviceName)
+		upCmd := client.Compose(remoteDir, "up", "-d", serviceName).String()
+		if err := client.RunCommand(upCmd, stdout, stderr); err != nil {
+			return deployFailed(client, snapshot, []string{serviceName}, err, stdout, stderr)
+		}
+		if err := verifyServices(client, compose, remoteDir, []string{serviceName}, stdout, stderr); err != nil {
+			return deployFailed(client, snapshot, []string{serviceName}, err, stdout, stderr)
+		}
+	}
+	hookErr := runPostDeployHooks(client, compose, remoteDir, []string{serviceName}, stdout, stderr)
+
+	// Record the deploy as a release; its images stay tagged, so the prune below keeps them
+	if _, err := RecordRelease(client, remoteDir, CurrentCommit(useGit, gitBranch, gitCommit), meta.KeepReleases, stdout); err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not record release: %v\n", err)
 	}
 
 	// Cleanup old images
 	fmt.Fprintln(stdout, "🧹 Cleaning up old images...")
-	cleanupCmd := "sudo docker image prune -f"
+	cleanupCmd := client.Docker("image", "prune", "-f").String()
 	if err := client.RunCommand(cleanupCmd, stdout, stderr); err != nil {
 		fmt.Fprintf(stdout, "⚠️  Cleanup warning: %v\n", err)
 	}
 
-	return nil
+	return hookErr
 }
 
-func Sync(client *ssh.Client, p *Project, noCache, heave, useGit bool, gitBranch, gitCommit string, stdout, stderr io.Writer) error {
+// Sync deploys every service of the project. Uploads, local builds and server builds of
+// up to parallel services run concurrently (1 processes them one after another).
+// Server builds whose build context is unchanged since the last deploy are neither uploaded
+// nor rebuilt, unless force or noCache is set.
+func Sync(client *ssh.Client, p *Project, noCache, force, heave, useGit bool, gitBranch, gitCommit string, parallel int, stdout, stderr io.Writer) error {
 	fmt.Fprintf(stdout, "🚀 Syncing project: %s\n", p.Name)
 
 	remoteDir := fmt.Sprintf("/opt/graft/projects/%s", p.Name)
 	
-	// Update project metadata with current remote path
-	meta := &config.ProjectMetadata{
-		Name:       p.Name,
-		RemotePath: remoteDir,
+	// Update project metadata with current remote path, keeping the other settings
+	meta, err := config.LoadProjectMetadata()
+	if err != nil {
+		meta = &config.ProjectMetadata{}
 	}
+	meta.Name = p.Name
+	meta.RemotePath = remoteDir
 	if err := config.SaveProjectMetadata(meta); err != nil {
 		fmt.Fprintf(stdout, "Warning: Could not save project metadata: %v\n", err)
 	}
 	
-	if err := client.RunCommand(fmt.Sprintf("sudo mkdir -p %s && sudo chown $USER:$USER %s", remoteDir, remoteDir), stdout, stderr); err != nil {
+	if err := client.RunCommand(client.MkdirOwned(remoteDir).String(), stdout, stderr); err != nil {
 		return err
 	}
 
@@ -532,6 +610,15 @@ func Sync(client *ssh.Client, p *Project, noCache, heave, useGit bool, gitBranch
 		return fmt.Errorf("failed to parse compose file: %v", err)
 	}
 
+	// Resolve variable references before anything is built or uploaded
+	vars, err := LoadVariables()
+	if err != nil {
+		return err
+	}
+	if err := interpolateCompose(compose, vars); err != nil {
+		return err
+	}
+
 	// Handle git-based sync if enabled
 	var workingDir string
 	var cleanupFunc func()
@@ -595,7 +682,16 @@ func Sync(client *ssh.Client, p *Project, noCache, heave, useGit bool, gitBranch
 	}
 
 	// Process each service based on graft.mode
-	for serviceName, service := range compose.Services {
+	localImages := make(map[string]string) // localbuild service -> image tag loaded on the server
+	var localMu sync.Mutex
+	builds := loadBuildRecords(client, remoteDir)
+	buildHashes := make(map[string]string) // serverbuild service -> content hash of its build
+	skippedBuilds := make(map[string]bool)
+	if parallel > 1 {
+		fmt.Fprintf(stdout, "\n⚡ Processing services in parallel (up to %d at a time)\n", parallel)
+	}
+	err = runParallel(parallel, serviceNames(compose), stdout, stderr, func(serviceName string, stdout, stderr io.Writer) error {
+		service := compose.Services[serviceName]
 		mode := getGraftMode(service.Labels)
 		fmt.Fprintf(stdout, "\n📦 Processing service '%s' (mode: %s)\n", serviceName, mode)
 
@@ -626,74 +722,63 @@ func Sync(client *ssh.Client, p *Project, noCache, heave, useGit bool, gitBranch
 				return fmt.Errorf("Dockerfile not found: %s\n👉 Checked path: %s\n👉 Please check the 'dockerfile' field in your graft.yml and ensure the file exists and casing matches EXACTLY (Linux is case-sensitive!).", dockerfileName, dockerfilePath)
 			}
 
-			fmt.Fprintf(stdout, "  📦 Syncing source code with rsync (incremental)...\n")
+			// Skip services built from exactly this content by the last deploy
+			hash, err := buildHash(contextPath, dockerfilePath, service.Build)
+			if err != nil {
+				return fmt.Errorf("failed to hash build context: %v", err)
+			}
+			localMu.Lock()
+			buildHashes[serviceName] = hash
+			localMu.Unlock()
+			if !force && !noCache && unchangedBuild(client, remoteDir, serviceName, service, builds[serviceName], hash) {
+				fmt.Fprintf(stdout, "  ⏭️  Unchanged since the last deploy (%s), skipping upload and build\n", hash[:12])
+				localMu.Lock()
+				skippedBuilds[serviceName] = true
+				localMu.Unlock()
+				return nil
+			}
+
+			fmt.Fprintf(stdout, "  📦 Syncing source code (incremental)...\n")
 			contextName := filepath.Base(contextPath)
 			if contextName == "." || contextName == "/" {
 				contextName = serviceName
 			}
 
-			// Use rsync to sync the directory
 			serviceDir := path.Join(remoteDir, contextName)
-			
-			// Ensure remote directory exists
-			if err := client.RunCommand(fmt.Sprintf("mkdir -p %s", serviceDir), stdout, stderr); err != nil {
-				return fmt.Errorf("failed to create remote directory: %v", err)
-			}
-			
-			// Try rsync first, fall back to tarball if rsync is not available
-			fmt.Fprintf(stdout, "  📤 Uploading changes from %s...\n", contextPath)
-			rsyncErr := client.RsyncDirectory(contextPath, serviceDir, stdout, stderr)
-			
-			if rsyncErr != nil {
-				// Check if error is due to rsync not being found
-				if strings.Contains(rsyncErr.Error(), "rsync not found") {
-					fmt.Fprintf(stdout, "  ⚠️  Rsync not available, falling back to tarball method...\n")
-					
-					// Fall back to tarball method
-					tarballPath := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%s.tar.gz", p.Name, contextName))
-					if err := createTarball(contextPath, tarballPath); err != nil {
-						return fmt.Errorf("failed to create tarball: %v", err)
-					}
-					defer os.Remove(tarballPath)
-
-					// Upload tarball to server
-					remoteTarball := path.Join(remoteDir, fmt.Sprintf("%s.tar.gz", contextName))
-					fmt.Fprintf(stdout, "  📤 Uploading tarball...\n")
-					if err := client.UploadFile(tarballPath, remoteTarball); err != nil {
-						return fmt.Errorf("failed to upload tarball: %v", err)
-					}
 
-					// Extract on server
-					extractCmd := fmt.Sprintf("mkdir -p %s && tar -xzf %s -C %s && rm %s", 
-						serviceDir, remoteTarball, serviceDir, remoteTarball)
-					fmt.Fprintf(stdout, "  📂 Extracting on server...\n")
-					if err := client.RunCommand(extractCmd, stdout, stderr); err != nil {
-						return fmt.Errorf("failed to extract tarball: %v", err)
-					}
-				} else {
-					return fmt.Errorf("failed to sync directory: %v", rsyncErr)
-				}
+			// Delta sync over SFTP: only changed files are uploaded, removed files are deleted
+			fmt.Fprintf(stdout, "  📤 Uploading changes from %s...\n", contextPath)
+			if err := client.SyncDirectory(contextPath, serviceDir, stdout, stderr); err != nil {
+				return fmt.Errorf("failed to sync directory: %v", err)
 			}
+		} else if mode == "localbuild" && service.Build != nil {
+			// Build with the local Docker daemon and ship the image, the server never compiles
+			contextPath := filepath.Clean(service.Build.Context)
+			if useGit {
+				contextPath = filepath.Join(workingDir, contextPath)
+			}
+			if _, err := os.Stat(contextPath); os.IsNotExist(err) {
+				return fmt.Errorf("build context directory not found: %s\n👉 Please ensure the directory exists or update 'context' in your graft.yml file.", contextPath)
+			}
+			tag, err := BuildLocalImage(client, p.Name, serviceName, service.Build, contextPath, noCache, stdout, stderr)
+			if err != nil {
+				return err
+			}
+			localMu.Lock()
+			localImages[serviceName] = tag
+			localMu.Unlock()
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// Load secrets
-	secrets, _ := config.LoadSecrets()
-
 	// Process environments for ALL services
 	for sName := range compose.Services {
 		sPtr := compose.Services[sName]
-		ProcessServiceEnvironment(sName, &sPtr, secrets)
-		
-		// For serverbuild services, update build context to point to uploaded code
-		mode := getGraftMode(sPtr.Labels)
-		if mode == "serverbuild" && sPtr.Build != nil {
-			contextName := filepath.Base(sPtr.Build.Context)
-			if contextName == "." || contextName == "/" {
-				contextName = sName
-			}
-			sPtr.Build.Context = "./" + contextName
-		}
+		ProcessServiceEnvironment(sName, &sPtr)
+		prepareServerService(sName, &sPtr, localImages)
 		compose.Services[sName] = sPtr
 	}
 
@@ -704,23 +789,30 @@ func Sync(client *ssh.Client, p *Project, noCache, heave, useGit bool, gitBranch
 	}
 
 	// Save the actual docker-compose.yml locally
-	if err := os.WriteFile("docker-compose.yml", updatedComposeData, 0644); err != nil {
+	if err := os.WriteFile(localComposeFile(), updatedComposeData, 0644); err != nil {
 		return fmt.Errorf("failed to save docker-compose.yml: %v", err)
 	}
 
 	// Ensure .gitignore is up to date
 	EnsureGitignore(".")
 
+	// Remember what is running now, before the new env files and compose file replace it,
+	// to restore it if a pre-deploy hook fails or the new version is not healthy
+	var snapshot *deploySnapshot
+	if !heave {
+		snapshot = snapshotDeploy(client, remoteDir)
+	}
+
 	// Upload env directory if it exists
-	if _, err := os.Stat("env"); err == nil {
+	if _, err := os.Stat(localEnvDir()); err == nil {
 		fmt.Fprintf(stdout, "\n📤 Uploading environment files...\n")
 		remoteEnvDir := path.Join(remoteDir, "env")
-		client.RunCommand(fmt.Sprintf("mkdir -p %s", remoteEnvDir), stdout, stderr)
+		client.RunCommand(shell.New("mkdir", "-p", remoteEnvDir).String(), stdout, stderr)
 		
-		files, _ := os.ReadDir("env")
+		files, _ := os.ReadDir(localEnvDir())
 		for _, f := range files {
 			if !f.IsDir() {
-				localEnvPath := filepath.Join("env", f.Name())
+				localEnvPath := filepath.Join(localEnvDir(), f.Name())
 				remoteEnvPath := path.Join(remoteEnvDir, f.Name())
 				client.UploadFile(localEnvPath, remoteEnvPath)
 			}
@@ -730,7 +822,7 @@ func Sync(client *ssh.Client, p *Project, noCache, heave, useGit bool, gitBranch
 	// Upload docker-compose.yml
 	remoteCompose := path.Join(remoteDir, "docker-compose.yml")
 	fmt.Fprintln(stdout, "\n📤 Uploading generated docker-compose.yml...")
-	if err := client.UploadFile("docker-compose.yml", remoteCompose); err != nil {
+	if err := client.UploadFile(localComposeFile(), remoteCompose); err != nil {
 		return err
 	}
 
@@ -740,32 +832,146 @@ func Sync(client *ssh.Client, p *Project, noCache, heave, useGit bool, gitBranch
 	}
 
 	// Build and start services
-	if noCache {
+	if parallel > 1 {
+		if noCache {
+			fmt.Fprintln(stdout, "🧹 Clearing build cache for fresh build...")
+			client.RunCommand(client.Docker("builder", "prune", "-f").String(), stdout, stderr) // Ignore errors
+		}
+
+		// One compose build per service, so a slow image does not hold up the others
+		built := changedBuilds(buildServices(compose), skippedBuilds)
+		fmt.Fprintf(stdout, "🔨 Building %d services (up to %d in parallel)...\n", len(built), parallel)
+		err := runParallel(parallel, built, stdout, stderr, func(serviceName string, stdout, stderr io.Writer) error {
+			args := []string{"build"}
+			if noCache {
+				args = append(args, "--no-cache")
+			}
+			if err := client.RunCommand(client.Compose(remoteDir, append(args, serviceName)...).String(), stdout, stderr); err != nil {
+				return fmt.Errorf("build failed: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else if noCache {
 		fmt.Fprintln(stdout, "🧹 Clearing build cache for fresh build...")
-		pruneCmd := "sudo docker builder prune -f"
+		pruneCmd := client.Docker("builder", "prune", "-f").String()
 		client.RunCommand(pruneCmd, stdout, stderr) // Ignore errors
 		
 		fmt.Fprintln(stdout, "🔨 Building services (no cache)...")
-		if err := client.RunCommand(fmt.Sprintf("cd %s && sudo docker compose build --no-cache", remoteDir), stdout, stderr); err != nil {
+		if err := client.RunCommand(client.Compose(remoteDir, "build", "--no-cache").String(), stdout, stderr); err != nil {
 			return fmt.Errorf("build failed: %v", err)
 		}
-	} else {
+	} else if len(skippedBuilds) == 0 {
 		fmt.Fprintln(stdout, "🔨 Building services...")
-		if err := client.RunCommand(fmt.Sprintf("cd %s && sudo docker compose build", remoteDir), stdout, stderr); err != nil {
+		if err := client.RunCommand(client.Compose(remoteDir, "build").String(), stdout, stderr); err != nil {
+			return fmt.Errorf("build failed: %v", err)
+		}
+	} else if built := changedBuilds(buildServices(compose), skippedBuilds); len(built) > 0 {
+		fmt.Fprintf(stdout, "🔨 Building changed services: %s\n", strings.Join(built, ", "))
+		if err := client.RunCommand(client.Compose(remoteDir, append([]string{"build"}, built...)...).String(), stdout, stderr); err != nil {
 			return fmt.Errorf("build failed: %v", err)
 		}
+	} else {
+		fmt.Fprintln(stdout, "⏭️  No build needed, every build context is unchanged")
+	}
+
+	// Pre-deploy hooks run against the new images while the old containers still serve
+	if err := runPreDeployHooks(client, compose, remoteDir, serviceNames(compose), registryServices(compose, localImages), stdout, stderr); err != nil {
+		return preDeployFailed(client, snapshot, err, stdout, stderr)
 	}
 
 	fmt.Fprintln(stdout, "🚀 Starting services...")
-	if err := client.RunCommand(fmt.Sprintf("cd %s && sudo docker compose up -d --pull always --remove-orphans", remoteDir), stdout, stderr); err != nil {
-		return err
+	upArgs := []string{"up", "-d", "--pull", "always", "--remove-orphans"}
+	if len(localImages) > 0 {
+		// --pull always would try to pull the locally built images from a registry,
+		// so pull only the registry images and start without it
+		if pullable := registryServices(compose, localImages); len(pullable) > 0 {
+			if err := client.RunCommand(client.Compose(remoteDir, append([]string{"pull"}, pullable...)...).String(), stdout, stderr); err != nil {
+				return fmt.Errorf("image pull failed: %v", err)
+			}
+		}
+		upArgs = []string{"up", "-d", "--remove-orphans"}
+	}
+
+	blueGreen := blueGreenServices(compose)
+	if len(blueGreen) == 0 {
+		if err := client.RunCommand(client.Compose(remoteDir, upArgs...).String(), stdout, stderr); err != nil {
+			return deployFailed(client, snapshot, nil, err, stdout, stderr)
+		}
+	} else {
+		// Start everything else first, blue-green services are swapped one at a time afterwards
+		swapped := make(map[string]bool)
+		for _, name := range blueGreen {
+			swapped[name] = true
+		}
+		var others []string
+		for _, name := range serviceNames(compose) {
+			if !swapped[name] {
+				others = append(others, name)
+			}
+		}
+		if len(others) > 0 {
+			upArgs = append(append(upArgs, "--no-deps"), others...)
+			if err := client.RunCommand(client.Compose(remoteDir, upArgs...).String(), stdout, stderr); err != nil {
+				return deployFailed(client, snapshot, nil, err, stdout, stderr)
+			}
+		}
+
+		// Registry images were only pulled for the services started above
+		if len(localImages) == 0 {
+			var pullable []string
+			for _, name := range registryServices(compose, localImages) {
+				if swapped[name] {
+					pullable = append(pullable, name)
+				}
+			}
+			if len(pullable) > 0 {
+				if err := client.RunCommand(client.Compose(remoteDir, append([]string{"pull"}, pullable...)...).String(), stdout, stderr); err != nil {
+					return fmt.Errorf("image pull failed: %v", err)
+				}
+			}
+		}
+
+		for _, name := range blueGreen {
+			fmt.Fprintf(stdout, "\n🔁 Blue-green deploy of '%s'\n", name)
+			if err := blueGreenDeploy(client, compose, remoteDir, name, stdout, stderr); err != nil {
+				return deployFailed(client, snapshot, nil, fmt.Errorf("%s: %v", name, err), stdout, stderr)
+			}
+		}
+	}
+
+	// Blue-green services were verified during their swap
+	var started []string
+	for _, name := range serviceNames(compose) {
+		if getDeployStrategy(compose.Services[name].Labels) != StrategyBlueGreen {
+			started = append(started, name)
+		}
+	}
+	if err := verifyServices(client, compose, remoteDir, started, stdout, stderr); err != nil {
+		return deployFailed(client, snapshot, nil, err, stdout, stderr)
+	}
+	hookErr := runPostDeployHooks(client, compose, remoteDir, serviceNames(compose), stdout, stderr)
+
+	// Remember what the images were built from, so the next sync can skip unchanged services
+	if err := saveBuildRecords(client, remoteDir, compose, buildHashes); err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not record build hashes: %v\n", err)
+	}
+
+	// Record the deploy as a release; its images stay tagged, so the prune below keeps them
+	if _, err := RecordRelease(client, remoteDir, CurrentCommit(useGit, gitBranch, gitCommit), meta.KeepReleases, stdout); err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not record release: %v\n", err)
 	}
 
 	// Cleanup: Remove only dangling images
 	fmt.Fprintln(stdout, "🧹 Cleaning up old images...")
-	cleanupCmd := "sudo docker image prune -f"
+	cleanupCmd := client.Docker("image", "prune", "-f").String()
 	client.RunCommand(cleanupCmd, stdout, stderr)
 
+	if hookErr != nil {
+		return hookErr
+	}
 	fmt.Fprintln(stdout, "✅ Deployment complete!")
 	return nil
 }
@@ -0,0 +1,182 @@
+package deploy
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/skssmd/graft/internal/config"
+)
+
+// localEnvDir is where the generated env files of the active environment are written; on
+// the server they always live in env/
+func localEnvDir() string {
+	if env := config.ActiveEnvironment(); env != "" {
+		return filepath.Join("env", env)
+	}
+	return "env"
+}
+
+// localComposeFile is the generated docker-compose.yml of the active environment
+func localComposeFile() string {
+	if env := config.ActiveEnvironment(); env != "" {
+		return "docker-compose." + env + ".yml"
+	}
+	return "docker-compose.yml"
+}
+
+// graftModeLabel maps a project deployment mode to the graft.mode label of its services
+func graftModeLabel(deploymentMode string) string {
+	switch deploymentMode {
+	case "git-images", "git-repo-serverbuild", "git-manual":
+		return deploymentMode
+	case "direct-localbuild":
+		return "localbuild"
+	default:
+		return "serverbuild" // Default to serverbuild for backward compatibility
+	}
+}
+
+// traefikName matches labels that name a Traefik router, service or middleware
+var traefikName = regexp.MustCompile(`^traefik\.(http|tcp|udp)\.(routers|services|middlewares)\.([^.]+)\.(.+)$`)
+
+// applyEnvironment adapts a parsed graft-compose.yml to the active environment: the project
+// domain is replaced with the environment's, Traefik routers, services and middlewares get
+// the environment as suffix so environments can share a server, the environment's
+// deployment mode replaces graft.mode and its env overrides replace service variables.
+// source is the file as read, to tell whether it references an override.
+func applyEnvironment(compose *DockerComposeFile, composeDomain string, source []byte) error {
+	meta, err := config.LoadProjectMetadata()
+	if err != nil || meta.CurrentEnvironment() == nil {
+		return nil
+	}
+	env := meta.CurrentEnvironment()
+
+	fromDomain := meta.Domain
+	if fromDomain == "" {
+		fromDomain = composeDomain
+	}
+	if env.Domain != "" && fromDomain == "" {
+		return fmt.Errorf("environment '%s' sets a domain, but the project's own domain is unknown\n👉 Add \"domain\": \"<domain used in graft-compose.yml>\" to .graft/project.json", meta.Environment)
+	}
+
+	declared := make(map[string]bool)
+	for name, service := range compose.Services {
+		labels := make(Labels, 0, len(service.Labels))
+		for _, label := range service.Labels {
+			key, value, _ := strings.Cut(label, "=")
+			if env.Domain != "" {
+				value = environmentHosts(value, fromDomain, env.Domain)
+			}
+			if m := traefikName.FindStringSubmatch(key); m != nil {
+				key = fmt.Sprintf("traefik.%s.%s.%s.%s", m[1], m[2], m[3]+"-"+meta.Environment, m[4])
+				if m[2] == "routers" && (m[4] == "service" || m[4] == "middlewares") {
+					value = environmentReferences(value, meta.Environment)
+				}
+			}
+			if key == "graft.mode" && env.DeploymentMode != "" {
+				value = graftModeLabel(env.DeploymentMode)
+			}
+			if strings.Contains(label, "=") {
+				labels = append(labels, key+"="+value)
+			} else {
+				labels = append(labels, key)
+			}
+		}
+		service.Labels = labels
+
+		switch vars := service.Environment.(type) {
+		case map[string]interface{}:
+			for k := range vars {
+				if v, ok := env.Env[k]; ok {
+					vars[k] = v
+					declared[k] = true
+				}
+			}
+		case []interface{}:
+			for i, entry := range vars {
+				k, _, _ := strings.Cut(fmt.Sprintf("%v", entry), "=")
+				if v, ok := env.Env[k]; ok {
+					vars[i] = k + "=" + v
+					declared[k] = true
+				}
+			}
+		}
+		compose.Services[name] = service
+	}
+
+	// An override no service declares only matters if graft-compose.yml references it
+	var unmatched []string
+	for k := range env.Env {
+		if !declared[k] && !regexp.MustCompile(`\$\{?`+regexp.QuoteMeta(k)+`\b`).Match(source) {
+			unmatched = append(unmatched, k)
+		}
+	}
+	if len(unmatched) > 0 {
+		sort.Strings(unmatched)
+		unmatchedWarning.Do(func() {
+			fmt.Printf("⚠️  env overrides of environment '%s' have no effect, no service declares them and graft-compose.yml does not reference them: %s\n", meta.Environment, strings.Join(unmatched, ", "))
+		})
+	}
+	return nil
+}
+
+// unmatchedWarning makes sure unmatched env overrides are reported once per run, though
+// the compose file is parsed several times
+var unmatchedWarning sync.Once
+
+// ruleHost matches a quoted host in a Traefik rule, e.g. Host(`api.example.com`)
+var ruleHost = regexp.MustCompile("`[^`]*`")
+
+// environmentHosts moves the hosts of the project domain in a label value to the
+// environment's domain: the host names quoted in Traefik rules, or the whole value (or
+// each part of a comma separated one) when it is a host name. Other text is left alone,
+// so a domain that merely contains the project's is not touched.
+func environmentHosts(value, fromDomain, toDomain string) string {
+	if ruleHost.MatchString(value) {
+		return ruleHost.ReplaceAllStringFunc(value, func(quoted string) string {
+			return "`" + environmentHost(strings.Trim(quoted, "`"), fromDomain, toDomain) + "`"
+		})
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		parts[i] = environmentHost(part, fromDomain, toDomain)
+	}
+	return strings.Join(parts, ",")
+}
+
+// environmentHost maps one host of the project domain to the environment's domain. When the
+// environment's domain is a single label below the project's, as for previews
+// (feature-login.app.example.com), subdomains are folded into that label
+// (feature-login-api.app.example.com), so one wildcard certificate and DNS record for
+// *.app.example.com serve every host. Otherwise subdomains are kept
+// (api.staging.example.com).
+func environmentHost(host, fromDomain, toDomain string) string {
+	if host == fromDomain {
+		return toDomain
+	}
+	sub, ok := strings.CutSuffix(host, "."+fromDomain)
+	if !ok || sub == "" || strings.ContainsAny(sub, "/:@ ") {
+		return host
+	}
+	if label, ok := strings.CutSuffix(toDomain, "."+fromDomain); ok && !strings.Contains(label, ".") {
+		return label + "-" + strings.ReplaceAll(sub, ".", "-") + "." + fromDomain
+	}
+	return sub + "." + toDomain
+}
+
+// environmentReferences renames the Traefik objects in a comma separated reference list,
+// leaving references to other providers (name@provider) alone
+func environmentReferences(value, environment string) string {
+	refs := strings.Split(value, ",")
+	for i, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if ref != "" && !strings.Contains(ref, "@") {
+			refs[i] = ref + "-" + environment
+		}
+	}
+	return strings.Join(refs, ",")
+}
@@ -0,0 +1,309 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+const (
+	healthTimeout = 2 * time.Minute
+	healthPoll    = 2 * time.Second
+	// without a healthcheck a container counts as healthy once it kept running this long
+	healthGrace = 10 * time.Second
+
+	// healthProbeImage runs HTTP probes inside the network namespace of the checked container.
+	// The version is pinned so a new release cannot change or break health checks.
+	healthProbeImage = "curlimages/curl:8.10.1"
+
+	// previousComposeFile keeps the compose file of the last deploy for rollbacks
+	previousComposeFile = "docker-compose.prev.yml"
+
+	// previousEnvDir keeps the env files of the last deploy for rollbacks
+	previousEnvDir = "env.prev"
+)
+
+// healthCheck is the post-deploy verification configured with graft.health.* labels
+type healthCheck struct {
+	enabled bool
+	path    string // HTTP path to probe, empty to rely on the Docker healthcheck
+	port    string
+	timeout time.Duration
+	oneshot bool // the service is a job expected to exit, exit code 0 counts as success
+}
+
+// getHealthCheck reads the graft.health.* labels of a service:
+//
+//	graft.health.path=/healthz   probe this path over HTTP
+//	graft.health.port=8080       port of the probe (default: Traefik server port, else 80)
+//	graft.health.timeout=90s     how long to wait (default 2m)
+//	graft.health.enabled=false   skip verification
+//	graft.health.oneshot=true    the service runs once, exiting with code 0 is a success
+func getHealthCheck(labels []string) healthCheck {
+	hc := healthCheck{enabled: true, timeout: healthTimeout}
+	for _, label := range labels {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "graft.health.path":
+			hc.path = value
+			if !strings.HasPrefix(hc.path, "/") {
+				hc.path = "/" + hc.path
+			}
+		case key == "graft.health.port":
+			hc.port = value
+		case key == "graft.health.timeout":
+			if d, err := time.ParseDuration(value); err == nil {
+				hc.timeout = d
+			} else if secs, err := strconv.Atoi(value); err == nil {
+				hc.timeout = time.Duration(secs) * time.Second
+			}
+		case key == "graft.health.enabled":
+			hc.enabled = value != "false"
+		case key == "graft.health.oneshot":
+			hc.oneshot = value == "true"
+		case hc.port == "" && strings.HasPrefix(key, "traefik.http.services.") && strings.HasSuffix(key, ".loadbalancer.server.port"):
+			hc.port = value
+		}
+	}
+	if hc.port == "" {
+		hc.port = "80"
+	}
+	return hc
+}
+
+// waitHealthy waits until a container is healthy: its HTTP probe answers with a 2xx/3xx
+// status, or else its Docker healthcheck passes. Containers with neither must keep running
+// without restarting for healthGrace. Any exit is a failure, except exit code 0 of a one-off
+// job (e.g. a migration) marked with graft.health.oneshot=true or restart: "no".
+func waitHealthy(client *ssh.Client, containerID string, service ComposeService, stdout io.Writer) error {
+	hc := getHealthCheck(service.Labels)
+	if restart, _ := service.OtherFields["restart"].(string); restart == "no" {
+		hc.oneshot = true
+	}
+	if hc.path != "" {
+		fmt.Fprintf(stdout, "⏳ Waiting for container %.12s to answer on :%s%s...\n", containerID, hc.port, hc.path)
+	} else {
+		fmt.Fprintf(stdout, "⏳ Waiting for container %.12s to become healthy...\n", containerID)
+	}
+	inspect := client.Docker("inspect", "-f", "{{.State.Status}}|{{if .State.Health}}{{.State.Health.Status}}{{end}}|{{.RestartCount}}|{{.State.ExitCode}}", containerID).String()
+
+	deadline := time.Now().Add(hc.timeout)
+	var runningSince time.Time
+	startRestarts := -1
+	for time.Now().Before(deadline) {
+		var out bytes.Buffer
+		if err := client.RunCommand(inspect, &out, nil); err != nil {
+			return fmt.Errorf("failed to inspect container: %v", err)
+		}
+		parts := strings.Split(strings.TrimSpace(out.String()), "|")
+		if len(parts) != 4 {
+			return fmt.Errorf("unexpected inspect output: %s", out.String())
+		}
+		status, health := parts[0], parts[1]
+		restarts, _ := strconv.Atoi(parts[2])
+		if startRestarts < 0 {
+			startRestarts = restarts
+		}
+
+		switch {
+		case status == "exited" && parts[3] == "0" && restarts == 0 && hc.oneshot:
+			fmt.Fprintln(stdout, "✅ Container finished successfully")
+			return nil
+		case status == "exited" && parts[3] == "0":
+			return fmt.Errorf("container exited (exit code 0)\n👉 Mark one-off jobs with the label graft.health.oneshot=true or restart: \"no\"")
+		case status == "exited" || status == "dead":
+			return fmt.Errorf("container %s (exit code %s)", status, parts[3])
+		case health == "unhealthy":
+			return fmt.Errorf("container is unhealthy")
+		case hc.path != "" && status == "running":
+			if probeHTTP(client, containerID, hc) {
+				fmt.Fprintln(stdout, "✅ Health probe passed")
+				return nil
+			}
+		case hc.path != "":
+			// not running yet, probe again on the next poll
+		case health == "healthy":
+			fmt.Fprintln(stdout, "✅ Container is healthy")
+			return nil
+		case health == "" && status == "running" && restarts == startRestarts:
+			if runningSince.IsZero() {
+				runningSince = time.Now()
+			} else if time.Since(runningSince) >= healthGrace {
+				fmt.Fprintln(stdout, "✅ Container is running (no healthcheck defined)")
+				return nil
+			}
+		default:
+			// restarting, or restarted since we started watching
+			runningSince = time.Time{}
+			startRestarts = restarts
+		}
+		time.Sleep(healthPoll)
+	}
+	return fmt.Errorf("not healthy after %s", hc.timeout)
+}
+
+// probeHTTP requests the health path from inside the container's network namespace, so the
+// probe neither needs a published port nor curl in the service image
+func probeHTTP(client *ssh.Client, containerID string, hc healthCheck) bool {
+	url := fmt.Sprintf("http://127.0.0.1:%s%s", hc.port, hc.path)
+	cmd := client.Docker("run", "--rm", "--network", "container:"+containerID, healthProbeImage,
+		"-fsS", "-o", "/dev/null", "--max-time", "5", url).String()
+	return client.RunCommand(cmd, nil, nil) == nil
+}
+
+// verifyServices waits for every listed service to become healthy. On failure the last log
+// lines of the failing services are shown.
+func verifyServices(client *ssh.Client, compose *DockerComposeFile, remoteDir string, services []string, stdout, stderr io.Writer) error {
+	var checked []string
+	for _, name := range services {
+		if getHealthCheck(compose.Services[name].Labels).enabled {
+			checked = append(checked, name)
+		}
+	}
+	if len(checked) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(stdout, "\n🩺 Verifying service health...")
+	return runParallel(len(checked), checked, stdout, stderr, func(serviceName string, stdout, stderr io.Writer) error {
+		id, err := serviceContainer(client, remoteDir, "", serviceName)
+		if err == nil {
+			err = waitHealthy(client, id, compose.Services[serviceName], stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "📜 Last log lines of %s:\n", serviceName)
+			client.RunCommand(client.Compose(remoteDir, "logs", "--tail=30", "--no-log-prefix", serviceName).String(), stdout, stderr)
+			return err
+		}
+		return nil
+	})
+}
+
+// deployedImage is the image a container was running before a deploy
+type deployedImage struct {
+	id  string // image id, still present after the tag moved to a new build or pull
+	ref string // image reference the container was created from
+}
+
+// deploySnapshot records what was running before a deploy, so it can be restored
+type deploySnapshot struct {
+	remoteDir  string
+	hasCompose bool
+	hasEnv     bool
+	images     map[string]deployedImage // service -> image
+}
+
+// snapshotDeploy keeps a copy of the current compose file and env files and records the
+// images of the running containers. It must run before the new env files and compose file
+// are uploaded.
+func snapshotDeploy(client *ssh.Client, remoteDir string) *deploySnapshot {
+	s := &deploySnapshot{remoteDir: remoteDir, images: make(map[string]deployedImage)}
+
+	current := path.Join(remoteDir, "docker-compose.yml")
+	backup := shell.New("test", "-f", current).And(shell.New("cp", current, path.Join(remoteDir, previousComposeFile)))
+	if client.RunCommand(backup.String(), nil, nil) != nil {
+		return s // first deploy, nothing to restore
+	}
+	s.hasCompose = true
+
+	envDir, prevEnvDir := path.Join(remoteDir, "env"), path.Join(remoteDir, previousEnvDir)
+	backupEnv := shell.New("rm", "-rf", prevEnvDir).
+		And(shell.New("test", "-d", envDir)).
+		And(shell.New("cp", "-a", envDir, prevEnvDir))
+	s.hasEnv = client.RunCommand(backupEnv.String(), nil, nil) == nil
+
+	s.images = runningImages(client, remoteDir)
+	return s
+}
+
+// runningImages returns the image of every container of the compose project in remoteDir
+func runningImages(client *ssh.Client, remoteDir string) map[string]deployedImage {
+	images := make(map[string]deployedImage)
+	var ids bytes.Buffer
+	if err := client.RunCommand(client.Compose(remoteDir, "ps", "-aq").String(), &ids, nil); err != nil {
+		return images
+	}
+	containers := strings.Fields(ids.String())
+	if len(containers) == 0 {
+		return images
+	}
+	args := append([]string{"inspect", "-f", `{{index .Config.Labels "com.docker.compose.service"}} {{.Image}} {{.Config.Image}}`}, containers...)
+	var out bytes.Buffer
+	if err := client.RunCommand(client.Docker(args...).String(), &out, nil); err != nil {
+		return images
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 {
+			images[fields[0]] = deployedImage{id: fields[1], ref: fields[2]}
+		}
+	}
+	return images
+}
+
+// rollback restores the previous compose file and points the image references back at the
+// previous images, then recreates the given services (all services when none are given)
+func (s *deploySnapshot) rollback(client *ssh.Client, services []string, stdout, stderr io.Writer) error {
+	if !s.hasCompose {
+		return fmt.Errorf("nothing to roll back to, this was the first deploy")
+	}
+	fmt.Fprintln(stdout, "\n⏪ Rolling back to the previous deployment...")
+	if err := s.restore(client, services, stdout, stderr); err != nil {
+		return err
+	}
+
+	args := []string{"up", "-d", "--remove-orphans"}
+	if len(services) > 0 {
+		args = append([]string{"up", "-d", "--no-deps"}, services...)
+	}
+	if err := client.RunCommand(client.Compose(s.remoteDir, args...).String(), stdout, stderr); err != nil {
+		return fmt.Errorf("failed to restart previous containers: %v", err)
+	}
+	fmt.Fprintln(stdout, "⏪ Previous deployment restored")
+	return nil
+}
+
+// restore puts the previous compose file and env files back and points the image
+// references of the given services (all services when none are given) at their previous images
+func (s *deploySnapshot) restore(client *ssh.Client, services []string, stdout, stderr io.Writer) error {
+	restore := shell.New("cp", path.Join(s.remoteDir, previousComposeFile), path.Join(s.remoteDir, "docker-compose.yml"))
+	if err := client.RunCommand(restore.String(), stdout, stderr); err != nil {
+		return fmt.Errorf("failed to restore compose file: %v", err)
+	}
+	if s.hasEnv {
+		envDir := path.Join(s.remoteDir, "env")
+		restoreEnv := shell.New("rm", "-rf", envDir).And(shell.New("cp", "-a", path.Join(s.remoteDir, previousEnvDir), envDir))
+		if err := client.RunCommand(restoreEnv.String(), stdout, stderr); err != nil {
+			return fmt.Errorf("failed to restore env files: %v", err)
+		}
+	}
+
+	for service, image := range s.images {
+		if len(services) > 0 && !slices.Contains(services, service) {
+			continue
+		}
+		if err := client.RunCommand(client.Docker("tag", image.id, image.ref).String(), stdout, stderr); err != nil {
+			return fmt.Errorf("failed to restore image of %s: %v", service, err)
+		}
+	}
+	return nil
+}
+
+// deployFailed rolls back after a failed start or health check and reports both outcomes
+func deployFailed(client *ssh.Client, snapshot *deploySnapshot, services []string, cause error, stdout, stderr io.Writer) error {
+	if err := snapshot.rollback(client, services, stdout, stderr); err != nil {
+		return fmt.Errorf("deployment failed: %v\n⚠️  Rollback failed: %v", cause, err)
+	}
+	return fmt.Errorf("deployment failed, previous version restored: %v", cause)
+}
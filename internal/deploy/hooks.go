@@ -0,0 +1,91 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+// Deploy hooks are shell commands declared as service labels:
+//
+//	graft.hook.pre-deploy=./migrate up     runs in a one-off container of the new image before
+//	                                       any container is replaced; failing aborts the deploy
+//	graft.hook.post-deploy=./warm-cache    runs in the service's container once it is started
+const (
+	HookPreDeploy  = "pre-deploy"
+	HookPostDeploy = "post-deploy"
+)
+
+// serviceHook returns the command of the service's hook for phase, "" without one
+func serviceHook(labels []string, phase string) string {
+	for _, label := range labels {
+		if key, value, ok := strings.Cut(label, "="); ok && key == "graft.hook."+phase {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// hookServices returns those of the given services that have a hook for phase
+func hookServices(compose *DockerComposeFile, services []string, phase string) []string {
+	var hooked []string
+	for _, name := range services {
+		if serviceHook(compose.Services[name].Labels, phase) != "" {
+			hooked = append(hooked, name)
+		}
+	}
+	return hooked
+}
+
+// runPreDeployHooks runs the pre-deploy hooks of services, one after another, each in a
+// one-off container of the service's new image. Images listed in pull come from a registry
+// and are pulled first. Running containers are left alone.
+func runPreDeployHooks(client *ssh.Client, compose *DockerComposeFile, remoteDir string, services, pull []string, stdout, stderr io.Writer) error {
+	for _, name := range hookServices(compose, services, HookPreDeploy) {
+		if slices.Contains(pull, name) {
+			if err := client.RunCommand(client.Compose(remoteDir, "pull", name).String(), stdout, stderr); err != nil {
+				return fmt.Errorf("image pull for the pre-deploy hook of %s failed: %v", name, err)
+			}
+		}
+		command := serviceHook(compose.Services[name].Labels, HookPreDeploy)
+		fmt.Fprintf(stdout, "🪝 Pre-deploy hook of %s: %s\n", name, command)
+		// --no-deps: compose would otherwise (re)create its dependencies from the new compose file
+		run := client.Compose(remoteDir, "run", "--rm", "-T", "--no-deps", "--entrypoint", "sh", name, "-c", command)
+		if err := client.RunCommand(run.String(), stdout, stderr); err != nil {
+			return fmt.Errorf("pre-deploy hook of %s failed: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// runPostDeployHooks runs the post-deploy hooks of services inside their started containers.
+// Every hook runs even if an earlier one failed; the failures are reported together.
+func runPostDeployHooks(client *ssh.Client, compose *DockerComposeFile, remoteDir string, services []string, stdout, stderr io.Writer) error {
+	var failed []string
+	for _, name := range hookServices(compose, services, HookPostDeploy) {
+		command := serviceHook(compose.Services[name].Labels, HookPostDeploy)
+		fmt.Fprintf(stdout, "🪝 Post-deploy hook of %s: %s\n", name, command)
+		exec := client.Compose(remoteDir, "exec", "-T", name, "sh", "-c", command)
+		if err := client.RunCommand(exec.String(), stdout, stderr); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("post-deploy hook failed (the new version is running):\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+// preDeployFailed puts the previous compose file, env files and image tags back after a
+// failed pre-deploy hook. No container was replaced, so nothing is restarted.
+func preDeployFailed(client *ssh.Client, snapshot *deploySnapshot, cause error, stdout, stderr io.Writer) error {
+	if snapshot != nil && snapshot.hasCompose {
+		if err := snapshot.restore(client, nil, stdout, stderr); err != nil {
+			return fmt.Errorf("deployment aborted: %v\n⚠️  Restoring the previous compose and env files failed: %v", cause, err)
+		}
+	}
+	return fmt.Errorf("deployment aborted, the running services were not touched: %v", cause)
+}
@@ -0,0 +1,314 @@
+package deploy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/skssmd/graft/internal/config"
+)
+
+// LoadVariables returns the values ${...} references in service environments resolve
+// from. Sources are tried in this order, the first one that sets a variable wins:
+//
+//  1. the env overrides of the active environment (.graft/project.json)
+//  2. graft secrets (.graft/secrets.<environment>.env, then .graft/secrets.env)
+//  3. the environment graft runs in
+//  4. the project's .env file
+func LoadVariables() (map[string]string, error) {
+	vars, err := readDotEnv(".env")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .env: %v", err)
+	}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			vars[k] = v
+		}
+	}
+	secrets, err := config.LoadSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets: %v", err)
+	}
+	for k, v := range secrets {
+		vars[k] = v
+	}
+	if meta, err := config.LoadProjectMetadata(); err == nil && meta.CurrentEnvironment() != nil {
+		for k, v := range meta.CurrentEnvironment().Env {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// readDotEnv reads KEY=value lines of a .env file, skipping comments. Values may be quoted.
+func readDotEnv(path string) (map[string]string, error) {
+	vars := make(map[string]string)
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return vars, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[strings.TrimSpace(key)] = value
+	}
+	return vars, scanner.Err()
+}
+
+// interpolateCompose resolves the variable references in a compose file the way docker
+// compose does, in every value of the services and of the top-level sections (keys are
+// left alone, as are graft's own x-* extensions): $VAR, ${VAR}, ${VAR:-default},
+// ${VAR-default}, ${VAR:?error}, ${VAR?error}, ${VAR:+replacement}, ${VAR+replacement} and
+// $$ for a literal $. Resolved values are written back with $ escaped as $$, because docker
+// compose interpolates the generated file and its env files once more on the server.
+// References that cannot be resolved fail the whole file, listing every one of them.
+func interpolateCompose(compose *DockerComposeFile, vars map[string]string) error {
+	var problems []string
+	report := func(where string, unresolved []string) {
+		sort.Strings(unresolved)
+		for _, u := range slices.Compact(unresolved) {
+			problems = append(problems, fmt.Sprintf("  - %s: %s", where, u))
+		}
+	}
+
+	for _, name := range serviceNames(compose) {
+		service := compose.Services[name]
+		var unresolved []string
+		resolve := func(s string) string {
+			value, missing := interpolate(s, vars)
+			unresolved = append(unresolved, missing...)
+			return escapeDollars(value)
+		}
+
+		service.Image = resolve(service.Image)
+		service.Environment = interpolateValue(service.Environment, resolve)
+		for i, label := range service.Labels {
+			service.Labels[i] = resolve(label)
+		}
+		for i := range service.EnvFiles {
+			service.EnvFiles[i].Path = resolve(service.EnvFiles[i].Path)
+		}
+		if build := service.Build; build != nil {
+			build.Context = resolve(build.Context)
+			build.Dockerfile = resolve(build.Dockerfile)
+			build.Target = resolve(build.Target)
+			build.Args = interpolateValue(build.Args, resolve)
+			for k, v := range build.OtherFields {
+				build.OtherFields[k] = interpolateValue(v, resolve)
+			}
+		}
+		for k, v := range service.OtherFields {
+			service.OtherFields[k] = interpolateValue(v, resolve)
+		}
+		compose.Services[name] = service
+		report(name, unresolved)
+	}
+
+	sections := map[string]interface{}{"networks": compose.Networks, "volumes": compose.Volumes}
+	for k, v := range compose.OtherFields {
+		if !strings.HasPrefix(k, "x-") {
+			sections[k] = v
+		}
+	}
+	keys := make([]string, 0, len(sections))
+	for k := range sections {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var unresolved []string
+		resolve := func(s string) string {
+			value, missing := interpolate(s, vars)
+			unresolved = append(unresolved, missing...)
+			return escapeDollars(value)
+		}
+		switch section := sections[key].(type) {
+		case map[string]interface{}:
+			for k, v := range section {
+				section[k] = interpolateValue(v, resolve)
+			}
+		default:
+			if _, ok := compose.OtherFields[key]; ok {
+				compose.OtherFields[key] = interpolateValue(section, resolve)
+			}
+		}
+		report(key, unresolved)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unresolved variables in graft-compose.yml:\n%s\n👉 Set them in .graft/secrets.env, the environment or the project's .env file", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// interpolateValue resolves the strings in a decoded YAML value, recursing into mappings
+// and lists. A nil environment or build arg value (taken from the server's environment) is
+// kept as it is.
+func interpolateValue(v interface{}, resolve func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return resolve(v)
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = interpolateValue(item, resolve)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateValue(item, resolve)
+		}
+	}
+	return v
+}
+
+// escapeDollars escapes every $ of a resolved value for another round of interpolation
+func escapeDollars(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// unescapeDollars turns an interpolated compose value back into the literal value, for
+// tools that do not interpolate, like docker build
+func unescapeDollars(s string) string {
+	return strings.ReplaceAll(s, "$$", "$")
+}
+
+// interpolate substitutes the variable references in s and returns the references that
+// could not be resolved
+func interpolate(s string, vars map[string]string) (string, []string) {
+	var out strings.Builder
+	var missing []string
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		switch next := s[i+1]; {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				missing = append(missing, fmt.Sprintf("unterminated reference %q", s[i:]))
+				out.WriteString(s[i:])
+				return out.String(), missing
+			}
+			value, problems := expandBraced(s[i+2:end], vars)
+			out.WriteString(value)
+			missing = append(missing, problems...)
+			i = end
+		case isNameStart(next):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			name := s[i+1 : j]
+			if value, ok := vars[name]; ok {
+				out.WriteString(value)
+			} else {
+				missing = append(missing, name)
+			}
+			i = j - 1
+		default:
+			out.WriteByte('$')
+		}
+	}
+	return out.String(), missing
+}
+
+// closingBrace finds the } that closes a ${ whose content starts at start
+func closingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// expandBraced resolves the content of a ${...} reference
+func expandBraced(expr string, vars map[string]string) (string, []string) {
+	n := 0
+	for n < len(expr) && isNameChar(expr[n]) {
+		n++
+	}
+	name, rest := expr[:n], expr[n:]
+	if name == "" || !isNameStart(name[0]) {
+		return "${" + expr + "}", []string{fmt.Sprintf("invalid reference ${%s}", expr)}
+	}
+	value, set := vars[name]
+
+	op := ""
+	for _, candidate := range []string{":-", ":?", ":+", "-", "?", "+"} {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" && rest != "" {
+		return "${" + expr + "}", []string{fmt.Sprintf("invalid reference ${%s}", expr)}
+	}
+	word := rest[len(op):]
+	// ':' variants treat an empty value like an unset one
+	present := set && (value != "" || !strings.HasPrefix(op, ":"))
+
+	switch strings.TrimPrefix(op, ":") {
+	case "-":
+		if present {
+			return value, nil
+		}
+		return interpolate(word, vars)
+	case "?":
+		if present {
+			return value, nil
+		}
+		message, _ := interpolate(word, vars)
+		if message == "" {
+			message = "required"
+		}
+		return "", []string{fmt.Sprintf("%s (%s)", name, message)}
+	case "+":
+		if present {
+			return interpolate(word, vars)
+		}
+		return "", nil
+	}
+	if !set {
+		return "", []string{name}
+	}
+	return value, nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,96 @@
+package deploy
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{
+		"HOST":  "db.internal",
+		"PORT":  "5432",
+		"EMPTY": "",
+		"PRICE": "$5",
+	}
+
+	tests := []struct {
+		in      string
+		want    string
+		missing []string
+	}{
+		{in: "plain text", want: "plain text"},
+		{in: "$HOST:$PORT", want: "db.internal:5432"},
+		{in: "${HOST}_x", want: "db.internal_x"},
+		{in: "$HOST_x", want: "", missing: []string{"HOST_x"}},
+		{in: "pa$$word", want: "pa$word"},
+		{in: "$$HOST", want: "$HOST"},
+		{in: "cost: $", want: "cost: $"},
+		{in: "100$ 5$-", want: "100$ 5$-"},
+		{in: "$PRICE", want: "$5"},
+		{in: "$MISSING and ${ALSO}", want: " and ", missing: []string{"MISSING", "ALSO"}},
+		{in: "${HOST", want: "${HOST", missing: []string{`unterminated reference "${HOST"`}},
+		{in: "${HOST:-${PORT}}", want: "db.internal"},
+		{in: "${NOPE:-${PORT}}", want: "5432"},
+		{in: "${NOPE:-a ${NOPE2:-b}}", want: "a b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, missing := interpolate(tt.in, vars)
+			if got != tt.want {
+				t.Errorf("interpolate(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if !slices.Equal(missing, tt.missing) {
+				t.Errorf("interpolate(%q) missing = %q, want %q", tt.in, missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestExpandBraced(t *testing.T) {
+	vars := map[string]string{"SET": "value", "EMPTY": ""}
+
+	tests := []struct {
+		expr    string
+		want    string
+		missing []string
+	}{
+		{expr: "SET", want: "value"},
+		{expr: "EMPTY", want: ""},
+		{expr: "UNSET", missing: []string{"UNSET"}},
+
+		{expr: "SET:-default", want: "value"},
+		{expr: "EMPTY:-default", want: "default"},
+		{expr: "UNSET:-default", want: "default"},
+		{expr: "EMPTY-default", want: ""},
+		{expr: "UNSET-default", want: "default"},
+
+		{expr: "SET:?needed", want: "value"},
+		{expr: "EMPTY:?needed", missing: []string{"EMPTY (needed)"}},
+		{expr: "EMPTY?needed", want: ""},
+		{expr: "UNSET?needed", missing: []string{"UNSET (needed)"}},
+		{expr: "UNSET:?", missing: []string{"UNSET (required)"}},
+
+		{expr: "SET:+other", want: "other"},
+		{expr: "EMPTY:+other", want: ""},
+		{expr: "EMPTY+other", want: "other"},
+		{expr: "UNSET+other", want: ""},
+		{expr: "SET:+$SET!", want: "value!"},
+
+		{expr: "", want: "${}", missing: []string{"invalid reference ${}"}},
+		{expr: "1ABC", want: "${1ABC}", missing: []string{"invalid reference ${1ABC}"}},
+		{expr: "SET/x", want: "${SET/x}", missing: []string{"invalid reference ${SET/x}"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, missing := expandBraced(tt.expr, vars)
+			if got != tt.want {
+				t.Errorf("expandBraced(%q) = %q, want %q", tt.expr, got, tt.want)
+			}
+			if !slices.Equal(missing, tt.missing) {
+				t.Errorf("expandBraced(%q) missing = %q, want %q", tt.expr, missing, tt.missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,449 @@
+package deploy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/git"
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+// localImageKeep is how many tags of a locally built service image stay on the server
+// (the running one plus older ones for rollbacks)
+const localImageKeep = 3
+
+// localImageRepo is the repository locally built images of a service are tagged with
+func localImageRepo(project, service string) string {
+	return fmt.Sprintf("graft-local/%s-%s", strings.ToLower(project), strings.ToLower(service))
+}
+
+// BuildLocalImage builds a localbuild service with the local Docker daemon and streams the
+// image to the server (docker save | gzip → ssh → gunzip | docker load). Layers the server
+// already has are left out of the stream. It returns the tag the server's compose file must use.
+func BuildLocalImage(client *ssh.Client, project, serviceName string, build *BuildConfig, contextPath string, noCache bool, stdout, stderr io.Writer) (string, error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return "", fmt.Errorf("localbuild needs Docker on this machine: %v", err)
+	}
+
+	dockerfileName := build.Dockerfile
+	if dockerfileName == "" {
+		dockerfileName = "Dockerfile"
+	}
+	dockerfilePath := filepath.Join(contextPath, dockerfileName)
+	if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
+		return "", fmt.Errorf("Dockerfile not found: %s\n👉 Checked path: %s", dockerfileName, dockerfilePath)
+	}
+
+	// Build for the server's architecture, which may differ from this machine's
+	platform, err := serverPlatform(client)
+	if err != nil {
+		return "", err
+	}
+
+	repo := localImageRepo(project, serviceName)
+	fmt.Fprintf(stdout, "  🔨 Building %s locally (%s)...\n", serviceName, platform)
+	args := []string{"build", "--platform", platform, "-t", repo + ":latest", "-f", dockerfilePath}
+	args = append(args, build.buildArgFlags()...)
+	if build.Target != "" {
+		args = append(args, "--target", build.Target)
+	}
+	if noCache {
+		args = append(args, "--no-cache")
+	}
+	args = append(args, contextPath)
+	buildCmd := exec.Command("docker", args...)
+	buildCmd.Stdout = stdout
+	buildCmd.Stderr = stderr
+	if err := buildCmd.Run(); err != nil {
+		return "", fmt.Errorf("local build failed: %v", err)
+	}
+
+	// Tag by image id: an unchanged image keeps its tag and never has to be uploaded again
+	imageID, err := localDockerOutput("image", "inspect", "-f", "{{.Id}}", repo+":latest")
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect built image: %v", err)
+	}
+	tag := repo + ":" + shortImageID(imageID)
+	if _, err := localDockerOutput("tag", repo+":latest", tag); err != nil {
+		return "", fmt.Errorf("failed to tag image: %v", err)
+	}
+
+	if err := client.RunCommand(client.Docker("image", "inspect", tag).String(), nil, nil); err == nil {
+		fmt.Fprintf(stdout, "  ✅ Server already has %s, skipping upload\n", tag)
+		return tag, nil
+	}
+
+	if err := pushLocalImage(client, tag, stdout, stderr); err != nil {
+		return "", err
+	}
+	pruneLocalImages(client, repo, tag)
+	return tag, nil
+}
+
+// LocalImageTag returns the server tag of the last local build of a service, if there is one
+func LocalImageTag(project, serviceName string) string {
+	repo := localImageRepo(project, serviceName)
+	imageID, err := localDockerOutput("image", "inspect", "-f", "{{.Id}}", repo+":latest")
+	if err != nil {
+		return ""
+	}
+	return repo + ":" + shortImageID(imageID)
+}
+
+// pushLocalImage streams the image to the server. If the server rejects an archive without
+// the layers it already has, the complete image is sent instead.
+func pushLocalImage(client *ssh.Client, tag string, stdout, stderr io.Writer) error {
+	layers, err := localImageLayers(tag)
+	if err != nil {
+		return err
+	}
+	shared := sharedLayerCount(layers, remoteImageLayers(client))
+
+	tmp, err := os.CreateTemp("", "graft-image-*.tar")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	fmt.Fprintf(stdout, "  📦 Exporting %s...\n", tag)
+	if _, err := localDockerOutput("save", "-o", tmp.Name(), tag); err != nil {
+		return fmt.Errorf("docker save failed: %v", err)
+	}
+
+	if shared > 0 {
+		fmt.Fprintf(stdout, "  ♻️  Server already has %d of %d layers\n", shared, len(layers))
+		var loadErr bytes.Buffer
+		if err := streamImage(client, tmp.Name(), shared, stdout, &loadErr); err == nil {
+			return nil
+		}
+		fmt.Fprintln(stdout, "  ⚠️  Server could not load the partial image, sending all layers...")
+	}
+
+	if err := streamImage(client, tmp.Name(), 0, stdout, stderr); err != nil {
+		return fmt.Errorf("failed to load image on server: %v", err)
+	}
+	return nil
+}
+
+// streamImage sends the saved archive, minus the first skipLayers layers, to docker load
+func streamImage(client *ssh.Client, archive string, skipLayers int, stdout, stderr io.Writer) error {
+	skip, err := skippedLayerFiles(archive, skipLayers)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	counter := &countingReader{r: pr}
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := filterTar(f, gz, skip)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	start := time.Now()
+	fmt.Fprintln(stdout, "  📤 Streaming image to server...")
+	loadCmd := shell.New("gunzip").Pipe(client.Docker("load"))
+	if err := client.RunCommandStdin(loadCmd.String(), counter, stdout, stderr); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	fmt.Fprintf(stdout, "  ✅ Uploaded %s (compressed) in %s\n", formatSize(counter.n), time.Since(start).Round(time.Second))
+	return nil
+}
+
+// skippedLayerFiles returns the archive paths of the first n layers. Files that a later layer
+// (or a symlink to it) still needs are kept.
+func skippedLayerFiles(archive string, n int) (map[string]bool, error) {
+	skip := make(map[string]bool)
+	if n == 0 {
+		return skip, nil
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var manifest []struct {
+		Layers []string
+	}
+	needed := make(map[string]bool)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image archive: %v", err)
+		}
+		switch {
+		case hdr.Name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, fmt.Errorf("failed to read image manifest: %v", err)
+			}
+		case hdr.Typeflag == tar.TypeSymlink:
+			needed[path.Join(path.Dir(hdr.Name), hdr.Linkname)] = true
+		}
+	}
+	if len(manifest) != 1 {
+		return skip, nil
+	}
+
+	layers := manifest[0].Layers
+	for i, layer := range layers {
+		if i >= n {
+			needed[layer] = true
+		}
+	}
+	for i := 0; i < n && i < len(layers); i++ {
+		if !needed[layers[i]] {
+			skip[layers[i]] = true
+		}
+	}
+	return skip, nil
+}
+
+// filterTar copies a tar stream, leaving out the entries in skip
+func filterTar(r io.Reader, w io.Writer, skip map[string]bool) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if skip[hdr.Name] {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// localImageLayers returns the layer diff ids of a local image, base layer first
+func localImageLayers(image string) ([]string, error) {
+	out, err := localDockerOutput("image", "inspect", "-f", "{{json .RootFS.Layers}}", image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image layers: %v", err)
+	}
+	var layers []string
+	if err := json.Unmarshal([]byte(out), &layers); err != nil {
+		return nil, fmt.Errorf("failed to parse image layers: %v", err)
+	}
+	return layers, nil
+}
+
+// remoteImageLayers returns the layer lists of every image on the server
+func remoteImageLayers(client *ssh.Client) [][]string {
+	var out bytes.Buffer
+	cmd := fmt.Sprintf(`ids=$(%s); [ -z "$ids" ] || %s $ids`,
+		client.Docker("image", "ls", "-q", "--no-trunc"),
+		client.Docker("image", "inspect", "-f", "{{json .RootFS.Layers}}"))
+	if err := client.RunCommand(cmd, &out, nil); err != nil {
+		return nil
+	}
+
+	var images [][]string
+	for _, line := range strings.Split(out.String(), "\n") {
+		var layers []string
+		if json.Unmarshal([]byte(strings.TrimSpace(line)), &layers) == nil {
+			images = append(images, layers)
+		}
+	}
+	return images
+}
+
+// sharedLayerCount returns how many leading layers of the image some server image shares.
+// Docker identifies a layer by its whole chain, so only a common prefix can be reused.
+func sharedLayerCount(layers []string, remote [][]string) int {
+	best := 0
+	for _, other := range remote {
+		n := 0
+		for n < len(layers) && n < len(other) && layers[n] == other[n] {
+			n++
+		}
+		if n > best {
+			best = n
+		}
+	}
+	return best
+}
+
+// pruneLocalImages removes all but the newest tags of a service image from the server.
+// Images still used by a container are kept by docker.
+func pruneLocalImages(client *ssh.Client, repo, current string) {
+	var out bytes.Buffer
+	list := client.Docker("image", "ls", repo, "--format", "{{.Repository}}:{{.Tag}}")
+	if err := client.RunCommand(list.String(), &out, nil); err != nil {
+		return
+	}
+
+	var stale []string
+	kept := 0
+	for _, tag := range strings.Fields(out.String()) {
+		if tag == current || strings.HasSuffix(tag, ":<none>") {
+			continue
+		}
+		kept++
+		if kept >= localImageKeep {
+			stale = append(stale, tag)
+		}
+	}
+	if len(stale) > 0 {
+		client.RunCommand(client.Docker(append([]string{"image", "rm"}, stale...)...).String(), nil, nil)
+	}
+}
+
+// serverPlatform maps the server's machine architecture to a docker build platform
+func serverPlatform(client *ssh.Client) (string, error) {
+	var out bytes.Buffer
+	if err := client.RunCommand("uname -m", &out, nil); err != nil {
+		return "", fmt.Errorf("failed to detect server architecture: %v", err)
+	}
+	switch arch := strings.TrimSpace(out.String()); arch {
+	case "x86_64", "amd64":
+		return "linux/amd64", nil
+	case "aarch64", "arm64":
+		return "linux/arm64", nil
+	case "armv7l":
+		return "linux/arm/v7", nil
+	default:
+		return "", fmt.Errorf("unsupported server architecture for localbuild: %s", arch)
+	}
+}
+
+// localDockerOutput runs the local docker CLI and returns its trimmed output
+func localDockerOutput(args ...string) (string, error) {
+	var errOut bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stderr = &errOut
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v %s", err, strings.TrimSpace(errOut.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// shortImageID returns the first 12 hex characters of an image id
+func shortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// formatSize renders a byte count for progress messages
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// registryServices returns the image-only services that are pulled from a registry
+func registryServices(compose *DockerComposeFile, localImages map[string]string) []string {
+	var names []string
+	for name, service := range compose.Services {
+		if _, local := localImages[name]; local || service.Image == "" || service.Build != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exportGitContext exports contextPath at the given branch/commit into a temp directory,
+// so a local build uses committed code only. The caller must run cleanup.
+func exportGitContext(gitBranch, gitCommit, contextPath string, stdout io.Writer) (string, func(), error) {
+	if !git.HasGitRepo(".") {
+		return "", nil, fmt.Errorf("--git flag used but no git repository found (.git directory missing)")
+	}
+
+	branch := gitBranch
+	if branch == "" {
+		current, err := git.GetCurrentBranch(".")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get current branch: %v", err)
+		}
+		branch = current
+	}
+	commit := gitCommit
+	if commit == "" {
+		latest, err := git.GetLatestCommit(".", branch)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get latest commit: %v", err)
+		}
+		commit = latest
+	}
+	fmt.Fprintf(stdout, "📦 Git mode: branch=%s, commit=%.7s\n", branch, commit)
+
+	tempDir, err := os.MkdirTemp("", "graft-git-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	tarballPath := filepath.Join(tempDir, "export.tar.gz")
+	if err := git.CreateArchive(".", commit, tarballPath, []string{filepath.ToSlash(contextPath) + "/"}); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to create git archive: %v", err)
+	}
+	extractDir := filepath.Join(tempDir, "extracted")
+	if err := git.ExtractArchive(tarballPath, extractDir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to extract git archive: %v", err)
+	}
+	return extractDir, cleanup, nil
+}
@@ -0,0 +1,279 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+const (
+	// DefaultLockWait is how long --wait waits for another deploy to finish
+	DefaultLockWait = 10 * time.Minute
+
+	// The holder refreshes the lock every lockHeartbeat; a lock without a refresh for
+	// lockStaleAfter belongs to a graft that crashed or lost its connection
+	lockHeartbeat  = 30 * time.Second
+	lockStaleAfter = 2 * time.Minute
+	lockPoll       = 5 * time.Second
+)
+
+// LockInfo describes who holds the deploy lock of a project
+type LockInfo struct {
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Command   string    `json:"command"`
+	StartedAt time.Time `json:"started_at"`
+	Token     string    `json:"token"`
+
+	// Idle is the time since the holder last refreshed the lock (server clock)
+	Idle time.Duration `json:"-"`
+}
+
+// Stale reports whether the holder stopped refreshing the lock
+func (i *LockInfo) Stale() bool {
+	return i.Idle > lockStaleAfter
+}
+
+func (i *LockInfo) String() string {
+	holder := fmt.Sprintf("%s@%s (pid %d", i.User, i.Host, i.PID)
+	if i.Command != "" {
+		holder += ", " + i.Command
+	}
+	if !i.StartedAt.IsZero() {
+		holder += fmt.Sprintf(", since %s", i.StartedAt.Local().Format("15:04:05"))
+	}
+	return holder + ")"
+}
+
+// Lock is a held deploy lock, refreshed in the background until Release
+type Lock struct {
+	client    *ssh.Client
+	remoteDir string
+	info      LockInfo
+	stop      chan struct{}
+	done      chan struct{}
+	release   sync.Once
+}
+
+// lockDir is the advisory lock of a project. mkdir is atomic, so only one deploy can create it.
+func lockDir(remoteDir string) string {
+	return path.Join(remoteDir, ".graft", "deploy.lock")
+}
+
+// AcquireLock takes the deploy lock of the project in remoteDir. When another deploy holds
+// it, AcquireLock fails right away, or waits up to wait for it to be released. Stale locks
+// are taken over.
+func AcquireLock(client *ssh.Client, remoteDir, command string, wait time.Duration, stdout io.Writer) (*Lock, error) {
+	if err := client.RunCommand(client.MkdirOwned(remoteDir, path.Join(remoteDir, ".graft")).String(), nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to prepare remote directory: %v", err)
+	}
+
+	info := LockInfo{PID: os.Getpid(), Command: command, StartedAt: time.Now().UTC()}
+	info.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		info.User = u.Username
+	}
+	token := make([]byte, 8)
+	rand.Read(token)
+	info.Token = hex.EncodeToString(token)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := lockDir(remoteDir)
+	create := shell.New("mkdir", dir).Append("2>/dev/null").And(shell.New("cat").Append("> " + shell.Quote(path.Join(dir, "info.json"))))
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		if err := client.RunCommandStdin(create.String(), bytes.NewReader(data), nil, nil); err == nil {
+			break
+		}
+
+		holder, err := ReadLock(client, remoteDir)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case holder == nil:
+			// released in the meantime
+		case holder.Stale():
+			fmt.Fprintf(stdout, "⚠️  Taking over stale deploy lock of %s, idle for %s\n", holder, holder.Idle.Round(time.Second))
+			// When another deploy takes it over first, nothing is removed and the next
+			// round finds its lock
+			if err := removeStaleLock(client, remoteDir, holder.Token); err != nil {
+				return nil, err
+			}
+		case time.Now().Before(deadline):
+			if !waiting {
+				fmt.Fprintf(stdout, "⏳ Waiting for the deploy of %s to finish...\n", holder)
+				waiting = true
+			}
+			time.Sleep(lockPoll)
+		case wait > 0:
+			return nil, fmt.Errorf("project is still locked by %s after waiting %s", holder, wait)
+		default:
+			return nil, fmt.Errorf("project is locked by %s\n👉 Use --wait to wait for it, or 'graft lock break' if that deploy is stuck", holder)
+		}
+	}
+
+	l := &Lock{client: client, remoteDir: remoteDir, info: info, stop: make(chan struct{}), done: make(chan struct{})}
+	go l.heartbeat()
+	return l, nil
+}
+
+// heartbeat refreshes the lock so other deploys do not consider it stale
+func (l *Lock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+	touch := shell.New("touch", path.Join(lockDir(l.remoteDir), "info.json")).String()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.client.RunCommandContext(context.Background(), touch, nil, nil)
+		}
+	}
+}
+
+// Release gives the lock up. It also works after the user interrupted the deploy, and
+// releasing it again does nothing.
+func (l *Lock) Release() {
+	l.release.Do(func() {
+		close(l.stop)
+		<-l.done
+		removeLock(l.client, l.remoteDir, l.info.Token)
+	})
+}
+
+// removeLock deletes the lock if it is still the one with the given token
+func removeLock(client *ssh.Client, remoteDir, token string) error {
+	dir := lockDir(remoteDir)
+	cmd := shell.New("grep", "-q", token, path.Join(dir, "info.json")).And(shell.New("rm", "-rf", dir))
+	if token == "" {
+		cmd = shell.New("rm", "-rf", dir)
+	}
+	if err := client.RunCommandContext(context.Background(), cmd.String(), nil, nil); err != nil {
+		return fmt.Errorf("failed to remove deploy lock: %v", err)
+	}
+	return nil
+}
+
+// removeStaleLock deletes the lock if it still has the given token and is still stale, so
+// a lock another deploy took over in the meantime is left alone
+func removeStaleLock(client *ssh.Client, remoteDir, token string) error {
+	if err := client.RunCommandContext(context.Background(), staleLockScript(lockDir(remoteDir), token), nil, nil); err != nil {
+		return fmt.Errorf("failed to remove stale deploy lock: %v", err)
+	}
+	return nil
+}
+
+// staleLockScript removes the lock in dir when it is stale and, unless token is empty,
+// still holds token. The idle time is measured like ReadLock does.
+func staleLockScript(dir, token string) string {
+	infoFile := path.Join(dir, "info.json")
+	script := "f=" + shell.Quote(infoFile) + "; [ -f \"$f\" ] || f=" + shell.Quote(dir) + "; [ -e \"$f\" ] || exit 0; " +
+		fmt.Sprintf("[ $(( $(date +%%s) - $(stat -c %%Y \"$f\") )) -gt %d ] || exit 0; ", int(lockStaleAfter.Seconds()))
+	if token != "" {
+		script += "grep -q " + shell.Quote(token) + " " + shell.Quote(infoFile) + " 2>/dev/null || exit 0; "
+	}
+	return script + "rm -rf " + shell.Quote(dir)
+}
+
+// ReadLock returns the holder of the project's deploy lock, or nil when it is not locked
+func ReadLock(client *ssh.Client, remoteDir string) (*LockInfo, error) {
+	dir := lockDir(remoteDir)
+	infoFile := path.Join(dir, "info.json")
+	// Idle time is measured with the server's clock, workstation clocks may differ
+	read := shell.Raw("f=" + shell.Quote(infoFile) + "; [ -f \"$f\" ] || f=" + shell.Quote(dir) + "; [ -e \"$f\" ] || { echo unlocked; exit 0; }; " +
+		"cat " + shell.Quote(infoFile) + " 2>/dev/null; echo; echo $(( $(date +%s) - $(stat -c %Y \"$f\") ))")
+	var out bytes.Buffer
+	if err := client.RunCommand(read.String(), &out, nil); err != nil {
+		return nil, fmt.Errorf("failed to read deploy lock: %v", err)
+	}
+	if strings.TrimSpace(out.String()) == "unlocked" {
+		return nil, nil
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	idle, _ := strconv.Atoi(strings.TrimSpace(lines[len(lines)-1]))
+	info := &LockInfo{User: "unknown", Host: "unknown"}
+	json.Unmarshal([]byte(strings.Join(lines[:len(lines)-1], "\n")), info)
+	info.Idle = time.Duration(idle) * time.Second
+	return info, nil
+}
+
+// BreakLock removes the deploy lock regardless of its holder and returns who held it
+func BreakLock(client *ssh.Client, remoteDir string) (*LockInfo, error) {
+	info, err := ReadLock(client, remoteDir)
+	if err != nil || info == nil {
+		return info, err
+	}
+	return info, removeLock(client, remoteDir, "")
+}
+
+// HookLockPath is where graft installs LockScript on the server, next to graft-hook. It is
+// inside /opt/graft, which the graft-hook container mounts at the same path; graft-hook
+// itself does not use it yet.
+const HookLockPath = "/opt/graft/webhook/graft-lock"
+
+// LockScript returns a shell script that runs a command while holding the deploy lock of a
+// project, so scripts on the server and graft sync exclude each other:
+//
+//	graft-lock /opt/graft/projects/<project> docker compose up -d
+//
+// It takes the lock the way AcquireLock does: it takes over stale locks, refreshes the lock
+// while the command runs and waits up to DefaultLockWait for another deploy to finish.
+func LockScript() string {
+	return fmt.Sprintf(`#!/bin/sh
+# Runs a command while holding the graft deploy lock of a project.
+# Usage: graft-lock <project-dir> <command...>
+[ $# -ge 2 ] || { echo "usage: graft-lock <project-dir> <command...>" >&2; exit 2; }
+dir="$1/.graft/deploy.lock"
+shift
+mkdir -p "${dir%%/*}" || exit 1
+token=$(od -An -N8 -tx1 /dev/urandom | tr -d ' \n')
+waited=0
+while ! mkdir "$dir" 2>/dev/null; do
+	held=$(sed -n 's/.*"token":"\([^"]*\)".*/\1/p' "$dir/info.json" 2>/dev/null)
+	f="$dir/info.json"; [ -f "$f" ] || f="$dir"
+	if [ -e "$f" ] && [ $(( $(date +%%s) - $(stat -c %%Y "$f") )) -gt %d ]; then
+		echo "graft-lock: taking over stale deploy lock $dir" >&2
+		if [ -z "$held" ] || grep -q "$held" "$dir/info.json" 2>/dev/null; then rm -rf "$dir"; fi
+		continue
+	fi
+	if [ "$waited" -ge %d ]; then
+		echo "graft-lock: $dir is still held after %s: $(cat "$dir/info.json" 2>/dev/null)" >&2
+		exit 75
+	fi
+	sleep %d
+	waited=$(( waited + %d ))
+done
+printf '{"user":"graft-hook","host":"%%s","pid":%%d,"command":"webhook deploy","started_at":"%%s","token":"%%s"}\n' \
+	"$(hostname 2>/dev/null || echo server)" $$ "$(date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ)" "$token" > "$dir/info.json"
+( while sleep %d; do touch "$dir/info.json"; done ) &
+heartbeat=$!
+trap 'kill $heartbeat 2>/dev/null; grep -q "$token" "$dir/info.json" 2>/dev/null && rm -rf "$dir"' EXIT
+trap 'exit 129' HUP
+trap 'exit 130' INT
+trap 'exit 143' TERM
+"$@"
+`, int(lockStaleAfter.Seconds()), int(DefaultLockWait.Seconds()), DefaultLockWait, int(lockPoll.Seconds()), int(lockPoll.Seconds()), int(lockHeartbeat.Seconds()))
+}
@@ -0,0 +1,135 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// prefixWriter prefixes every line written to it with the service name. Lines are
+// written to the underlying writer whole, so concurrent services do not interleave mid-line.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(mu *sync.Mutex, w io.Writer, name string) *prefixWriter {
+	return &prefixWriter{mu: mu, w: w, prefix: fmt.Sprintf("[%s] ", name)}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		// Progress output often redraws with \r, treat it as a line end as well
+		idx := bytes.IndexAny(p.buf, "\r\n")
+		if idx < 0 {
+			break
+		}
+		line := p.buf[:idx+1]
+		if len(bytes.TrimSpace(line)) > 0 {
+			p.writeLine(bytes.TrimRight(line, "\r\n"))
+		}
+		p.buf = p.buf[idx+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes a trailing partial line
+func (p *prefixWriter) Flush() {
+	if len(bytes.TrimSpace(p.buf)) > 0 {
+		p.writeLine(p.buf)
+	}
+	p.buf = nil
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, "%s%s\n", p.prefix, line)
+}
+
+// runParallel runs task for every service with at most n running at once. With n <= 1 the
+// services run one after another with unprefixed output. After the first failure no new
+// services are started; all failures are reported together once the running ones finish.
+func runParallel(n int, services []string, stdout, stderr io.Writer, task func(service string, stdout, stderr io.Writer) error) error {
+	if n <= 1 {
+		for _, service := range services {
+			if err := task(service, stdout, stderr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		mu      sync.Mutex // serializes output lines
+		errMu   sync.Mutex
+		failed  []error
+		wg      sync.WaitGroup
+		limiter = make(chan struct{}, n)
+	)
+	aborted := func() bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return len(failed) > 0
+	}
+
+	for _, service := range services {
+		limiter <- struct{}{}
+		if aborted() {
+			<-limiter
+			break
+		}
+
+		wg.Add(1)
+		go func(service string) {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			out := newPrefixWriter(&mu, stdout, service)
+			errOut := newPrefixWriter(&mu, stderr, service)
+			err := task(service, out, errOut)
+			out.Flush()
+			errOut.Flush()
+
+			if err != nil {
+				errMu.Lock()
+				failed = append(failed, fmt.Errorf("%s: %v", service, err))
+				errMu.Unlock()
+			}
+		}(service)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Error() < failed[j].Error() })
+	return fmt.Errorf("%d service(s) failed:\n%v", len(failed), errors.Join(failed...))
+}
+
+// serviceNames returns the compose services in a stable order
+func serviceNames(compose *DockerComposeFile) []string {
+	names := make([]string, 0, len(compose.Services))
+	for name := range compose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildServices returns the services the server has to build
+func buildServices(compose *DockerComposeFile) []string {
+	var names []string
+	for _, name := range serviceNames(compose) {
+		if compose.Services[name].Build != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
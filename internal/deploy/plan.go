@@ -0,0 +1,446 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// planListLimit caps how many uploaded or deleted files are listed per build context
+const planListLimit = 20
+
+// Plan prints what a sync would change on the server without uploading, building or
+// restarting anything: the docker-compose.yml diff, changed env files (values masked), the
+// files each serverbuild context would upload or delete and the service actions. With a
+// serviceName only that service's code and action are shown.
+func Plan(client *ssh.Client, p *Project, serviceName string, noCache, force, useGit bool, gitBranch, gitCommit string, stdout io.Writer) error {
+	remoteDir := fmt.Sprintf("/opt/graft/projects/%s", p.Name)
+
+	localFile := "graft-compose.yml"
+	if _, err := os.Stat(localFile); err != nil {
+		return fmt.Errorf("project file not found: %s", localFile)
+	}
+	compose, err := ParseComposeFile(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to parse compose file: %v", err)
+	}
+	services := serviceNames(compose)
+	if serviceName != "" {
+		if _, ok := compose.Services[serviceName]; !ok {
+			return fmt.Errorf("service '%s' not found in compose file", serviceName)
+		}
+		services = []string{serviceName}
+	}
+
+	fmt.Fprintf(stdout, "🔍 Dry run for project %s: nothing is uploaded, built or restarted\n", p.Name)
+
+	// Keep the original build contexts, the generated compose file points them at the server
+	contexts := make(map[string]*BuildConfig)
+	for name, s := range compose.Services {
+		if s.Build != nil {
+			build := *s.Build
+			contexts[name] = &build
+		}
+	}
+
+	// Generate the compose file and env files the same way Sync does, in memory only.
+	// Locally built services show their last local build, the real tag is known after building.
+	localImages := make(map[string]string)
+	for _, name := range serviceNames(compose) {
+		s := compose.Services[name]
+		if getGraftMode(s.Labels) == "localbuild" && s.Build != nil {
+			tag := LocalImageTag(p.Name, name)
+			if tag == "" {
+				tag = localImageRepo(p.Name, name) + ":<built-on-sync>"
+			}
+			localImages[name] = tag
+		}
+	}
+	envFiles := make(map[string]string) // env/<file> -> content that would be uploaded
+	if files, err := os.ReadDir(localEnvDir()); err == nil {
+		for _, f := range files {
+			if !f.IsDir() {
+				if data, err := os.ReadFile(filepath.Join(localEnvDir(), f.Name())); err == nil {
+					envFiles["env/"+f.Name()] = string(data)
+				}
+			}
+		}
+	}
+	vars, err := LoadVariables()
+	if err != nil {
+		return err
+	}
+	if err := interpolateCompose(compose, vars); err != nil {
+		return err
+	}
+	for _, name := range serviceNames(compose) {
+		s := compose.Services[name]
+		if rel, content := renderServiceEnvironment(name, &s); rel != "" {
+			envFiles[filepath.ToSlash(rel)] = content
+		}
+		prepareServerService(name, &s, localImages)
+		compose.Services[name] = s
+	}
+	generated, err := yaml.Marshal(compose)
+	if err != nil {
+		return fmt.Errorf("failed to marshal updated compose file: %v", err)
+	}
+
+	// Compose file
+	fmt.Fprintln(stdout, "\n📄 docker-compose.yml:")
+	var remoteData bytes.Buffer
+	remoteExists := client.RunCommand(shell.New("cat", path.Join(remoteDir, "docker-compose.yml")).String(), &remoteData, nil) == nil
+	var remoteCompose DockerComposeFile
+	switch {
+	case !remoteExists:
+		fmt.Fprintf(stdout, "  + new file (%d lines)\n", strings.Count(string(generated), "\n"))
+	case remoteData.String() == string(generated):
+		fmt.Fprintln(stdout, "  no changes")
+	default:
+		fmt.Fprint(stdout, indent(unifiedDiff("server/docker-compose.yml", "local/docker-compose.yml", splitLines(remoteData.String()), splitLines(string(generated)), 3)))
+	}
+	if remoteExists {
+		yaml.Unmarshal(remoteData.Bytes(), &remoteCompose)
+	}
+
+	// Env files
+	fmt.Fprintln(stdout, "\n🔐 Environment files (values masked):")
+	changedEnv := make(map[string]bool)
+	unchanged := 0
+	for _, rel := range sortedStringKeys(envFiles) {
+		var remote bytes.Buffer
+		exists := client.RunCommand(shell.New("cat", path.Join(remoteDir, rel)).String(), &remote, nil) == nil
+		changes := envChanges(parseEnv(remote.String()), parseEnv(envFiles[rel]))
+		switch {
+		case !exists:
+			fmt.Fprintf(stdout, "  + %s (new, %d variables)\n", rel, len(parseEnv(envFiles[rel])))
+		case len(changes) == 0:
+			unchanged++
+			continue
+		default:
+			fmt.Fprintf(stdout, "  ~ %s\n", rel)
+			for _, change := range changes {
+				fmt.Fprintf(stdout, "      %s\n", change)
+			}
+		}
+		changedEnv[rel] = true
+	}
+	if len(changedEnv) == 0 {
+		fmt.Fprintln(stdout, "  no changes")
+	} else if unchanged > 0 {
+		fmt.Fprintf(stdout, "  %d unchanged\n", unchanged)
+	}
+
+	// Source code. A full sync skips server builds whose content is unchanged.
+	fmt.Fprintln(stdout, "\n📦 Source code:")
+	codeChanges := make(map[string]int)
+	skippedBuilds := make(map[string]bool)
+	builds := loadBuildRecords(client, remoteDir)
+	shown := false
+	for _, name := range services {
+		s := compose.Services[name]
+		build := contexts[name]
+		if build == nil {
+			continue
+		}
+		shown = true
+		mode := getGraftMode(s.Labels)
+		if mode == "localbuild" {
+			fmt.Fprintf(stdout, "  %s: built locally, the image is uploaded only if it changed\n", name)
+			continue
+		}
+		if mode != "serverbuild" {
+			fmt.Fprintf(stdout, "  %s: not uploaded in mode %s\n", name, mode)
+			continue
+		}
+
+		contextPath := filepath.Clean(build.Context)
+		if useGit {
+			exportDir, cleanup, err := exportGitContext(gitBranch, gitCommit, contextPath, io.Discard)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			contextPath = filepath.Join(exportDir, contextPath)
+		}
+		if _, err := os.Stat(contextPath); os.IsNotExist(err) {
+			return fmt.Errorf("build context directory not found: %s", contextPath)
+		}
+		if serviceName == "" && !force && !noCache {
+			dockerfile := build.Dockerfile
+			if dockerfile == "" {
+				dockerfile = "Dockerfile"
+			}
+			hash, err := buildHash(contextPath, filepath.Join(contextPath, dockerfile), build)
+			if err != nil {
+				return fmt.Errorf("failed to hash build context of %s: %v", name, err)
+			}
+			if unchangedBuild(client, remoteDir, name, s, builds[name], hash) {
+				skippedBuilds[name] = true
+				fmt.Fprintf(stdout, "  %s: unchanged since the last deploy, not uploaded\n", name)
+				continue
+			}
+		}
+		contextName := filepath.Base(filepath.Clean(build.Context))
+		if contextName == "." || contextName == "/" {
+			contextName = name
+		}
+		plan, err := client.PlanSync(contextPath, path.Join(remoteDir, contextName))
+		if err != nil {
+			return fmt.Errorf("failed to plan upload of %s: %v", name, err)
+		}
+		codeChanges[name] = len(plan.Upload) + len(plan.Delete)
+		if codeChanges[name] == 0 {
+			fmt.Fprintf(stdout, "  %s: no changes (%d files)\n", name, plan.Unchanged)
+			continue
+		}
+		fmt.Fprintf(stdout, "  %s: %d to upload (%s), %d to delete, %d unchanged\n", name, len(plan.Upload), formatSize(plan.Bytes), len(plan.Delete), plan.Unchanged)
+		printFileList(stdout, "+", plan.Upload)
+		printFileList(stdout, "-", plan.Delete)
+	}
+	if !shown {
+		fmt.Fprintln(stdout, "  no build contexts")
+	}
+
+	// Services
+	fmt.Fprintln(stdout, "\n🚀 Services:")
+	for _, name := range services {
+		s := compose.Services[name]
+		var actions []string
+		old, existed := remoteCompose.Services[name]
+		if !existed {
+			actions = append(actions, "create")
+		}
+
+		mode := getGraftMode(s.Labels)
+		switch {
+		case contexts[name] != nil && mode == "localbuild":
+			actions = append(actions, "build locally")
+		case skippedBuilds[name]:
+			// same image, recreated below only if its configuration changed
+		case s.Build != nil && (noCache || codeChanges[name] > 0):
+			actions = append(actions, "rebuild")
+		case s.Build != nil:
+			actions = append(actions, "rebuild (cached, code unchanged)")
+		case s.Image != "":
+			actions = append(actions, "pull")
+		}
+
+		if existed {
+			var reasons []string
+			if serviceYAML(old) != serviceYAML(s) {
+				reasons = append(reasons, "configuration changed")
+			}
+			for _, envFile := range s.EnvFiles {
+				if changedEnv[strings.TrimPrefix(path.Clean(envFile.Path), "./")] {
+					reasons = append(reasons, "environment changed")
+					break
+				}
+			}
+			switch {
+			case len(reasons) > 0:
+				actions = append(actions, "recreate ("+strings.Join(reasons, ", ")+")")
+			case len(actions) > 0:
+				actions = append(actions, "recreate if the image changed")
+			}
+		}
+
+		marker := "~"
+		if !existed {
+			marker = "+"
+		} else if len(actions) == 0 {
+			marker = "="
+			actions = []string{"unchanged"}
+		}
+		if getDeployStrategy(s.Labels) == StrategyBlueGreen && existed {
+			actions = append(actions, "blue-green")
+		}
+		// Hooks run on every deploy, whether or not the service changed
+		for _, phase := range []string{HookPreDeploy, HookPostDeploy} {
+			if serviceHook(s.Labels, phase) != "" {
+				actions = append(actions, phase+" hook")
+			}
+		}
+		fmt.Fprintf(stdout, "  %s %-20s %s\n", marker, name, strings.Join(actions, ", "))
+	}
+	if serviceName == "" {
+		for _, name := range serviceNames(&remoteCompose) {
+			if _, ok := compose.Services[name]; !ok {
+				fmt.Fprintf(stdout, "  - %-20s remove (no longer in %s)\n", name, localFile)
+			}
+		}
+	}
+
+	fmt.Fprintln(stdout, "\nℹ️  Run without --dry-run to apply.")
+	return nil
+}
+
+// serviceYAML renders a service definition for comparison
+func serviceYAML(s ComposeService) string {
+	data, _ := yaml.Marshal(s)
+	return string(data)
+}
+
+func printFileList(stdout io.Writer, marker string, files []string) {
+	for i, f := range files {
+		if i == planListLimit {
+			fmt.Fprintf(stdout, "      ... and %d more\n", len(files)-planListLimit)
+			return
+		}
+		fmt.Fprintf(stdout, "      %s %s\n", marker, f)
+	}
+}
+
+// parseEnv reads KEY=VALUE lines of an env file
+func parseEnv(content string) map[string]string {
+	env := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		env[strings.TrimSpace(key)] = value
+	}
+	return env
+}
+
+// envChanges lists added, changed and removed variables without revealing any value
+func envChanges(old, new map[string]string) []string {
+	var changes []string
+	for _, key := range sortedStringKeys(new) {
+		prev, exists := old[key]
+		switch {
+		case !exists:
+			changes = append(changes, "+ "+key+"=****")
+		case prev != new[key]:
+			changes = append(changes, "~ "+key+"=****")
+		}
+	}
+	for _, key := range sortedStringKeys(old) {
+		if _, exists := new[key]; !exists {
+			changes = append(changes, "- "+key)
+		}
+	}
+	return changes
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func indent(s string) string {
+	var b strings.Builder
+	for _, line := range splitLines(s) {
+		b.WriteString("  " + line + "\n")
+	}
+	return b.String()
+}
+
+// unifiedDiff returns a unified diff of a and b with the given number of context lines
+func unifiedDiff(nameA, nameB string, a, b []string, context int) string {
+	// Longest common subsequence table, lcs[i][j] covers a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type op struct {
+		kind byte // ' ', '-' or '+'
+		line string
+		ai   int // line number in a before this op
+		bi   int // line number in b before this op
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, op{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', a[i], i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(ops); {
+		// Find the next change and the extent of its hunk
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		from := max(start-context, 0)
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k
+			} else if k-end > 2*context {
+				break
+			}
+		}
+		to := min(end+context+1, len(ops))
+
+		countA, countB := 0, 0
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				countA++
+			}
+			if o.kind != '-' {
+				countB++
+			}
+		}
+		// An empty side starts at the line before the hunk
+		startA, startB := ops[from].ai+1, ops[from].bi+1
+		if countA == 0 {
+			startA--
+		}
+		if countB == 0 {
+			startB--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", startA, countA, startB, countB)
+		for _, o := range ops[from:to] {
+			fmt.Fprintf(&out, "%c%s\n", o.kind, o.line)
+		}
+		start = to
+	}
+	return out.String()
+}
@@ -0,0 +1,61 @@
+package deploy
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    []string
+		context int
+		want    string
+	}{
+		{
+			name:    "identical",
+			a:       []string{"1", "2"},
+			b:       []string{"1", "2"},
+			context: 3,
+			want:    "--- a\n+++ b\n",
+		},
+		{
+			name:    "changed line with context",
+			a:       []string{"1", "2", "3", "4", "5"},
+			b:       []string{"1", "2", "X", "4", "5"},
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -2,3 +2,3 @@\n 2\n-3\n+X\n 4\n",
+		},
+		{
+			name:    "new file",
+			b:       []string{"x", "y"},
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+		},
+		{
+			name:    "removed file",
+			a:       []string{"x"},
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-x\n",
+		},
+		{
+			name:    "distant changes in separate hunks",
+			a:       []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"},
+			b:       []string{"A", "2", "3", "4", "5", "6", "7", "8", "Z"},
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-1\n+A\n 2\n@@ -8,2 +8,2 @@\n 8\n-9\n+Z\n",
+		},
+		{
+			name:    "close changes share a hunk",
+			a:       []string{"1", "2", "3", "4"},
+			b:       []string{"A", "2", "3", "D"},
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+A\n 2\n 3\n-4\n+D\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("a", "b", tt.a, tt.b, tt.context); got != tt.want {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
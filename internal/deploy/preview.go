@@ -0,0 +1,234 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+)
+
+// PreviewInfo describes a branch preview, kept on the server in .graft/preview.json
+type PreviewInfo struct {
+	Name      string    `json:"name"` // project name on the server, <project>_pr_<branch>
+	Branch    string    `json:"branch"`
+	Commit    string    `json:"commit,omitempty"`
+	Host      string    `json:"host"`
+	Databases []string  `json:"databases,omitempty"` // throwaway Postgres databases of the preview
+	User      string    `json:"user,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PreviewSlug turns a branch name into a DNS label: lower case letters, digits and dashes
+func PreviewSlug(branch string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(branch) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimRight(b.String(), "-")
+	// Keep room for the project and database names built from it
+	if len(slug) > 30 {
+		slug = strings.TrimRight(slug[:30], "-")
+	}
+	return slug
+}
+
+// PreviewEnvironmentName is the environment a preview deploys as, so its project is
+// named <project>_pr_<branch>
+func PreviewEnvironmentName(slug string) string {
+	return "pr_" + strings.ReplaceAll(slug, "-", "_")
+}
+
+// previewInfoPath is where a preview describes itself on the server
+func previewInfoPath(remoteDir string) string {
+	return path.Join(remoteDir, ".graft", "preview.json")
+}
+
+// SavePreviewInfo writes the description of a preview to the server
+func SavePreviewInfo(client *ssh.Client, remoteDir string, info *PreviewInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(os.TempDir(), "graft_preview.json")
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+
+	if err := client.RunCommand(client.MkdirOwned(path.Dir(previewInfoPath(remoteDir))).String(), nil, nil); err != nil {
+		return fmt.Errorf("failed to create %s: %v", path.Dir(previewInfoPath(remoteDir)), err)
+	}
+	if err := client.UploadFile(tmpFile, previewInfoPath(remoteDir)); err != nil {
+		return fmt.Errorf("failed to upload preview info: %v", err)
+	}
+	return nil
+}
+
+// LoadPreviewInfo reads the description of a preview, nil when remoteDir is no preview
+func LoadPreviewInfo(client *ssh.Client, remoteDir string) (*PreviewInfo, error) {
+	var out bytes.Buffer
+	cmd := shell.New("cat", previewInfoPath(remoteDir)).Append("2>/dev/null").Or(shell.New("true"))
+	if err := client.RunCommand(cmd.String(), &out, nil); err != nil {
+		return nil, fmt.Errorf("failed to read preview info: %v", err)
+	}
+	if out.Len() == 0 {
+		return nil, nil
+	}
+	var info PreviewInfo
+	if err := json.Unmarshal(out.Bytes(), &info); err != nil {
+		return nil, fmt.Errorf("invalid preview info in %s: %v", remoteDir, err)
+	}
+	return &info, nil
+}
+
+// ListPreviews returns the previews of a project on the server, newest first
+func ListPreviews(client *ssh.Client, project string) ([]PreviewInfo, error) {
+	var out bytes.Buffer
+	pattern := shell.Quote("/opt/graft/projects/"+project+"_pr_") + "*/.graft/preview.json"
+	cmd := shell.Raw("cat " + pattern).Append("2>/dev/null").Or(shell.New("true"))
+	if err := client.RunCommand(cmd.String(), &out, nil); err != nil {
+		return nil, fmt.Errorf("failed to list previews: %v", err)
+	}
+
+	var previews []PreviewInfo
+	decoder := json.NewDecoder(&out)
+	for {
+		var info PreviewInfo
+		if err := decoder.Decode(&info); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid preview info: %v", err)
+		}
+		previews = append(previews, info)
+	}
+	sort.Slice(previews, func(i, j int) bool {
+		return previews[i].UpdatedAt.After(previews[j].UpdatedAt)
+	})
+	return previews, nil
+}
+
+// RemovePreview stops a preview and deletes its containers, volumes, images and files. The
+// preview has to be the active environment.
+func RemovePreview(client *ssh.Client, remoteDir string, stdout, stderr io.Writer) error {
+	fmt.Fprintln(stdout, "🛑 Stopping preview containers...")
+	// A preview whose first deploy failed may not have a compose file yet
+	if client.RunCommand(shell.New("test", "-f", path.Join(remoteDir, "docker-compose.yml")).String(), nil, nil) == nil {
+		down := client.Compose(remoteDir, "down", "--volumes", "--rmi", "local", "--remove-orphans")
+		if err := client.RunCommand(down.String(), stdout, stderr); err != nil {
+			return fmt.Errorf("failed to stop preview: %v", err)
+		}
+	}
+
+	// Images kept for rollbacks of the preview
+	name := path.Base(remoteDir)
+	ids := client.Docker("images", "-q", "--filter", "reference=graft-release/"+name+"-*")
+	images := client.Docker("rmi", "-f").Append("$(" + ids.String() + ")").
+		Append(">/dev/null 2>&1").Or(shell.New("true"))
+	client.RunCommand(images.String(), nil, nil)
+
+	fmt.Fprintf(stdout, "🗑️  Removing %s\n", remoteDir)
+	if err := client.RunCommand(client.Privileged("rm", "-rf", remoteDir).String(), stdout, stderr); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", remoteDir, err)
+	}
+
+	// Files generated locally while deploying the preview
+	os.Remove(localComposeFile())
+	os.RemoveAll(localEnvDir())
+	return nil
+}
+
+// GeneratePreviewWorkflow writes .github/workflows/preview.yml, which deploys every pull
+// request with graft preview up and removes it with graft preview down once it is closed
+func GeneratePreviewWorkflow(p *Project, domain string) error {
+	workflowsDir := filepath.Join(".github", "workflows")
+	if err := os.MkdirAll(workflowsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create workflows directory: %v", err)
+	}
+
+	previewTemplate := `name: Preview
+
+on:
+  pull_request:
+    types: [opened, reopened, synchronize, closed]
+
+concurrency:
+  group: preview-${{ github.event.pull_request.number }}
+
+jobs:
+  preview:
+    name: Preview Environment
+    runs-on: ubuntu-latest
+    environment: CI CD
+    env:
+      BRANCH: ${{ github.head_ref }}
+      COMMIT: ${{ github.event.pull_request.head.sha }}
+
+    steps:
+      - name: Checkout code
+        uses: actions/checkout@v4
+        with:
+          fetch-depth: 0
+
+      - name: Set up Go
+        uses: actions/setup-go@v5
+        with:
+          go-version: stable
+
+      - name: Install graft
+        run: go install github.com/skssmd/graft/cmd/graft@latest
+
+      # graft-compose.yml and .graft/ are not committed, they are rebuilt from repository secrets
+      - name: Configure graft
+        env:
+          GRAFT_HOST: ${{ secrets.GRAFT_HOST }}
+          GRAFT_USER: ${{ secrets.GRAFT_USER }}
+          GRAFT_SSH_KEY: ${{ secrets.GRAFT_SSH_KEY }}
+          GRAFT_KNOWN_HOSTS: ${{ secrets.GRAFT_KNOWN_HOSTS }}
+          GRAFT_SECRETS: ${{ secrets.GRAFT_SECRETS }}
+          GRAFT_COMPOSE: ${{ secrets.GRAFT_COMPOSE }}
+        run: |
+          mkdir -p .graft ~/.graft
+          printf '%%s\n' "$GRAFT_SSH_KEY" > ~/.graft/preview_key
+          chmod 600 ~/.graft/preview_key
+          printf '%%s\n' "$GRAFT_KNOWN_HOSTS" > ~/.graft/known_hosts
+          printf '%%s\n' "$GRAFT_SECRETS" > .graft/secrets.env
+          [ -f graft-compose.yml ] || printf '%%s\n' "$GRAFT_COMPOSE" > graft-compose.yml
+          cat > .graft/config.json <<EOF
+          {"server": {"host": "$GRAFT_HOST", "port": 22, "user": "$GRAFT_USER", "key_path": "~/.graft/preview_key"}}
+          EOF
+          cat > .graft/project.json <<EOF
+          {"name": "%s", "remote_path": "/opt/graft/projects/%s", "domain": "%s"}
+          EOF
+
+      - name: Deploy preview
+        if: github.event.action != 'closed'
+        run: graft preview up "$BRANCH" --commit "$COMMIT"
+
+      - name: Remove preview
+        if: github.event.action == 'closed'
+        run: graft preview down "$BRANCH"
+`
+	content := fmt.Sprintf(previewTemplate, p.Name, p.Name, domain)
+	previewPath := filepath.Join(workflowsDir, "preview.yml")
+	if err := os.WriteFile(previewPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write preview workflow: %v", err)
+	}
+	return nil
+}
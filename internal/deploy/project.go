@@ -13,7 +13,7 @@ type Service struct {
 	GraftMode string            `yaml:"graft-mode,omitempty"`
 	Port      int               `yaml:"port,omitempty"`
 	Env       map[string]string `yaml:"env,omitempty"`
-	Labels    []string          `yaml:"labels,omitempty"`
+	Labels    Labels            `yaml:"labels,omitempty"`
 }
 
 type Project struct {
@@ -47,21 +47,7 @@ func (p *Project) Save(dir string) error {
 	path := filepath.Join(dir, filename)
 	
 	// Determine the graft mode label based on deployment mode
-	var graftMode string
-	switch p.DeploymentMode {
-	case "git-images":
-		graftMode = "git-images"
-	case "git-repo-serverbuild":
-		graftMode = "git-repo-serverbuild"
-	case "git-manual":
-		graftMode = "git-manual"
-	case "direct-localbuild":
-		graftMode = "localbuild"
-	case "direct-serverbuild":
-		graftMode = "serverbuild"
-	default:
-		graftMode = "serverbuild" // Default to serverbuild for backward compatibility
-	}
+	graftMode := graftModeLabel(p.DeploymentMode)
 	
 	// Generate a valid docker-compose.yml file that can be used directly
 	template := `# Docker Compose Configuration for: %s
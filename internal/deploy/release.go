@@ -0,0 +1,285 @@
+package deploy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/git"
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultKeepReleases is the number of releases kept on the server unless configured otherwise
+const DefaultKeepReleases = 5
+
+// Release is a deploy recorded on the server under .graft/releases/<id>, together with a
+// copy of its docker-compose.yml and env files
+type Release struct {
+	ID        string                  `json:"id"`
+	CreatedAt time.Time               `json:"created_at"`
+	GitCommit string                  `json:"git_commit,omitempty"`
+	Services  map[string]ReleaseImage `json:"services"`
+}
+
+// ReleaseImage is the image a service ran in a release
+type ReleaseImage struct {
+	Ref    string `json:"ref"`              // image reference in the compose file
+	ID     string `json:"id"`               // image id
+	Digest string `json:"digest,omitempty"` // registry digest, for pulled images
+}
+
+// releasesDir is where the releases of a project are kept on the server
+func releasesDir(remoteDir string) string {
+	return path.Join(remoteDir, ".graft", "releases")
+}
+
+// releaseImageTag keeps the image of a release from being pruned
+func releaseImageTag(project, service, id string) string {
+	return fmt.Sprintf("graft-release/%s-%s:%s", project, service, id)
+}
+
+// timestampID returns an id that sorts by time. The random suffix keeps ids created within
+// the same second, by two clients or two quick deploys, apart.
+func timestampID(t time.Time) string {
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return t.Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// CurrentCommit returns the commit being deployed: the exported one in git mode, otherwise
+// HEAD of the working directory when it is a git repository
+func CurrentCommit(useGit bool, gitBranch, gitCommit string) string {
+	if !git.HasGitRepo(".") {
+		return ""
+	}
+	if useGit && gitCommit != "" {
+		if commit, err := git.GetLatestCommit(".", gitCommit); err == nil {
+			return commit
+		}
+		return gitCommit
+	}
+	ref := "HEAD"
+	if useGit && gitBranch != "" {
+		ref = gitBranch
+	}
+	commit, _ := git.GetLatestCommit(".", ref)
+	return commit
+}
+
+// RecordRelease snapshots the deployed compose file, env files and images as a new release
+// and removes releases beyond keep
+func RecordRelease(client *ssh.Client, remoteDir, gitCommit string, keep int, stdout io.Writer) (*Release, error) {
+	project := composeProjectName(remoteDir)
+	now := time.Now().UTC()
+	release := &Release{
+		ID:        timestampID(now),
+		CreatedAt: now,
+		GitCommit: gitCommit,
+		Services:  make(map[string]ReleaseImage),
+	}
+	dir := path.Join(releasesDir(remoteDir), release.ID)
+
+	// mkdir without -p fails instead of mixing two releases in one directory
+	copyFiles := shell.New("mkdir", "-p", releasesDir(remoteDir)).
+		And(shell.New("mkdir", dir)).
+		And(shell.New("cp", path.Join(remoteDir, "docker-compose.yml"), dir)).
+		And(shell.Raw("{ [ ! -d " + shell.Quote(path.Join(remoteDir, "env")) + " ] || cp -r " + shell.Quote(path.Join(remoteDir, "env")) + " " + shell.Quote(dir) + "; }"))
+	if err := client.RunCommand(copyFiles.String(), nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to save release files: %v", err)
+	}
+
+	images := runningImages(client, remoteDir)
+	digests := imageDigests(client, images)
+	for service, image := range images {
+		// A tag keeps the image from being removed by image prune once newer releases replace it
+		if err := client.RunCommand(client.Docker("tag", image.id, releaseImageTag(project, service, release.ID)).String(), nil, nil); err != nil {
+			return nil, fmt.Errorf("failed to tag image of %s: %v", service, err)
+		}
+		release.Services[service] = ReleaseImage{Ref: image.ref, ID: image.id, Digest: digests[image.id]}
+	}
+
+	data, err := json.Marshal(release)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.RunCommandStdin(shell.New("cat").Append("> "+shell.Quote(path.Join(dir, "release.json"))).String(), bytes.NewReader(data), nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to save release: %v", err)
+	}
+	if err := setCurrentRelease(client, remoteDir, release.ID); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(stdout, "🏷️  Recorded release %s\n", release.ID)
+
+	pruneReleases(client, remoteDir, keep, stdout)
+	return release, nil
+}
+
+// imageDigests looks up the registry digests of the given images
+func imageDigests(client *ssh.Client, images map[string]deployedImage) map[string]string {
+	digests := make(map[string]string)
+	if len(images) == 0 {
+		return digests
+	}
+	args := []string{"image", "inspect", "-f", `{{.Id}} {{join .RepoDigests ","}}`}
+	for _, image := range images {
+		args = append(args, image.id)
+	}
+	var out bytes.Buffer
+	client.RunCommand(client.Docker(args...).String(), &out, nil)
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			digests[fields[0]] = strings.Split(fields[1], ",")[0]
+		}
+	}
+	return digests
+}
+
+// setCurrentRelease marks the release that is running now
+func setCurrentRelease(client *ssh.Client, remoteDir, id string) error {
+	cmd := shell.New("echo", id).Append("> " + shell.Quote(path.Join(releasesDir(remoteDir), "current")))
+	if err := client.RunCommand(cmd.String(), nil, nil); err != nil {
+		return fmt.Errorf("failed to mark release %s as current: %v", id, err)
+	}
+	return nil
+}
+
+// ListReleases returns the releases on the server, oldest first, and the id of the active one
+func ListReleases(client *ssh.Client, remoteDir string) ([]Release, string, error) {
+	dir := releasesDir(remoteDir)
+	list := shell.Raw("for f in " + shell.Quote(dir) + "/*/release.json; do [ -f \"$f\" ] && cat \"$f\" && echo; done; true")
+	var out bytes.Buffer
+	if err := client.RunCommand(list.String(), &out, nil); err != nil {
+		return nil, "", fmt.Errorf("failed to list releases: %v", err)
+	}
+
+	var releases []Release
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var r Release
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			continue
+		}
+		releases = append(releases, r)
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		if !releases[i].CreatedAt.Equal(releases[j].CreatedAt) {
+			return releases[i].CreatedAt.Before(releases[j].CreatedAt)
+		}
+		return releases[i].ID < releases[j].ID
+	})
+
+	var current bytes.Buffer
+	client.RunCommand(shell.New("cat", path.Join(dir, "current")).String(), &current, nil)
+	return releases, strings.TrimSpace(current.String()), nil
+}
+
+// pruneReleases removes the oldest releases and their image tags, keeping keep releases
+// and always the active one
+func pruneReleases(client *ssh.Client, remoteDir string, keep int, stdout io.Writer) {
+	if keep < 1 {
+		keep = DefaultKeepReleases
+	}
+	releases, current, err := ListReleases(client, remoteDir)
+	if err != nil || len(releases) <= keep {
+		return
+	}
+
+	project := composeProjectName(remoteDir)
+	for _, r := range releases[:len(releases)-keep] {
+		if r.ID == current {
+			continue
+		}
+		for service := range r.Services {
+			client.RunCommand(client.Docker("rmi", releaseImageTag(project, service, r.ID)).String(), nil, nil)
+		}
+		client.RunCommand(shell.New("rm", "-rf", path.Join(releasesDir(remoteDir), r.ID)).String(), nil, nil)
+		fmt.Fprintf(stdout, "🗑️  Removed old release %s\n", r.ID)
+	}
+}
+
+// RollbackRelease reactivates a release: its compose file, env files and images. Without
+// an id the release before the active one is used.
+func RollbackRelease(client *ssh.Client, remoteDir, id string, stdout, stderr io.Writer) error {
+	releases, current, err := ListReleases(client, remoteDir)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		return fmt.Errorf("no releases found on the server")
+	}
+
+	var target *Release
+	if id == "" {
+		for i := range releases {
+			if releases[i].ID == current && i > 0 {
+				target = &releases[i-1]
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("no release before the active one (%s)", current)
+		}
+	} else {
+		for i := range releases {
+			if releases[i].ID == id {
+				target = &releases[i]
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("release %s not found, see 'graft releases'", id)
+		}
+	}
+
+	fmt.Fprintf(stdout, "⏪ Rolling back to release %s", target.ID)
+	if target.GitCommit != "" {
+		fmt.Fprintf(stdout, " (commit %.7s)", target.GitCommit)
+	}
+	fmt.Fprintln(stdout)
+
+	dir := path.Join(releasesDir(remoteDir), target.ID)
+	envDir := path.Join(remoteDir, "env")
+	restore := shell.New("cp", path.Join(dir, "docker-compose.yml"), path.Join(remoteDir, "docker-compose.yml")).
+		And(shell.Raw("{ [ ! -d " + shell.Quote(path.Join(dir, "env")) + " ] || { rm -rf " + shell.Quote(envDir) + " && cp -r " + shell.Quote(path.Join(dir, "env")) + " " + shell.Quote(envDir) + "; }; }"))
+	if err := client.RunCommand(restore.String(), stdout, stderr); err != nil {
+		return fmt.Errorf("failed to restore release files: %v", err)
+	}
+
+	project := composeProjectName(remoteDir)
+	for service, image := range target.Services {
+		if err := client.RunCommand(client.Docker("tag", releaseImageTag(project, service, target.ID), image.Ref).String(), stdout, stderr); err != nil {
+			return fmt.Errorf("failed to restore image of %s: %v", service, err)
+		}
+	}
+
+	fmt.Fprintln(stdout, "🚀 Starting services...")
+	if err := client.RunCommand(client.Compose(remoteDir, "up", "-d", "--remove-orphans").String(), stdout, stderr); err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	if err := client.RunCommand(shell.New("cat", path.Join(remoteDir, "docker-compose.yml")).String(), &data, stderr); err != nil {
+		return err
+	}
+	var compose DockerComposeFile
+	if err := yaml.Unmarshal(data.Bytes(), &compose); err != nil {
+		return fmt.Errorf("failed to parse release compose file: %v", err)
+	}
+	if err := setCurrentRelease(client, remoteDir, target.ID); err != nil {
+		return err
+	}
+	if err := verifyServices(client, &compose, remoteDir, serviceNames(&compose), stdout, stderr); err != nil {
+		return fmt.Errorf("release %s is not healthy: %v", target.ID, err)
+	}
+	return nil
+}
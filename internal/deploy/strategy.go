@@ -0,0 +1,255 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// Deploy strategies, selected per service with the graft.deploy.strategy label
+const (
+	StrategyRecreate  = "recreate"   // stop the old container, then start the new one (default)
+	StrategyBlueGreen = "blue-green" // start the new container next to the old one, then stop the old one
+)
+
+// standbyComposeFile holds the single-service project that runs the new container during a swap
+const standbyComposeFile = "docker-compose.standby.yml"
+
+// getDeployStrategy extracts graft.deploy.strategy from service labels
+func getDeployStrategy(labels []string) string {
+	for _, label := range labels {
+		if strings.HasPrefix(label, "graft.deploy.strategy=") {
+			switch strings.ToLower(strings.TrimPrefix(label, "graft.deploy.strategy=")) {
+			case "blue-green", "bluegreen":
+				return StrategyBlueGreen
+			}
+		}
+	}
+	return StrategyRecreate
+}
+
+// composeProjectName is the compose project of a remote project directory
+func composeProjectName(remoteDir string) string {
+	return path.Base(remoteDir)
+}
+
+// blueGreenDeploy replaces the running container of a service without downtime. The new
+// image is started in a standby compose project (<project>-standby) on the same networks and
+// volumes. Once it is healthy Traefik routes to both containers, the old container is
+// recreated from the new image, and the standby copy is removed after that is healthy too.
+// compose is the generated compose file; the image must already be built or pulled.
+func blueGreenDeploy(client *ssh.Client, compose *DockerComposeFile, remoteDir, serviceName string, stdout, stderr io.Writer) error {
+	project := composeProjectName(remoteDir)
+	standbyProject := project + "-standby"
+	service := compose.Services[serviceName]
+
+	// First deploy: nothing to keep serving, start normally
+	current, _ := serviceContainer(client, remoteDir, "", serviceName)
+	if current == "" {
+		fmt.Fprintf(stdout, "🚀 Starting %s...\n", serviceName)
+		if err := client.RunCommand(client.Compose(remoteDir, "up", "-d", "--no-deps", serviceName).String(), stdout, stderr); err != nil {
+			return err
+		}
+		id, err := serviceContainer(client, remoteDir, "", serviceName)
+		if err != nil {
+			return err
+		}
+		return waitHealthy(client, id, service, stdout)
+	}
+
+	standby, err := standbyCompose(compose, project, serviceName)
+	if err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("graft-%s-standby.yml", serviceName))
+	if err := os.WriteFile(tmpFile, standby, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+	if err := client.UploadFile(tmpFile, path.Join(remoteDir, standbyComposeFile)); err != nil {
+		return fmt.Errorf("failed to upload standby compose file: %v", err)
+	}
+
+	standbyArgs := func(args ...string) []string {
+		return append([]string{"-p", standbyProject, "-f", standbyComposeFile}, args...)
+	}
+	removeStandby := func() {
+		client.RunCommand(client.Compose(remoteDir, standbyArgs("down", "--remove-orphans")...).String(), nil, nil)
+	}
+	// A leftover from an interrupted deploy would be serving an old image
+	removeStandby()
+
+	fmt.Fprintf(stdout, "🟢 Starting new %s container alongside the running one...\n", serviceName)
+	if err := client.RunCommand(client.Compose(remoteDir, standbyArgs("up", "-d", serviceName)...).String(), stdout, stderr); err != nil {
+		removeStandby()
+		return fmt.Errorf("failed to start new container: %v", err)
+	}
+	standbyID, err := serviceContainer(client, remoteDir, standbyProject, serviceName)
+	if err == nil {
+		err = waitHealthy(client, standbyID, service, stdout)
+	}
+	if err != nil {
+		client.RunCommand(client.Compose(remoteDir, standbyArgs("logs", "--tail=50", serviceName)...).String(), stdout, stderr)
+		removeStandby()
+		return fmt.Errorf("new container did not become healthy, the old one keeps running: %v", err)
+	}
+
+	// Both containers carry the same Traefik labels, so traffic is now split between them.
+	// Give Traefik a moment to pick up the new one before the old one goes away.
+	fmt.Fprintln(stdout, "🔀 Traefik is routing to old and new containers")
+	time.Sleep(healthPoll)
+
+	fmt.Fprintf(stdout, "🔵 Replacing old %s container...\n", serviceName)
+	if err := client.RunCommand(client.Compose(remoteDir, "up", "-d", "--no-deps", "--force-recreate", serviceName).String(), stdout, stderr); err != nil {
+		return fmt.Errorf("failed to recreate %s, the new container in project %s keeps serving: %v", serviceName, standbyProject, err)
+	}
+	id, err := serviceContainer(client, remoteDir, "", serviceName)
+	if err == nil {
+		err = waitHealthy(client, id, service, stdout)
+	}
+	if err != nil {
+		return fmt.Errorf("recreated %s is not healthy, the new container in project %s keeps serving: %v", serviceName, standbyProject, err)
+	}
+
+	fmt.Fprintln(stdout, "🧹 Removing standby container...")
+	removeStandby()
+	return nil
+}
+
+// standbyCompose returns a compose file that runs only serviceName from the generated compose
+// file, attached to the main project's networks and volumes
+func standbyCompose(compose *DockerComposeFile, project, serviceName string) ([]byte, error) {
+	service, ok := compose.Services[serviceName]
+	if !ok {
+		return nil, fmt.Errorf("service '%s' not found in compose file", serviceName)
+	}
+
+	// Run the image the main project built or pulled instead of building again
+	if service.Image == "" {
+		service.Image = project + "-" + serviceName
+	}
+	service.Build = nil
+
+	// Drop settings that would clash with the running container or reference other services
+	other := make(map[string]interface{}, len(service.OtherFields))
+	for k, v := range service.OtherFields {
+		switch k {
+		case "container_name", "ports", "depends_on", "links":
+			continue
+		}
+		other[k] = v
+	}
+	service.OtherFields = other
+
+	standby := DockerComposeFile{
+		Version:     compose.Version,
+		Services:    map[string]ComposeService{serviceName: service},
+		Networks:    make(map[string]interface{}),
+		Volumes:     make(map[string]interface{}),
+		OtherFields: make(map[string]interface{}),
+	}
+	// The service may mount top-level configs and secrets; they resolve from the same directory
+	for _, key := range []string{"configs", "secrets"} {
+		if def, ok := compose.OtherFields[key]; ok {
+			standby.OtherFields[key] = def
+		}
+	}
+	if _, ok := other["network_mode"]; !ok {
+		for _, name := range serviceNetworks(other["networks"]) {
+			standby.Networks[name] = sharedResource(compose.Networks[name], project, name)
+		}
+	}
+	for _, name := range namedVolumes(other["volumes"], compose.Volumes) {
+		standby.Volumes[name] = sharedResource(compose.Volumes[name], project, name)
+	}
+	return yaml.Marshal(standby)
+}
+
+// sharedResource turns a network or volume definition of the main project into an external
+// reference, so the standby project uses the existing one instead of creating its own
+func sharedResource(def interface{}, project, name string) interface{} {
+	if m, ok := def.(map[string]interface{}); ok {
+		if ext, _ := m["external"].(bool); ext {
+			return m
+		}
+		if explicit, ok := m["name"].(string); ok && explicit != "" {
+			return map[string]interface{}{"name": explicit, "external": true}
+		}
+	}
+	return map[string]interface{}{"name": project + "_" + name, "external": true}
+}
+
+// serviceNetworks lists the networks a service joins (compose's default network when unset)
+func serviceNetworks(networks interface{}) []string {
+	var names []string
+	switch n := networks.(type) {
+	case []interface{}:
+		for _, v := range n {
+			names = append(names, fmt.Sprintf("%v", v))
+		}
+	case map[string]interface{}:
+		for name := range n {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{"default"}
+	}
+	return names
+}
+
+// namedVolumes lists the top-level named volumes a service mounts
+func namedVolumes(volumes interface{}, declared map[string]interface{}) []string {
+	list, _ := volumes.([]interface{})
+	var names []string
+	for _, v := range list {
+		var source string
+		switch vol := v.(type) {
+		case string:
+			source = strings.SplitN(vol, ":", 2)[0]
+		case map[string]interface{}:
+			source, _ = vol["source"].(string)
+		}
+		if _, ok := declared[source]; ok && source != "" {
+			names = append(names, source)
+		}
+	}
+	return names
+}
+
+// serviceContainer returns the id of the container of a service in the given compose
+// project ("" for the project of remoteDir), including stopped ones
+func serviceContainer(client *ssh.Client, remoteDir, project, serviceName string) (string, error) {
+	args := []string{"ps", "-aq", serviceName}
+	if project != "" {
+		args = append([]string{"-p", project, "-f", standbyComposeFile}, args...)
+	}
+	var out bytes.Buffer
+	if err := client.RunCommand(client.Compose(remoteDir, args...).String(), &out, nil); err != nil {
+		return "", fmt.Errorf("failed to find container of %s: %v", serviceName, err)
+	}
+	ids := strings.Fields(out.String())
+	if len(ids) == 0 {
+		return "", fmt.Errorf("%s has no container", serviceName)
+	}
+	return ids[0], nil
+}
+
+// blueGreenServices returns the services deployed with the blue-green strategy
+func blueGreenServices(compose *DockerComposeFile) []string {
+	var names []string
+	for _, name := range serviceNames(compose) {
+		if getDeployStrategy(compose.Services[name].Labels) == StrategyBlueGreen {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,214 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skssmd/graft/internal/shell"
+	"github.com/skssmd/graft/internal/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// Task is a named one-off command, declared in graft-compose.yml under the x-graft-tasks
+// extension key, which docker compose ignores:
+//
+//	x-graft-tasks:
+//	  migrate:
+//	    service: api
+//	    command: ./manage.py migrate
+//	    description: Apply database migrations
+type Task struct {
+	Service     string `yaml:"service"`
+	Command     string `yaml:"command"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// reservedTaskNames are the subcommands of graft task
+var reservedTaskNames = map[string]bool{"ls": true, "history": true, "logs": true}
+
+// DefaultKeepTaskLogs is the number of task run logs kept on the server
+const DefaultKeepTaskLogs = 20
+
+// TaskRun is one run of a task, kept in the task history on the server
+type TaskRun struct {
+	ID         string    `json:"id"`
+	Task       string    `json:"task"`
+	Service    string    `json:"service"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args,omitempty"`
+	User       string    `json:"user"`
+	Host       string    `json:"host"`
+	GitCommit  string    `json:"git_commit,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"` // why the container could not run to completion
+}
+
+// LoadTasks reads the tasks declared in a graft-compose.yml
+func LoadTasks(composePath string) (map[string]Task, error) {
+	data, err := os.ReadFile(composePath)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Services map[string]yaml.Node `yaml:"services"`
+		Tasks    map[string]Task      `yaml:"x-graft-tasks"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", composePath, err)
+	}
+	for name, task := range file.Tasks {
+		if reservedTaskNames[name] {
+			return nil, fmt.Errorf("task '%s' in %s: the name is reserved for 'graft task %s'", name, composePath, name)
+		}
+		if _, ok := file.Services[task.Service]; !ok {
+			return nil, fmt.Errorf("task '%s' in %s: service '%s' does not exist", name, composePath, task.Service)
+		}
+		if strings.TrimSpace(task.Command) == "" {
+			return nil, fmt.Errorf("task '%s' in %s has no command", name, composePath)
+		}
+	}
+	return file.Tasks, nil
+}
+
+// TaskNames returns the names of tasks in sorted order
+func TaskNames(tasks map[string]Task) []string {
+	var names []string
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// taskDir is where the task history and run logs of a project are kept on the server
+func taskDir(remoteDir string) string {
+	return path.Join(remoteDir, ".graft", "tasks")
+}
+
+// taskLogPath is the captured output of a task run
+func taskLogPath(remoteDir, id string) string {
+	return path.Join(taskDir(remoteDir), "run-"+id+".log")
+}
+
+// lockedBuffer collects stdout and stderr of a run, which the session writes concurrently
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+// RunTask runs a task in a fresh container of its service, streaming and capturing its
+// output. Extra args are appended to the task's command. The container's exit code ends up
+// in run, which is then recorded; err is only set when recording failed.
+func RunTask(client *ssh.Client, remoteDir, name string, task Task, args []string, run *TaskRun, stdout, stderr io.Writer) error {
+	command := task.Command
+	for _, arg := range args {
+		command += " " + shell.Quote(arg)
+	}
+	run.ID = timestampID(run.StartedAt) + "-" + name
+	run.Task = name
+	run.Service = task.Service
+	run.Command = task.Command
+	run.Args = args
+
+	// Like pre-deploy hooks, the command runs with sh, bypassing the image's entrypoint
+	var output lockedBuffer
+	cmd := client.Compose(remoteDir, "run", "--rm", "-T", "--entrypoint", "sh", task.Service, "-c", command)
+	err := client.RunCommand(cmd.String(), io.MultiWriter(stdout, &output), io.MultiWriter(stderr, &output))
+	run.DurationMS = time.Since(run.StartedAt).Milliseconds()
+	if status, ok := ssh.ExitStatus(err); ok {
+		run.ExitCode = status
+	} else if err != nil {
+		run.ExitCode = 1
+		var sigErr *ssh.SignalError
+		if errors.As(err, &sigErr) {
+			run.ExitCode = 130
+		}
+		run.Error = err.Error()
+	}
+
+	return saveTaskRun(client, remoteDir, run, output.buf.Bytes())
+}
+
+// saveTaskRun stores the log of a run, appends the run to the task history and removes
+// the logs of runs beyond DefaultKeepTaskLogs (run ids sort by time). It is not bound to
+// the command context, so interrupted runs are recorded too.
+func saveTaskRun(client *ssh.Client, remoteDir string, run *TaskRun, output []byte) error {
+	dir := taskDir(remoteDir)
+	if err := client.RunCommandContext(context.Background(), shell.New("mkdir", "-p", dir).String(), nil, nil); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+
+	tmpFile := filepath.Join(os.TempDir(), "graft_task_"+run.ID+".log")
+	if err := os.WriteFile(tmpFile, output, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+	if err := client.UploadFile(tmpFile, taskLogPath(remoteDir, run.ID)); err != nil {
+		return fmt.Errorf("failed to upload task log: %v", err)
+	}
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	record := shell.New("printf", "%s\\n", string(data)).Append(">> " + shell.Quote(path.Join(dir, "history.jsonl"))).
+		And(shell.New("cd", dir)).
+		And(shell.Raw(fmt.Sprintf("ls -1r run-*.log | tail -n +%d | xargs -r rm -f", DefaultKeepTaskLogs+1)))
+	if err := client.RunCommandContext(context.Background(), record.String(), nil, nil); err != nil {
+		return fmt.Errorf("failed to record task run: %v", err)
+	}
+	return nil
+}
+
+// ListTaskRuns returns the recorded runs of a project's tasks, oldest first; all tasks
+// when task is ""
+func ListTaskRuns(client *ssh.Client, remoteDir, task string) ([]TaskRun, error) {
+	var out bytes.Buffer
+	read := shell.New("cat", path.Join(taskDir(remoteDir), "history.jsonl")).Append("2>/dev/null").Or(shell.New("true"))
+	if err := client.RunCommand(read.String(), &out, nil); err != nil {
+		return nil, fmt.Errorf("failed to read task history: %v", err)
+	}
+
+	var runs []TaskRun
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var run TaskRun
+		if err := json.Unmarshal([]byte(line), &run); err != nil {
+			continue // skip a line cut short by a concurrent write
+		}
+		if task == "" || run.Task == task {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// TaskLog writes the captured output of a task run to w
+func TaskLog(client *ssh.Client, remoteDir, id string, w io.Writer) error {
+	read := shell.New("cat", taskLogPath(remoteDir, id)).Append("2>/dev/null")
+	if err := client.RunCommand(read.String(), w, nil); err != nil {
+		return fmt.Errorf("no log kept for run %s, only the last %d runs keep theirs", id, DefaultKeepTaskLogs)
+	}
+	return nil
+}
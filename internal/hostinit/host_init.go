@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/shell"
 	"github.com/skssmd/graft/internal/ssh"
 )
 
@@ -41,12 +42,7 @@ sudo curl -SL https://github.com/docker/buildx/releases/download/v0.30.1/buildx-
 sudo chmod +x /usr/local/lib/docker/cli-plugins/docker-buildx`
 	}
 
-	steps := []struct {
-		name     string
-		check    string
-		cmd      string
-		skipMsg  string
-	}{
+	installSteps := []setupStep{
 		{
 			name:    "Check Docker",
 			check:   "docker --version",
@@ -59,22 +55,42 @@ sudo chmod +x /usr/local/lib/docker/cli-plugins/docker-buildx`
 			cmd:     composeInstallCmd,
 			skipMsg: "Docker Compose is already installed.",
 		},
+	}
+	if err := runSteps(client, installSteps, stdout, stderr); err != nil {
+		return err
+	}
+
+	// Work out how the deploy user reaches the docker daemon; every later command depends on it
+	mode, err := client.DetectDockerMode()
+	if err != nil {
+		return err
+	}
+	client.SetDockerMode(mode)
+	fmt.Fprintf(stdout, "🐳 Docker access mode: %s\n", mode)
+	if err := client.CheckBaseDir(); err != nil {
+		return err
+	}
+	if mode == config.DockerRootless {
+		fmt.Fprintln(stdout, "⚠️  Rootless Docker needs net.ipv4.ip_unprivileged_port_start=80 for Traefik to bind ports 80 and 443")
+	}
+
+	steps := []setupStep{
 		{
 			name:    "Create Network",
-			check:   "sudo docker network inspect graft-public",
-			cmd:     "sudo docker network create graft-public",
+			check:   client.Docker("network", "inspect", "graft-public").String(),
+			cmd:     client.Docker("network", "create", "graft-public").String(),
 			skipMsg: "Docker network 'graft-public' already exists.",
 		},
 		{
 			name:    "Create Base Dirs",
 			check:   "ls -d /opt/graft/gateway /opt/graft/infra",
-			cmd:     "sudo mkdir -p /opt/graft/gateway /opt/graft/infra && sudo chown $USER:$USER /opt/graft/gateway /opt/graft/infra",
+			cmd:     client.MkdirOwned("/opt/graft/gateway", "/opt/graft/infra").String(),
 			skipMsg: "Base directories already exist.",
 		},
 		{
 			name:    "Setup Traefik",
-			check:   "sudo docker ps | grep graft-traefik",
-			cmd: `sudo tee /opt/graft/gateway/docker-compose.yml <<EOF
+			check:   client.Docker("ps").Pipe(shell.New("grep", "graft-traefik")).String(),
+			cmd: fmt.Sprintf(`%s <<EOF
 version: '3.8'
 services:
   traefik:
@@ -106,7 +122,7 @@ services:
       - "443:443"
       # - "8080:8080"  # Traefik dashboard
     volumes:
-      - "/var/run/docker.sock:/var/run/docker.sock:ro"
+      - "%s:/var/run/docker.sock:ro"
       - "/opt/graft/gateway/letsencrypt:/letsencrypt"
     networks:
       - graft-public
@@ -116,29 +132,19 @@ networks:
   graft-public:
     external: true
 EOF
-sudo mkdir -p /opt/graft/gateway/letsencrypt
-sudo chmod 600 /opt/graft/gateway/letsencrypt
-sudo docker compose -f /opt/graft/gateway/docker-compose.yml up -d`,
+%s
+%s
+%s`,
+				client.Privileged("tee", "/opt/graft/gateway/docker-compose.yml"),
+				client.DockerSocket(),
+				client.Privileged("mkdir", "-p", "/opt/graft/gateway/letsencrypt"),
+				client.Privileged("chmod", "600", "/opt/graft/gateway/letsencrypt"),
+				client.Docker("compose", "-f", "/opt/graft/gateway/docker-compose.yml", "up", "-d")),
 			skipMsg: "Traefik gateway is already running.",
 		},
 	}
-
-	for _, step := range steps {
-		// Check if step is already completed
-		if step.check != "" {
-			err := client.RunCommand(step.check, nil, nil)
-			if err == nil {
-				if step.skipMsg != "" {
-					fmt.Fprintf(stdout, "✅ %s\n", step.skipMsg)
-				}
-				continue
-			}
-		}
-
-		fmt.Fprintf(stdout, "⏩ Running: %s...\n", step.name)
-		if err := client.RunCommand(step.cmd, stdout, stderr); err != nil {
-			return fmt.Errorf("step %s failed: %v", step.name, err)
-		}
+	if err := runSteps(client, steps, stdout, stderr); err != nil {
+		return err
 	}
 
 	// Conditionally setup shared infrastructure
@@ -172,6 +178,35 @@ sudo docker compose -f /opt/graft/gateway/docker-compose.yml up -d`,
 	return nil
 }
 
+// setupStep is a host setup command, skipped when its check command succeeds
+type setupStep struct {
+	name    string
+	check   string
+	cmd     string
+	skipMsg string
+}
+
+func runSteps(client *ssh.Client, steps []setupStep, stdout, stderr io.Writer) error {
+	for _, step := range steps {
+		// Check if step is already completed
+		if step.check != "" {
+			err := client.RunCommand(step.check, nil, nil)
+			if err == nil {
+				if step.skipMsg != "" {
+					fmt.Fprintf(stdout, "✅ %s\n", step.skipMsg)
+				}
+				continue
+			}
+		}
+
+		fmt.Fprintf(stdout, "⏩ Running: %s...\n", step.name)
+		if err := client.RunCommand(step.cmd, stdout, stderr); err != nil {
+			return fmt.Errorf("step %s failed: %v", step.name, err)
+		}
+	}
+	return nil
+}
+
 func SetupInfra(client *ssh.Client, setupPostgres, setupRedis bool, cfg config.InfraConfig, stdout, stderr io.Writer) error {
 	var services string
 	if setupPostgres {
@@ -185,9 +220,9 @@ func SetupInfra(client *ssh.Client, setupPostgres, setupRedis bool, cfg config.I
     container_name: graft-postgres
     image: postgres:18.1-alpine
 %s    environment:
-      POSTGRES_USER: %s
-      POSTGRES_PASSWORD: %s
-      POSTGRES_DB: %s
+      POSTGRES_USER: %q
+      POSTGRES_PASSWORD: %q
+      POSTGRES_DB: %q
     networks:
       - graft-public
 `, ports, cfg.PostgresUser, cfg.PostgresPassword, cfg.PostgresDB)
@@ -207,7 +242,8 @@ func SetupInfra(client *ssh.Client, setupPostgres, setupRedis bool, cfg config.I
 `, ports)
 	}
 
-	infraCmd := fmt.Sprintf(`sudo tee /opt/graft/infra/docker-compose.yml <<EOF
+	// Quoted heredoc delimiter: credentials are written verbatim, never expanded by the remote shell
+	infraCmd := fmt.Sprintf(`%s <<'EOF'
 version: '3.8'
 services:
 %s
@@ -215,7 +251,8 @@ networks:
   graft-public:
     external: true
 EOF
-sudo docker compose -f /opt/graft/infra/docker-compose.yml up -d`, services)
+%s`, client.Privileged("tee", "/opt/graft/infra/docker-compose.yml"), services,
+		client.Docker("compose", "-f", "/opt/graft/infra/docker-compose.yml", "up", "-d"))
 	
 	if err := client.RunCommand(infraCmd, stdout, stderr); err != nil {
 		return fmt.Errorf("shared infrastructure setup failed: %v", err)
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/shell"
 	"github.com/skssmd/graft/internal/ssh"
 )
 
@@ -91,24 +92,37 @@ AWS_SECRET_ACCESS_KEY=%s
 AWS_DEFAULT_REGION=%s
 S3_BUCKET=%s
 S3_ENDPOINT=%s
-`, cfg.Infra.S3.AccessKey, cfg.Infra.S3.SecretKey, cfg.Infra.S3.Region, cfg.Infra.S3.Bucket, cfg.Infra.S3.Endpoint)
+`, shell.Quote(cfg.Infra.S3.AccessKey), shell.Quote(cfg.Infra.S3.SecretKey), shell.Quote(cfg.Infra.S3.Region), shell.Quote(cfg.Infra.S3.Bucket), shell.Quote(cfg.Infra.S3.Endpoint))
 
 	tmpEnv := filepath.Join(os.TempDir(), ".backup.env")
 	os.WriteFile(tmpEnv, []byte(envContent), 0600)
 	defer os.Remove(tmpEnv)
 
 	// 2. Create backup.sh
-	backupScript := `#!/bin/bash
+	pgUser := cfg.Infra.PostgresUser
+	if pgUser == "" {
+		pgUser = "graft"
+	}
+	// Docker is invoked the way this server allows (sudo, docker group or rootless)
+	dumpCmd := client.Docker("exec", "graft-postgres", "pg_dumpall", "-U", pgUser).
+		Pipe(shell.New("gzip")).
+		Append("> /tmp/${FILENAME}")
+	uploadCmd := client.Docker("run", "--rm", "-v", "/tmp:/tmp").
+		Append("-e AWS_ACCESS_KEY_ID=$AWS_ACCESS_KEY_ID -e AWS_SECRET_ACCESS_KEY=$AWS_SECRET_ACCESS_KEY -e AWS_DEFAULT_REGION=$AWS_DEFAULT_REGION").
+		Arg("amazon/aws-cli").
+		Append("$ENDPOINT_FLAG s3 cp /tmp/${FILENAME} s3://${S3_BUCKET}/backups/${FILENAME}")
+
+	backupScript := fmt.Sprintf(`#!/bin/bash
 set -e
 
 # Load environment variables
 source /opt/graft/infra/.backup.env
 
-TIMESTAMP=$(date +"%Y%m%d_%H%M%S")
+TIMESTAMP=$(date +"%%Y%%m%%d_%%H%%M%%S")
 FILENAME="db_backup_${TIMESTAMP}.sql.gz"
 
 echo "🐘 Dumping Postgres database..."
-sudo docker exec graft-postgres pg_dumpall -U ${POSTGRES_USER:-graft} | gzip > /tmp/${FILENAME}
+%s
 
 echo "📤 Uploading to S3..."
 ENDPOINT_FLAG=""
@@ -116,19 +130,13 @@ if [ ! -z "$S3_ENDPOINT" ]; then
     ENDPOINT_FLAG="--endpoint-url $S3_ENDPOINT"
 fi
 
-sudo docker run --rm -v /tmp:/tmp -e AWS_ACCESS_KEY_ID=$AWS_ACCESS_KEY_ID -e AWS_SECRET_ACCESS_KEY=$AWS_SECRET_ACCESS_KEY -e AWS_DEFAULT_REGION=$AWS_DEFAULT_REGION amazon/aws-cli $ENDPOINT_FLAG s3 cp /tmp/${FILENAME} s3://${S3_BUCKET}/backups/${FILENAME}
+%s
 
 echo "🧹 Cleaning up..."
 rm /tmp/${FILENAME}
 
 echo "✅ Backup complete: ${FILENAME}"
-`
-	// We need to inject POSTGRES_USER if it's not the default 'graft'
-	pgUser := cfg.Infra.PostgresUser
-	if pgUser == "" {
-		pgUser = "graft"
-	}
-	backupScript = strings.Replace(backupScript, "${POSTGRES_USER:-graft}", pgUser, 1)
+`, dumpCmd, uploadCmd)
 
 	tmpScript := filepath.Join(os.TempDir(), "backup.sh")
 	os.WriteFile(tmpScript, []byte(backupScript), 0755)
@@ -157,8 +165,8 @@ echo "✅ Backup complete: ${FILENAME}"
 		checkCmd := "crontab -l | grep -q '/opt/graft/infra/backup.sh'"
 		if err := client.RunCommand(checkCmd, nil, nil); err != nil {
 			// Doesn't exist, add it
-			addCronCmd := fmt.Sprintf("(crontab -l 2>/dev/null; echo \"%s\") | crontab -", cronJob)
-			if err := client.RunCommand(addCronCmd, stdout, stderr); err != nil {
+			addCronCmd := shell.Raw("(crontab -l 2>/dev/null; echo " + shell.Quote(cronJob) + ")").Pipe(shell.New("crontab", "-"))
+			if err := client.RunCommand(addCronCmd.String(), stdout, stderr); err != nil {
 				return fmt.Errorf("failed to setup cron job: %v", err)
 			}
 			fmt.Fprintln(stdout, "✅ Cron job added (daily at 2 AM)")
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/skssmd/graft/internal/config"
 	"github.com/skssmd/graft/internal/ssh"
@@ -15,34 +16,17 @@ import (
 func InitPostgres(client *ssh.Client, name string, cfg *config.GraftConfig, stdout, stderr io.Writer) (string, error) {
 	fmt.Fprintf(stdout, "🐘 Creating isolated Postgres database: %s\n", name)
 
+	if err := loadPostgresCredentials(client, cfg, stdout); err != nil {
+		return "", err
+	}
 	pgUser := cfg.Infra.PostgresUser
 	pgPass := cfg.Infra.PostgresPassword
 	pgDB := cfg.Infra.PostgresDB
-
-	// If credentials missing, try to load from remote server
-	if pgPass == "" {
-		fmt.Fprintln(stdout, "🔍 Credentials missing locally, fetching from remote server...")
-		tmpFile := filepath.Join(os.TempDir(), "remote_infra.config")
-		if err := client.DownloadFile(config.RemoteInfraPath, tmpFile); err == nil {
-			data, _ := os.ReadFile(tmpFile)
-			var infraCfg config.InfraConfig
-			if err := json.Unmarshal(data, &infraCfg); err == nil {
-				cfg.Infra.PostgresUser = infraCfg.PostgresUser
-				cfg.Infra.PostgresPassword = infraCfg.PostgresPassword
-				cfg.Infra.PostgresDB = infraCfg.PostgresDB
-				pgUser = cfg.Infra.PostgresUser
-				pgPass = cfg.Infra.PostgresPassword
-				pgDB = cfg.Infra.PostgresDB
-				fmt.Fprintln(stdout, "✅ Credentials fetched from remote server")
-			}
-			os.Remove(tmpFile)
-		} else {
-			return "", fmt.Errorf("could not find infrastructure credentials locally or on the remote server. Run 'graft host init' first.")
-		}
-	}
 	
 	// Connect to the shared 'graft-postgres' container and create the database
-	cmd := fmt.Sprintf(`sudo docker exec graft-postgres psql -U %s -d %s -c "CREATE DATABASE %s;"`, pgUser, pgDB, name)
+	// The database name is a double-quoted SQL identifier, the whole statement a single shell argument
+	createSQL := fmt.Sprintf(`CREATE DATABASE "%s";`, strings.ReplaceAll(name, `"`, `""`))
+	cmd := client.Docker("exec", "graft-postgres", "psql", "-U", pgUser, "-d", pgDB, "-c", createSQL).String()
 
 	if err := client.RunCommand(cmd, stdout, stderr); err != nil {
 		// If it fails, maybe the DB already exists, which is fine for idempotency
@@ -54,6 +38,47 @@ func InitPostgres(client *ssh.Client, name string, cfg *config.GraftConfig, stdo
 	return url, nil
 }
 
+// DropPostgres removes a database created with InitPostgres, closing its open connections
+func DropPostgres(client *ssh.Client, name string, cfg *config.GraftConfig, stdout, stderr io.Writer) error {
+	fmt.Fprintf(stdout, "🐘 Dropping Postgres database: %s\n", name)
+
+	if err := loadPostgresCredentials(client, cfg, stdout); err != nil {
+		return err
+	}
+
+	dropSQL := fmt.Sprintf(`DROP DATABASE IF EXISTS "%s" WITH (FORCE);`, strings.ReplaceAll(name, `"`, `""`))
+	cmd := client.Docker("exec", "graft-postgres", "psql", "-U", cfg.Infra.PostgresUser, "-d", cfg.Infra.PostgresDB, "-c", dropSQL).String()
+	if err := client.RunCommand(cmd, stdout, stderr); err != nil {
+		return fmt.Errorf("failed to drop database %s: %v", name, err)
+	}
+	return nil
+}
+
+// loadPostgresCredentials fills in the shared Postgres credentials from the server's infra
+// config when they are missing locally
+func loadPostgresCredentials(client *ssh.Client, cfg *config.GraftConfig, stdout io.Writer) error {
+	if cfg.Infra.PostgresPassword != "" {
+		return nil
+	}
+
+	fmt.Fprintln(stdout, "🔍 Credentials missing locally, fetching from remote server...")
+	tmpFile := filepath.Join(os.TempDir(), "remote_infra.config")
+	if err := client.DownloadFile(config.RemoteInfraPath, tmpFile); err != nil {
+		return fmt.Errorf("could not find infrastructure credentials locally or on the remote server. Run 'graft host init' first.")
+	}
+	defer os.Remove(tmpFile)
+
+	data, _ := os.ReadFile(tmpFile)
+	var infraCfg config.InfraConfig
+	if err := json.Unmarshal(data, &infraCfg); err == nil {
+		cfg.Infra.PostgresUser = infraCfg.PostgresUser
+		cfg.Infra.PostgresPassword = infraCfg.PostgresPassword
+		cfg.Infra.PostgresDB = infraCfg.PostgresDB
+		fmt.Fprintln(stdout, "✅ Credentials fetched from remote server")
+	}
+	return nil
+}
+
 func InitRedis(client *ssh.Client, name string, stdout, stderr io.Writer) (string, error) {
 	fmt.Fprintf(stdout, "🍦 Mapping Redis database for: %s\n", name)
 	
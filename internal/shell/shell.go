@@ -0,0 +1,102 @@
+// Package shell builds POSIX shell command lines for remote execution.
+// Every argument is quoted, so names, paths and user-supplied arguments reach the
+// remote program unchanged and cannot inject additional shell syntax.
+package shell
+
+import "strings"
+
+// Quote returns s quoted for a POSIX shell. Strings made only of safe characters
+// are returned unchanged to keep commands readable.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if isSafe(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func isSafe(s string) bool {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("_-+=@%:,./", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Join quotes every argument and joins them into a single command line
+func Join(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Command is a shell command line assembled from quoted commands and operators
+type Command struct {
+	line string
+}
+
+// New returns a simple command with every argument quoted
+func New(args ...string) Command {
+	return Command{line: Join(args...)}
+}
+
+// Raw wraps a fixed command line that needs shell syntax (variables, redirects, pipes).
+// Never pass untrusted input to Raw.
+func Raw(line string) Command {
+	return Command{line: line}
+}
+
+// Cd returns a command changing into dir
+func Cd(dir string) Command {
+	return New("cd", dir)
+}
+
+// Arg appends quoted arguments to the last command
+func (c Command) Arg(args ...string) Command {
+	return Command{line: c.line + " " + Join(args...)}
+}
+
+// And runs next only if c succeeds (c && next)
+func (c Command) And(next Command) Command {
+	return c.join("&&", next)
+}
+
+// Or runs next only if c fails (c || next)
+func (c Command) Or(next Command) Command {
+	return c.join("||", next)
+}
+
+// Then runs next after c regardless of its result (c; next)
+func (c Command) Then(next Command) Command {
+	return Command{line: c.line + "; " + next.line}
+}
+
+// Pipe feeds the output of c into next (c | next)
+func (c Command) Pipe(next Command) Command {
+	return c.join("|", next)
+}
+
+// Append adds a fixed fragment such as a redirect ("2>/dev/null") to the command line
+func (c Command) Append(fragment string) Command {
+	return Command{line: c.line + " " + fragment}
+}
+
+func (c Command) join(op string, next Command) Command {
+	if c.line == "" {
+		return next
+	}
+	return Command{line: c.line + " " + op + " " + next.line}
+}
+
+// String returns the command line
+func (c Command) String() string {
+	return c.line
+}
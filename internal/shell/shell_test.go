@@ -0,0 +1,56 @@
+package shell
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "''"},
+		{in: "plain", want: "plain"},
+		{in: "/opt/graft/projects/my-app_1", want: "/opt/graft/projects/my-app_1"},
+		{in: "KEY=value,user@host:22%+", want: "KEY=value,user@host:22%+"},
+		{in: "two words", want: "'two words'"},
+		{in: "it's", want: `'it'"'"'s'`},
+		{in: "'", want: `''"'"''`},
+		{in: "$HOME", want: "'$HOME'"},
+		{in: "a;rm -rf /", want: "'a;rm -rf /'"},
+		{in: "`id`", want: "'`id`'"},
+		{in: "$(id)", want: "'$(id)'"},
+		{in: "line\nbreak", want: "'line\nbreak'"},
+		{in: "*.log", want: "'*.log'"},
+		{in: "~/x", want: "'~/x'"},
+		{in: "back\\slash", want: "'back\\slash'"},
+		{in: "naïve", want: "'naïve'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := Quote(tt.in); got != tt.want {
+				t.Errorf("Quote(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestQuoteRoundTrip checks that sh receives every quoted argument unchanged
+func TestQuoteRoundTrip(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run commands with")
+	}
+
+	for _, arg := range []string{"", "plain", "two words", "it's", "''", `"double"`, "$HOME", "a;b|c&d", "`id`", "$(id)", "line\nbreak", "*", "~", "back\\slash", "-n"} {
+		out, err := exec.Command(sh, "-c", "printf '%s' "+Quote(arg)).Output()
+		if err != nil {
+			t.Fatalf("sh failed for %q: %v", arg, err)
+		}
+		if string(out) != arg {
+			t.Errorf("sh received %q for %q", out, arg)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/skssmd/graft/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// askpassSocketEnv tells graft, re-executed as SSH_ASKPASS, where to ask for a password.
+// The password itself never appears in an environment, which other processes of the user
+// can read from /proc/<pid>/environ.
+const askpassSocketEnv = "GRAFT_ASKPASS_SOCKET"
+
+// askpassHost finds the user@host a password prompt of ssh is for, in both
+// "user@host's password: " and "(user@host) Password: "
+var askpassHost = regexp.MustCompile(`([^\s@'()]+@[^\s'()]+)(?:'s password|\))`)
+
+// credentials remembers how a client authenticated so external ssh commands
+// (rsync, interactive sessions) can reuse the same credentials without prompting again.
+type credentials struct {
+	method   string
+	keyPath  string
+	user     string
+	host     string
+	rawKey   interface{} // decrypted key, only set for passphrase-protected key files
+	password string
+
+	agentConn net.Conn // connection to ssh-agent, closed with the client
+}
+
+// close releases what the credentials hold open
+func (c *credentials) close() {
+	if c != nil && c.agentConn != nil {
+		c.agentConn.Close()
+	}
+}
+
+// expandHome expands a leading tilde (~) in a path
+func expandHome(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, p[2:])
+		}
+	} else if p == "~" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home
+		}
+	}
+	return p
+}
+
+// authMethods builds the ssh auth methods for the configured authentication method
+func authMethods(srv config.ServerConfig) ([]ssh.AuthMethod, *credentials, error) {
+	creds := &credentials{method: srv.AuthMethod, keyPath: expandHome(srv.KeyPath), user: srv.User, host: srv.Host}
+	if creds.method == "" {
+		creds.method = config.AuthKey
+	}
+
+	switch creds.method {
+	case config.AuthAgent:
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, nil, fmt.Errorf("ssh-agent auth selected but SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to reach ssh-agent: %v", err)
+		}
+		creds.agentConn = conn
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, creds, nil
+
+	case config.AuthPassword:
+		password := func() (string, error) {
+			if creds.password == "" {
+				pw, err := promptSecret(fmt.Sprintf("🔑 Password for %s@%s: ", srv.User, srv.Host))
+				if err != nil {
+					return "", err
+				}
+				creds.password = pw
+			}
+			return creds.password, nil
+		}
+		challenge := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i, q := range questions {
+				// A single hidden question is the password prompt
+				if len(questions) == 1 && !echos[i] {
+					pw, err := password()
+					if err != nil {
+						return nil, err
+					}
+					answers[i] = pw
+					continue
+				}
+				if echos[i] {
+					fmt.Print(q)
+					answers[i] = readLine()
+				} else {
+					a, err := promptSecret(q)
+					if err != nil {
+						return nil, err
+					}
+					answers[i] = a
+				}
+			}
+			return answers, nil
+		}
+		return []ssh.AuthMethod{
+			ssh.KeyboardInteractive(challenge),
+			ssh.PasswordCallback(password),
+		}, creds, nil
+
+	case config.AuthKey:
+		key, err := os.ReadFile(creds.keyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read private key: %v", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			passphrase, perr := promptSecret(fmt.Sprintf("🔑 Passphrase for %s: ", creds.keyPath))
+			if perr != nil {
+				return nil, nil, perr
+			}
+			raw, perr := ssh.ParseRawPrivateKeyWithPassphrase(key, []byte(passphrase))
+			if perr != nil {
+				return nil, nil, fmt.Errorf("unable to decrypt private key: %v", perr)
+			}
+			creds.rawKey = raw
+			signer, err = ssh.NewSignerFromKey(raw)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse private key: %v", err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, creds, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown auth method: %s", creds.method)
+}
+
+// promptSecret reads a secret from the terminal without echoing it.
+// The value never appears on the command line, so it stays out of shell history.
+func promptSecret(label string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("cannot prompt for credentials: stdin is not a terminal")
+	}
+	fmt.Print(label)
+	secret, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read input: %v", err)
+	}
+	return string(secret), nil
+}
+
+// externalAuth returns the ssh arguments and environment an external ssh process
+// needs to authenticate with the same credentials as this client.
+// agentSocket is called when a decrypted key has to be served through a local agent,
+// askpassEnv when ssh has to ask graft for a password.
+func (c *credentials) externalAuth(agentSocket func() (string, error), askpassEnv func() ([]string, error)) ([]string, []string, error) {
+	switch c.method {
+	case config.AuthAgent:
+		// The child inherits SSH_AUTH_SOCK from our environment
+		return nil, nil, nil
+
+	case config.AuthPassword:
+		env, err := askpassEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		args := []string{"-o", "PreferredAuthentications=keyboard-interactive,password", "-o", "PubkeyAuthentication=no"}
+		return args, env, nil
+	}
+
+	args := []string{"-i", c.keyPath}
+	if c.rawKey == nil {
+		return args, nil, nil
+	}
+
+	// Passphrase-protected key: serve the decrypted key from a private in-process agent
+	sock, err := agentSocket()
+	if err != nil {
+		return nil, nil, err
+	}
+	return args, []string{"SSH_AUTH_SOCK=" + sock}, nil
+}
+
+// localAgent serves decrypted private keys to external ssh processes on a temporary unix socket
+type localAgent struct {
+	dir      string
+	sock     string
+	listener net.Listener
+}
+
+// startLocalAgent starts an in-process ssh-agent holding the given raw private keys
+func startLocalAgent(keys []interface{}) (*localAgent, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("passphrase-protected keys are not supported for external ssh on Windows; load the key into ssh-agent and use agent auth")
+	}
+
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "graft"}); err != nil {
+			return nil, fmt.Errorf("unable to load key into local ssh-agent: %v", err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "graft-agent-*")
+	if err != nil {
+		return nil, err
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to start local ssh-agent: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return &localAgent{dir: dir, sock: sock, listener: listener}, nil
+}
+
+// close stops the agent and removes its socket
+func (a *localAgent) close() {
+	a.listener.Close()
+	os.RemoveAll(a.dir)
+}
+
+// askpassServer hands passwords to graft processes started by ssh as askpass helper, over a
+// unix socket in a private directory. An inherited pipe would not do: ssh closes every
+// descriptor beyond stderr before it runs the helper.
+type askpassServer struct {
+	dir      string
+	sock     string
+	listener net.Listener
+}
+
+// startAskpassServer answers each prompt with the password of the user@host it names.
+// passwords is keyed by user@host.
+func startAskpassServer(passwords map[string]string) (*askpassServer, error) {
+	dir, err := os.MkdirTemp("", "graft-askpass-*")
+	if err != nil {
+		return nil, err
+	}
+	sock := filepath.Join(dir, "askpass.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to start askpass helper: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				prompt, _ := bufio.NewReader(conn).ReadString('\n')
+				if password, ok := askpassAnswer(passwords, prompt); ok {
+					fmt.Fprintln(conn, password)
+				}
+			}()
+		}
+	}()
+
+	return &askpassServer{dir: dir, sock: sock, listener: listener}, nil
+}
+
+// askpassAnswer picks the password for a prompt. A password prompt naming no host (older
+// ssh versions) is only answered when there is a single password to give.
+func askpassAnswer(passwords map[string]string, prompt string) (string, bool) {
+	if m := askpassHost.FindStringSubmatch(prompt); m != nil {
+		password, ok := passwords[m[1]]
+		return password, ok
+	}
+	if len(passwords) == 1 && strings.Contains(strings.ToLower(prompt), "password") {
+		for _, password := range passwords {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+// close stops the helper and removes its socket
+func (a *askpassServer) close() {
+	a.listener.Close()
+	os.RemoveAll(a.dir)
+}
+
+// ServeAskpass answers an SSH_ASKPASS request when graft was started by ssh as its
+// askpass helper. It returns true if the process should exit afterwards.
+func ServeAskpass() bool {
+	sock, ok := os.LookupEnv(askpassSocketEnv)
+	if !ok || os.Getenv("SSH_ASKPASS_REQUIRE") != "force" {
+		return false
+	}
+	prompt := ""
+	if len(os.Args) > 1 {
+		prompt = os.Args[1]
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		os.Exit(1)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, strings.ReplaceAll(prompt, "\n", " "))
+	password, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		// No password for this prompt: a failing helper makes ssh give up on it
+		os.Exit(1)
+	}
+	fmt.Print(password)
+	return true
+}
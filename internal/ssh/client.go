@@ -1,7 +1,7 @@
 package ssh
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -9,9 +9,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/sftp"
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/shell"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
@@ -23,82 +27,174 @@ type Client struct {
 	port    int
 	user    string
 	keyPath string
+	creds   *credentials
+
+	// Jump hosts the connection passes through, outermost first
+	jumpHosts  []config.ServerConfig
+	jumpCreds  []*credentials
+	jumps      []*ssh.Client
+	agent      *localAgent
+	askpass    *askpassServer
+	sshConfig  string
+
+	// Remote execution: commands are cancelled with ctx and limited by timeout (0 = none)
+	ctx     context.Context
+	timeout time.Duration
+	done    chan struct{}
+	lost    atomic.Bool
+
+	closeOnce sync.Once
+
+	// How docker is invoked on the server (config.DockerSudo when empty). Parallel deploys
+	// share the client, dockerMu guards both fields.
+	dockerMu     sync.Mutex
+	dockerMode   string
+	dockerSocket string
 }
 
-func NewClient(host string, port int, user, keyPath string) (*Client, error) {
-	// Expand tilde (~) if present in keyPath
-	actualKeyPath := keyPath
-	if strings.HasPrefix(keyPath, "~/") {
-		home, err := os.UserHomeDir()
-		if err == nil {
-			actualKeyPath = filepath.Join(home, keyPath[2:])
-		}
-	} else if keyPath == "~" {
-		home, err := os.UserHomeDir()
-		if err == nil {
-			actualKeyPath = home
-		}
-	}
+func NewClient(srv config.ServerConfig) (*Client, error) {
+	return newClient(srv, false)
+}
 
-	key, err := os.ReadFile(actualKeyPath)
+// RepinHost connects to srv and replaces the host key pinned for it with the one the
+// server presents now, once the user confirmed its fingerprint. Until then the old pin
+// stays in place, so a failed or declined attempt leaves the host as trusted as before.
+func RepinHost(srv config.ServerConfig) error {
+	c, err := newClient(srv, true)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read private key: %v", err)
+		return err
 	}
+	c.Close()
+	return nil
+}
 
-	signer, err := ssh.ParsePrivateKey(key)
+// newClient connects to srv. With repin the target's new host key replaces the pinned one
+// after confirmation; jump hosts are always verified against their pinned keys.
+func newClient(srv config.ServerConfig, repin bool) (*Client, error) {
+	srv, err := ResolveServer(srv)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse private key: %v", err)
+		return nil, err
 	}
 
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+	c := &Client{
+		host: srv.Host,
+		port: srv.Port,
+		user: srv.User,
+		ctx:  context.Background(),
+		done: make(chan struct{}),
+
+		dockerMode: srv.DockerMode,
+	}
+	if srv.CommandTimeout != "" {
+		timeout, err := time.ParseDuration(srv.CommandTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command_timeout %q: %v", srv.CommandTimeout, err)
+		}
+		c.timeout = timeout
+	}
+
+	// Dial through each jump host in order, then the target itself
+	var conn *ssh.Client
+	for _, jump := range srv.JumpHosts {
+		hop := jump.Server(srv)
+		next, creds, err := dialHop(conn, hop, false)
+		if err != nil {
+			c.closeJumps()
+			return nil, fmt.Errorf("jump host %s: %v", hop.Host, err)
+		}
+		c.jumps = append(c.jumps, next)
+		c.jumpHosts = append(c.jumpHosts, hop)
+		c.jumpCreds = append(c.jumpCreds, creds)
+		conn = next
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	client, err := ssh.Dial("tcp", addr, config)
+	client, creds, err := dialHop(conn, srv, repin)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect: %v", err)
+		c.closeJumps()
+		return nil, err
 	}
 
 	sftpClient, err := sftp.NewClient(client)
 	if err != nil {
 		client.Close()
+		creds.close()
+		c.closeJumps()
 		return nil, fmt.Errorf("unable to start sftp: %v", err)
 	}
 
-	return &Client{
-		client:  client,
-		sftp:    sftpClient,
-		host:    host,
-		port:    port,
-		user:    user,
-		keyPath: actualKeyPath,
-	}, nil
+	c.client = client
+	c.sftp = sftpClient
+	c.keyPath = creds.keyPath
+	c.creds = creds
+
+	go c.keepalive(keepaliveInterval, keepaliveMaxMissed)
+	return c, nil
 }
 
-func (c *Client) RunCommand(cmd string, stdout, stderr io.Writer) error {
-	session, err := c.client.NewSession()
+// dialHop opens an SSH connection to srv, directly or through the previous hop
+func dialHop(via *ssh.Client, srv config.ServerConfig, repin bool) (*ssh.Client, *credentials, error) {
+	auth, creds, err := authMethods(srv)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer session.Close()
 
-	session.Stdout = stdout
-	session.Stderr = stderr
-	return session.Run(cmd)
+	clientConfig := &ssh.ClientConfig{
+		User:            srv.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback(),
+		Timeout:         10 * time.Second,
+	}
+
+	addr := fmt.Sprintf("%s:%d", srv.Host, srv.Port)
+	if repin {
+		// Any key type is accepted, the server may have been rebuilt with different keys
+		clientConfig.HostKeyCallback = repinHostKeyCallback()
+	} else {
+		clientConfig.HostKeyAlgorithms = knownHostKeyAlgorithms(addr)
+	}
+
+	if via == nil {
+		client, err := ssh.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			creds.close()
+			return nil, nil, fmt.Errorf("unable to connect: %v", err)
+		}
+		return client, creds, nil
+	}
+
+	// Nested dial: tunnel a TCP connection through the previous hop
+	netConn, err := via.Dial("tcp", addr)
+	if err != nil {
+		creds.close()
+		return nil, nil, fmt.Errorf("unable to reach %s through jump host: %v", addr, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, clientConfig)
+	if err != nil {
+		netConn.Close()
+		creds.close()
+		return nil, nil, fmt.Errorf("unable to connect: %v", err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), creds, nil
 }
 
-func (c *Client) InteractiveSession() error {
-	// Verify key exists
-	if _, err := os.Stat(c.keyPath); err != nil {
-		return fmt.Errorf("ssh key not found: %s", c.keyPath)
+// closeJumps closes the jump host connections, innermost first
+func (c *Client) closeJumps() {
+	for i := len(c.jumps) - 1; i >= 0; i-- {
+		c.jumps[i].Close()
 	}
+	c.jumps = nil
+	for _, creds := range c.jumpCreds {
+		creds.close()
+	}
+	c.jumpCreds = nil
+}
+
+// RunCommand runs cmd on the server using the client's context and command timeout
+func (c *Client) RunCommand(cmd string, stdout, stderr io.Writer) error {
+	return c.RunCommandContext(c.ctx, cmd, stdout, stderr)
+}
 
+func (c *Client) InteractiveSession() error {
 	// Find best ssh command
 	sshCmd, isWSL := findSSH()
 
@@ -109,25 +205,30 @@ func (c *Client) InteractiveSession() error {
 		return c.SimulatedSession()
 	}
 
+	// WSL ssh cannot reach our local agent or generated config, so hop through the Go client
+	if isWSL && len(c.jumpHosts) > 0 {
+		fmt.Println("⚠️  Jump hosts are not supported by WSL ssh. Using simulated terminal (fallback).")
+		return c.SimulatedSession()
+	}
+
+	pathStyle := ""
+	if isWSL {
+		pathStyle = "wsl"
+	}
+	sshArgs, env, err := c.externalSSHArgs(pathStyle)
+	if err != nil {
+		return err
+	}
+
 	args := []string{}
 	if isWSL {
-		wslKeyPath := "~/.ssh/graft_key.pem"
-		windowsKeyWSL := convertToUnixPath(c.keyPath, true)
-		
-		// Copy key to WSL filesystem and set proper permissions
-		copyCmd := exec.Command("wsl", "bash", "-c", 
-			fmt.Sprintf("mkdir -p ~/.ssh && cp '%s' %s && chmod 600 %s", 
-				windowsKeyWSL, wslKeyPath, wslKeyPath))
-		if err := copyCmd.Run(); err != nil {
-			return fmt.Errorf("failed to copy SSH key to WSL: %v", err)
-		}
-		
-		args = []string{"ssh", "-i", wslKeyPath, "-p", fmt.Sprintf("%d", c.port), "-o", "StrictHostKeyChecking=no", fmt.Sprintf("%s@%s", c.user, c.host)}
-	} else {
-		args = []string{"-i", c.keyPath, "-p", fmt.Sprintf("%d", c.port), "-o", "StrictHostKeyChecking=no", fmt.Sprintf("%s@%s", c.user, c.host)}
+		args = append(args, "ssh")
 	}
+	args = append(args, sshArgs...)
+	args = append(args, fmt.Sprintf("%s@%s", c.user, c.host))
 
 	cmd := exec.Command(sshCmd, args...)
+	cmd.Env = append(os.Environ(), env...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -135,6 +236,202 @@ func (c *Client) InteractiveSession() error {
 	return cmd.Run()
 }
 
+// externalSSHArgs returns the options (everything but the destination) and extra environment
+// an external ssh process needs to connect like this client does.
+// pathStyle is "" for native paths or "wsl" when the ssh binary runs inside WSL.
+func (c *Client) externalSSHArgs(pathStyle string) ([]string, []string, error) {
+	knownHostsPath, err := ensureKnownHostsFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open known_hosts: %v", err)
+	}
+
+	if c.creds.method == config.AuthKey {
+		// Verify key exists
+		if _, err := os.Stat(c.keyPath); err != nil {
+			return nil, nil, fmt.Errorf("ssh key not found: %s", c.keyPath)
+		}
+	}
+
+	authArgs, env, err := c.creds.externalAuth(c.agentSocket, c.askpassEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pathStyle == "wsl" {
+		// WSL does not see our environment, so only key files can be handed over
+		if c.creds.method != config.AuthKey {
+			return nil, nil, fmt.Errorf("%s auth is not supported through WSL ssh, use key auth", c.creds.method)
+		}
+		if len(c.jumpHosts) > 0 {
+			return nil, nil, fmt.Errorf("jump hosts are not supported through WSL ssh")
+		}
+
+		// For WSL, copy SSH key to WSL filesystem to fix permissions issue
+		// Windows filesystem doesn't support Unix permissions properly
+		wslKeyPath := "~/.ssh/graft_key.pem"
+		windowsKeyWSL := convertToUnixPath(c.keyPath, true)
+
+		// Copy key to WSL filesystem and set proper permissions
+		copyCmd := exec.Command("wsl", "bash", "-c",
+			fmt.Sprintf("mkdir -p ~/.ssh && cp %s %s && chmod 600 %s",
+				shell.Quote(windowsKeyWSL), wslKeyPath, wslKeyPath))
+		if err := copyCmd.Run(); err != nil {
+			return nil, nil, fmt.Errorf("failed to copy SSH key to WSL: %v", err)
+		}
+
+		authArgs = []string{"-i", wslKeyPath}
+		env = nil
+		knownHostsPath = convertToUnixPath(knownHostsPath, true)
+	}
+
+	args := append(authArgs, "-p", fmt.Sprintf("%d", c.port))
+	args = append(args, hostKeyOptions(knownHostsPath)...)
+
+	if len(c.jumpHosts) > 0 {
+		jumpArgs, jumpEnv, err := c.jumpSSHArgs(knownHostsPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, jumpArgs...)
+		env = mergeEnv(env, jumpEnv)
+	}
+	return args, env, nil
+}
+
+// jumpSSHArgs returns the -F/-J options that route an external ssh through the jump hosts.
+// Options given on the command line only apply to the destination, so the jump hosts get
+// their identity and known_hosts settings from a generated ssh config passed with -F
+// (ssh hands -F down to the ProxyJump connections).
+func (c *Client) jumpSSHArgs(knownHostsPath string) ([]string, []string, error) {
+	var jumps []string
+	var cfg strings.Builder
+	var env []string
+
+	for i, hop := range c.jumpHosts {
+		alias := fmt.Sprintf("graft-jump-%d", i)
+		jumps = append(jumps, alias)
+
+		cfg.WriteString(fmt.Sprintf("Host %s\n", alias))
+		cfg.WriteString(fmt.Sprintf("  HostName %s\n", hop.Host))
+		cfg.WriteString(fmt.Sprintf("  Port %d\n", hop.Port))
+		cfg.WriteString(fmt.Sprintf("  User %s\n", hop.User))
+
+		creds := c.jumpCreds[i]
+		switch creds.method {
+		case config.AuthKey:
+			cfg.WriteString(fmt.Sprintf("  IdentityFile \"%s\"\n", creds.keyPath))
+			cfg.WriteString("  IdentitiesOnly yes\n")
+			if creds.rawKey != nil {
+				sock, err := c.agentSocket()
+				if err != nil {
+					return nil, nil, err
+				}
+				env = mergeEnv(env, []string{"SSH_AUTH_SOCK=" + sock})
+			}
+		case config.AuthPassword:
+			cfg.WriteString("  PreferredAuthentications keyboard-interactive,password\n")
+			askpassEnv, err := c.askpassEnv()
+			if err != nil {
+				return nil, nil, err
+			}
+			env = mergeEnv(env, askpassEnv)
+		}
+	}
+	cfg.WriteString("Host *\n")
+	cfg.WriteString("  StrictHostKeyChecking yes\n")
+	cfg.WriteString(fmt.Sprintf("  UserKnownHostsFile \"%s\"\n", knownHostsPath))
+
+	if c.sshConfig == "" {
+		f, err := os.CreateTemp("", "graft-ssh-config-*")
+		if err != nil {
+			return nil, nil, err
+		}
+		f.Close()
+		c.sshConfig = f.Name()
+	}
+	if err := os.WriteFile(c.sshConfig, []byte(cfg.String()), 0600); err != nil {
+		return nil, nil, err
+	}
+
+	return []string{"-F", c.sshConfig, "-J", strings.Join(jumps, ",")}, env, nil
+}
+
+// agentSocket returns the socket of the client's local agent, starting it on first use.
+// It holds every decrypted key used by this connection, including jump hosts.
+func (c *Client) agentSocket() (string, error) {
+	if c.agent != nil {
+		return c.agent.sock, nil
+	}
+
+	var keys []interface{}
+	for _, creds := range append([]*credentials{c.creds}, c.jumpCreds...) {
+		if creds.rawKey != nil {
+			keys = append(keys, creds.rawKey)
+		}
+	}
+
+	a, err := startLocalAgent(keys)
+	if err != nil {
+		return "", err
+	}
+	c.agent = a
+	return a.sock, nil
+}
+
+// askpassEnv returns the environment that makes ssh ask graft for passwords, starting the
+// client's askpass helper on first use. It answers for the target and every jump host
+// that uses password auth, jump hosts under both their alias and their host name.
+func (c *Client) askpassEnv() ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.askpass == nil {
+		passwords := map[string]string{}
+		if c.creds.method == config.AuthPassword {
+			passwords[c.creds.user+"@"+c.creds.host] = c.creds.password
+		}
+		for i, creds := range c.jumpCreds {
+			if creds.method == config.AuthPassword {
+				passwords[creds.user+"@"+creds.host] = creds.password
+				passwords[fmt.Sprintf("%s@graft-jump-%d", creds.user, i)] = creds.password
+			}
+		}
+
+		a, err := startAskpassServer(passwords)
+		if err != nil {
+			return nil, err
+		}
+		c.askpass = a
+	}
+
+	return []string{
+		"SSH_ASKPASS=" + exe,
+		"SSH_ASKPASS_REQUIRE=force",
+		"DISPLAY=graft:0",
+		askpassSocketEnv + "=" + c.askpass.sock,
+	}, nil
+}
+
+// mergeEnv appends extra environment entries, replacing keys already present
+func mergeEnv(env, extra []string) []string {
+	for _, e := range extra {
+		key := strings.SplitN(e, "=", 2)[0] + "="
+		replaced := false
+		for i := range env {
+			if strings.HasPrefix(env[i], key) {
+				env[i] = e
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
 func (c *Client) SimulatedSession() error {
 	session, err := c.client.NewSession()
 	if err != nil {
@@ -181,6 +478,11 @@ func (c *Client) SimulatedSession() error {
 	return session.Wait()
 }
 
+// hostKeyOptions returns ssh options that only accept the host keys pinned by graft
+func hostKeyOptions(knownHostsPath string) []string {
+	return []string{"-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile=" + knownHostsPath}
+}
+
 // findSSH attempts to find the best SSH client. On Windows, it prefers WSL to avoid permission issues.
 func findSSH() (string, bool) {
 	// Only check for WSL on Windows
@@ -235,231 +537,6 @@ func (c *Client) DownloadFile(remote, local string) error {
 	return err
 }
 
-// parseGitignore reads a .gitignore file and returns rsync-compatible exclude patterns
-func parseGitignore(gitignorePath string) []string {
-	var excludes []string
-	
-	file, err := os.Open(gitignorePath)
-	if err != nil {
-		// If .gitignore doesn't exist, return empty list
-		return excludes
-	}
-	defer file.Close()
-	
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		
-		// Remove leading slash for rsync compatibility
-		pattern := strings.TrimPrefix(line, "/")
-		
-		// Skip negation patterns (rsync handles them differently)
-		if strings.HasPrefix(pattern, "!") {
-			continue
-		}
-		
-		excludes = append(excludes, pattern)
-	}
-	
-	return excludes
-}
-
-
-// RsyncDirectory syncs a local directory to a remote directory using rsync over SSH
-// This is much faster than creating tarballs as it only transfers changed files
-func (c *Client) RsyncDirectory(localDir, remoteDir string, stdout, stderr io.Writer) error {
-	// Find rsync executable
-	rsyncCmd, err := findRsync()
-	if err != nil {
-		return err
-	}
-	
-	// Essential hardcoded exclusions (always excluded regardless of .gitignore)
-	essentialExcludes := []string{
-		//".git",
-		"node_modules",
-		".next",
-	
-		"*.log",
-	}
-	
-	// Build base args
-	args := []string{
-		"-avz",
-		"--delete",
-	}
-	
-	// Add essential exclusions
-	for _, pattern := range essentialExcludes {
-		args = append(args, "--exclude="+pattern)
-	}
-	
-	// Try to read .gitignore from the local directory
-	gitignorePath := filepath.Join(localDir, ".gitignore")
-	gitignorePatterns := parseGitignore(gitignorePath)
-	
-	// Add gitignore patterns as exclusions
-	for _, pattern := range gitignorePatterns {
-		args = append(args, "--exclude="+pattern)
-	}
-	
-	// Prepare paths based on rsync type
-	sshKeyPath := c.keyPath
-	localPath := localDir
-	
-	// For Git Bash, Cygwin, and WSL, convert Windows paths to Unix format
-	if rsyncCmd != "rsync" {
-		useWSLFormat := (rsyncCmd == "wsl")
-		
-		if useWSLFormat {
-			// For WSL, copy SSH key to WSL filesystem to fix permissions issue
-			// Windows filesystem doesn't support Unix permissions properly
-			wslKeyPath := "~/.ssh/graft_key.pem"
-			
-			// Convert Windows path to WSL path for copying
-			windowsKeyWSL := convertToUnixPath(c.keyPath, true)
-			
-			// Copy key to WSL filesystem and set proper permissions
-			copyCmd := exec.Command("wsl", "bash", "-c", 
-				fmt.Sprintf("mkdir -p ~/.ssh && cp '%s' %s && chmod 600 %s", 
-					windowsKeyWSL, wslKeyPath, wslKeyPath))
-			if err := copyCmd.Run(); err != nil {
-				return fmt.Errorf("failed to copy SSH key to WSL: %v", err)
-			}
-			
-			sshKeyPath = wslKeyPath
-			localPath = convertToUnixPath(localDir, true)
-		} else {
-			sshKeyPath = convertToUnixPath(c.keyPath, false)
-			localPath = convertToUnixPath(localDir, false)
-		}
-	}
-	
-	// Add SSH configuration and paths
-	// Quote the SSH key path to handle spaces and special characters
-	args = append(args,
-		"-e",
-		fmt.Sprintf("ssh -i \"%s\" -p %d -o StrictHostKeyChecking=no", sshKeyPath, c.port),
-		localPath+"/",
-		fmt.Sprintf("%s@%s:%s/", c.user, c.host, remoteDir),
-	)
-	
-	// Execute rsync
-	var cmd *exec.Cmd
-	if rsyncCmd == "wsl" {
-		// For WSL, prepend rsync command
-		wslArgs := append([]string{"rsync"}, args...)
-		cmd = exec.Command("wsl", wslArgs...)
-	} else {
-		cmd = exec.Command(rsyncCmd, args...)
-	}
-	
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	
-	return cmd.Run()
-}
-
-// PullRsync syncs a remote directory to a local directory using rsync over SSH
-func (c *Client) PullRsync(remoteDir, localDir string, stdout, stderr io.Writer) error {
-	// Find rsync executable
-	rsyncCmd, err := findRsync()
-	if err != nil {
-		return err
-	}
-	
-	// Build base args
-	args := []string{
-		"-avz",
-	}
-	
-	// Prepare paths based on rsync type
-	sshKeyPath := c.keyPath
-	localPath := localDir
-	
-	// For Git Bash, Cygwin, and WSL, convert Windows paths to Unix format
-	if rsyncCmd != "rsync" {
-		useWSLFormat := (rsyncCmd == "wsl")
-		
-		if useWSLFormat {
-			wslKeyPath := "~/.ssh/graft_key.pem"
-			windowsKeyWSL := convertToUnixPath(c.keyPath, true)
-			
-			copyCmd := exec.Command("wsl", "bash", "-c", 
-				fmt.Sprintf("mkdir -p ~/.ssh && cp '%s' %s && chmod 600 %s", 
-					windowsKeyWSL, wslKeyPath, wslKeyPath))
-			if err := copyCmd.Run(); err != nil {
-				return fmt.Errorf("failed to copy SSH key to WSL: %v", err)
-			}
-			
-			sshKeyPath = wslKeyPath
-			localPath = convertToUnixPath(localDir, true)
-		} else {
-			sshKeyPath = convertToUnixPath(c.keyPath, false)
-			localPath = convertToUnixPath(localDir, false)
-		}
-	}
-	
-	// Add SSH configuration and paths
-	args = append(args,
-		"-e",
-		fmt.Sprintf("ssh -i \"%s\" -p %d -o StrictHostKeyChecking=no", sshKeyPath, c.port),
-		fmt.Sprintf("%s@%s:%s/", c.user, c.host, remoteDir),
-		localPath+"/",
-	)
-	
-	// Execute rsync
-	var cmd *exec.Cmd
-	if rsyncCmd == "wsl" {
-		wslArgs := append([]string{"rsync"}, args...)
-		cmd = exec.Command("wsl", wslArgs...)
-	} else {
-		cmd = exec.Command(rsyncCmd, args...)
-	}
-	
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	
-	return cmd.Run()
-}
-
-// findRsync tries to find rsync executable, checking common Windows locations
-func findRsync() (string, error) {
-	// On Windows, check specific locations first to properly identify the rsync type
-	windowsPaths := []string{
-		"C:\\Program Files\\Git\\usr\\bin\\rsync.exe", // Git Bash
-		"C:\\cygwin64\\bin\\rsync.exe",                // Cygwin 64-bit
-		"C:\\cygwin\\bin\\rsync.exe",                  // Cygwin 32-bit
-	}
-	
-	for _, path := range windowsPaths {
-		if _, err := os.Stat(path); err == nil {
-			return path, nil
-		}
-	}
-	
-	// Check if WSL is available
-	if _, err := exec.LookPath("wsl"); err == nil {
-		// Verify WSL has rsync
-		cmd := exec.Command("wsl", "which", "rsync")
-		if err := cmd.Run(); err == nil {
-			return "wsl", nil
-		}
-	}
-	
-	// Try standard rsync (Linux/Mac or rsync in PATH)
-	if _, err := exec.LookPath("rsync"); err == nil {
-		return "rsync", nil
-	}
-	
-	return "", fmt.Errorf("rsync not found - please install rsync via WSL, Git for Windows, or Cygwin")
-}
-
 // convertToUnixPath converts Windows paths to Unix-style paths
 // For WSL: C:\Users\Name\file.pem -> /mnt/c/Users/Name/file.pem
 // For Git Bash/Cygwin: C:\Users\Name\file.pem -> /c/Users/Name/file.pem
@@ -486,10 +563,24 @@ func convertToUnixPath(windowsPath string, useWSLFormat bool) string {
 }
 
 func (c *Client) Close() {
-	if c.sftp != nil {
-		c.sftp.Close()
-	}
-	if c.client != nil {
-		c.client.Close()
-	}
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.agent != nil {
+			c.agent.close()
+		}
+		if c.askpass != nil {
+			c.askpass.close()
+		}
+		if c.sshConfig != "" {
+			os.Remove(c.sshConfig)
+		}
+		if c.sftp != nil {
+			c.sftp.Close()
+		}
+		if c.client != nil {
+			c.client.Close()
+		}
+		c.creds.close()
+		c.closeJumps()
+	})
 }
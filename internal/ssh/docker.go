@@ -0,0 +1,129 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/skssmd/graft/internal/config"
+	"github.com/skssmd/graft/internal/shell"
+)
+
+// rootlessDockerHost points the docker CLI at the user's rootless daemon. Non-interactive
+// SSH sessions (and cron) often lack DOCKER_HOST, so it falls back to the default socket.
+const rootlessDockerHost = `DOCKER_HOST="${DOCKER_HOST:-unix:///run/user/$(id -u)/docker.sock}"`
+
+// DockerMode returns the docker privilege mode used for this server
+func (c *Client) DockerMode() string {
+	c.dockerMu.Lock()
+	defer c.dockerMu.Unlock()
+	if c.dockerMode == "" {
+		return config.DockerSudo
+	}
+	return c.dockerMode
+}
+
+// SetDockerMode changes the docker privilege mode, e.g. after detecting it
+func (c *Client) SetDockerMode(mode string) {
+	c.dockerMu.Lock()
+	defer c.dockerMu.Unlock()
+	c.dockerMode = mode
+	c.dockerSocket = ""
+}
+
+// DockerPrefix returns the shell prefix that invokes docker under the server's privilege mode
+func (c *Client) DockerPrefix() string {
+	return dockerPrefix(c.DockerMode())
+}
+
+func dockerPrefix(mode string) string {
+	switch mode {
+	case config.DockerGroup:
+		return "docker"
+	case config.DockerRootless:
+		return rootlessDockerHost + " docker"
+	}
+	return "sudo docker"
+}
+
+// Docker returns a docker command with quoted args, run under the server's privilege mode
+func (c *Client) Docker(args ...string) shell.Command {
+	return shell.Raw(c.DockerPrefix()).Arg(args...)
+}
+
+// Compose returns a docker compose command run inside the project directory dir
+func (c *Client) Compose(dir string, args ...string) shell.Command {
+	return shell.Cd(dir).And(c.Docker(append([]string{"compose"}, args...)...))
+}
+
+// Privileged returns a command that needs root on sudo hosts. Hosts without sudo
+// access run it as the deploy user, which owns the graft directories there.
+func (c *Client) Privileged(args ...string) shell.Command {
+	if c.DockerMode() == config.DockerSudo {
+		return shell.New(append([]string{"sudo"}, args...)...)
+	}
+	return shell.New(args...)
+}
+
+// BaseDir is where graft keeps its files on the server
+const BaseDir = "/opt/graft"
+
+// CheckBaseDir makes sure the deploy user can write BaseDir. On sudo hosts graft creates it
+// itself; without sudo an administrator has to create it once, since /opt belongs to root.
+func (c *Client) CheckBaseDir() error {
+	if c.DockerMode() == config.DockerSudo {
+		return nil
+	}
+	check := shell.New("test", "-d", BaseDir).And(shell.New("test", "-w", BaseDir))
+	if err := c.RunCommand(check.String(), nil, nil); err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s does not exist or is not writable by %s, and graft has no sudo in %s mode\n👉 Ask an administrator to run once: sudo mkdir -p %s && sudo chown %s: %s",
+		BaseDir, c.user, c.DockerMode(), BaseDir, c.user, BaseDir)
+}
+
+// MkdirOwned creates dirs and makes sure the deploy user owns them. Without sudo they must
+// be below a writable BaseDir, see CheckBaseDir.
+func (c *Client) MkdirOwned(dirs ...string) shell.Command {
+	if c.DockerMode() != config.DockerSudo {
+		return shell.New(append([]string{"mkdir", "-p"}, dirs...)...)
+	}
+	return shell.New(append([]string{"sudo", "mkdir", "-p"}, dirs...)...).
+		And(shell.New("sudo", "chown").Append("$USER:$USER").Arg(dirs...))
+}
+
+// DockerSocket returns the path of the docker daemon socket on the server,
+// for containers (Traefik, graft-hook) that talk to the daemon
+func (c *Client) DockerSocket() string {
+	if c.DockerMode() != config.DockerRootless {
+		return "/var/run/docker.sock"
+	}
+	// Held during the lookup, so concurrent callers wait for it instead of repeating it
+	c.dockerMu.Lock()
+	defer c.dockerMu.Unlock()
+	if c.dockerSocket == "" {
+		var out bytes.Buffer
+		if err := c.RunCommand("id -u", &out, nil); err != nil {
+			return "/var/run/docker.sock"
+		}
+		c.dockerSocket = fmt.Sprintf("/run/user/%s/docker.sock", strings.TrimSpace(out.String()))
+	}
+	return c.dockerSocket
+}
+
+// DetectDockerMode works out how the deploy user can reach the docker daemon:
+// a rootless daemon of its own, docker group membership, or sudo.
+func (c *Client) DetectDockerMode() (string, error) {
+	// Rootless first: its daemon answers without sudo but only through the user's socket
+	rootless := fmt.Sprintf("[ -S /run/user/$(id -u)/docker.sock ] && %s docker info -f '{{.SecurityOptions}}' | grep -q rootless", rootlessDockerHost)
+	if err := c.RunCommand(rootless, nil, nil); err == nil {
+		return config.DockerRootless, nil
+	}
+	if err := c.RunCommand("docker info", nil, nil); err == nil {
+		return config.DockerGroup, nil
+	}
+	if err := c.RunCommand("sudo -n docker info", nil, nil); err == nil {
+		return config.DockerSudo, nil
+	}
+	return "", fmt.Errorf("user '%s' cannot reach the docker daemon: add it to the docker group, set up rootless Docker or allow passwordless sudo", c.user)
+}
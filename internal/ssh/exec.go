@@ -0,0 +1,227 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/skssmd/graft/internal/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	keepaliveInterval  = 15 * time.Second
+	keepaliveMaxMissed = 3
+)
+
+// running counts remote commands in flight, see CommandRunning
+var running atomic.Int32
+
+// CommandRunning reports whether a remote command is currently executing
+func CommandRunning() bool {
+	return running.Load() > 0
+}
+
+// SignalError is the cancellation cause when the user interrupted graft.
+// Remote commands receive the same signal before they are stopped.
+type SignalError struct {
+	Signal os.Signal
+}
+
+func (e *SignalError) Error() string {
+	return fmt.Sprintf("interrupted (%v)", e.Signal)
+}
+
+// SetContext makes RunCommand stop the remote command when ctx is cancelled
+func (c *Client) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// SetTimeout limits how long each remote command may run (0 disables the limit)
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// RunCommandContext runs cmd on the server. When ctx is cancelled or the command timeout
+// expires, the remote process group is signalled so nothing keeps running on the server.
+func (c *Client) RunCommandContext(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	return c.runCommand(ctx, cmd, nil, stdout, stderr)
+}
+
+// RunCommandStdin runs cmd on the server with stdin streamed from the given reader,
+// e.g. to pipe an image archive into docker load
+func (c *Client) RunCommandStdin(cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return c.runCommand(c.ctx, cmd, stdin, stdout, stderr)
+}
+
+func (c *Client) runCommand(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	session, err := c.client.NewSession()
+	if err != nil {
+		return c.connectionError(err)
+	}
+	defer session.Close()
+
+	running.Add(1)
+	defer running.Add(-1)
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	// sshd starts the command in its own session, so the shell's pid is also the
+	// process group id. Remember it to be able to stop the whole group later.
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("unable to generate a command id: %v", err)
+	}
+	pidFile := fmt.Sprintf("/tmp/graft-cmd-%s.pid", hex.EncodeToString(id))
+	wrapped := posixShell(fmt.Sprintf("%s\n%s", pidScript(pidFile), cmd))
+
+	if err := session.Start(wrapped); err != nil {
+		return c.connectionError(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err := <-done:
+		return c.connectionError(err)
+	case <-ctx.Done():
+	}
+
+	sig := remoteSignal(context.Cause(ctx))
+	session.Signal(sig)
+	c.killRemote(pidFile, sig)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+
+	var sigErr *SignalError
+	if cause := context.Cause(ctx); errors.As(cause, &sigErr) {
+		return sigErr
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command timed out after %s", c.timeout)
+	}
+	return ctx.Err()
+}
+
+// posixShell runs script with sh, whatever the user's login shell is (fish, csh, ...).
+// exec keeps the pid of the session's shell, which leads the process group.
+func posixShell(script string) string {
+	return "exec sh -c " + shell.Quote(script)
+}
+
+// pidScript records the shell's pid in pidFile and removes the file however the script
+// ends: normally, through exit or set -e, or by a signal. A /tmp that is not writable only
+// costs the process group kill on cancellation.
+func pidScript(pidFile string) string {
+	return fmt.Sprintf("trap 'rm -f %s' EXIT\ntrap 'exit 129' HUP\ntrap 'exit 130' INT\ntrap 'exit 143' TERM\n{ echo $$ > %s; } 2>/dev/null", pidFile, pidFile)
+}
+
+// killRemote signals the process group recorded in pidFile from a fresh session
+func (c *Client) killRemote(pidFile string, sig ssh.Signal) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	cmd := posixShell(fmt.Sprintf("[ -f %s ] && kill -%s -$(cat %s) 2>/dev/null; rm -f %s", pidFile, sig, pidFile, pidFile))
+	finished := make(chan struct{})
+	go func() {
+		session.Run(cmd)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// remoteSignal maps the cancellation cause to the signal sent to the remote command
+func remoteSignal(cause error) ssh.Signal {
+	var sigErr *SignalError
+	if errors.As(cause, &sigErr) && sigErr.Signal == os.Interrupt {
+		return ssh.SIGINT
+	}
+	if errors.As(cause, &sigErr) && sigErr.Signal == syscall.SIGHUP {
+		return ssh.SIGHUP
+	}
+	return ssh.SIGTERM
+}
+
+// keepalive pings the server and closes the connection after maxMissed unanswered
+// requests, so commands on a dead connection fail instead of hanging forever.
+func (c *Client) keepalive(interval time.Duration, maxMissed int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err != nil {
+				missed = maxMissed
+			} else {
+				missed = 0
+			}
+		case <-time.After(interval):
+			missed++
+		case <-c.done:
+			return
+		}
+
+		if missed >= maxMissed {
+			c.lost.Store(true)
+			c.client.Close()
+			return
+		}
+	}
+}
+
+// connectionError explains failures caused by a connection the keepalive gave up on
+func (c *Client) connectionError(err error) error {
+	if err != nil && c.lost.Load() {
+		return fmt.Errorf("connection to %s lost (no response to %d keepalives): %v", c.host, keepaliveMaxMissed, err)
+	}
+	return err
+}
+
+// ExitStatus returns the exit status of a remote command that ran to completion and
+// failed; ok is false when err is not such a failure (connection lost, interrupted, ...)
+func ExitStatus(err error) (status int, ok bool) {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
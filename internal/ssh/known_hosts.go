@@ -0,0 +1,267 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// KnownHostsPath returns the location of graft's own known_hosts file.
+// It uses the OpenSSH format so the external ssh/rsync commands can share it.
+func KnownHostsPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".graft", "known_hosts")
+}
+
+// ensureKnownHostsFile creates an empty known_hosts file if none exists yet
+func ensureKnownHostsFile() (string, error) {
+	path := KnownHostsPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return path, nil
+}
+
+// hostKeyCallback verifies server keys against the graft known_hosts file.
+// Unknown hosts are pinned after the user confirms the fingerprint (trust on first use),
+// while a changed key is always a hard failure.
+func hostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		path, err := ensureKnownHostsFile()
+		if err != nil {
+			return fmt.Errorf("unable to open known_hosts: %v", err)
+		}
+
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("unable to read known_hosts: %v", err)
+		}
+
+		err = check(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		if len(keyErr.Want) > 0 {
+			return hostKeyMismatchError(hostname, key, keyErr.Want)
+		}
+
+		// First connection to this host: ask before pinning the key
+		if !confirmHostKey(fmt.Sprintf("The authenticity of host '%s' can't be established.", hostname), key) {
+			return fmt.Errorf("host key for %s was not trusted", hostname)
+		}
+		return appendKnownHost(path, hostname, key)
+	}
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms already pinned for addr,
+// so the server is asked for the key type we know instead of triggering a false mismatch.
+func knownHostKeyAlgorithms(addr string) []string {
+	path := KnownHostsPath()
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil
+	}
+
+	// Probe with a key that can never match to get the list of pinned keys
+	var keyErr *knownhosts.KeyError
+	if err := check(addr, &net.TCPAddr{}, probeKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algos []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		for _, algo := range algorithmsForKeyType(known.Key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+	return algos
+}
+
+// algorithmsForKeyType maps a key type to the signature algorithms that can negotiate it
+func algorithmsForKeyType(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// probeKey is a placeholder public key used to list known keys for a host
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "graft-probe" }
+func (probeKey) Marshal() []byte                              { return []byte("graft-probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("probe key") }
+
+// confirmHostKey shows why a host key needs confirmation and asks the user to trust it
+func confirmHostKey(headline string, key ssh.PublicKey) bool {
+	fmt.Printf("\n🔐 %s\n", headline)
+	fmt.Printf("   %s key fingerprint is %s\n", key.Type(), ssh.FingerprintSHA256(key))
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Println("❌ Not running in a terminal, refusing to trust an unknown host.")
+		fmt.Println("👉 Connect once interactively or run 'graft registry trust <name>' to pin this host.")
+		return false
+	}
+
+	fmt.Print("Trust this host and continue connecting? (yes/no): ")
+	answer := strings.ToLower(strings.TrimSpace(readLine()))
+	return answer == "y" || answer == "yes"
+}
+
+// readLine reads a single line from stdin without buffering past the newline,
+// so callers holding their own bufio.Reader on stdin don't lose input.
+func readLine() string {
+	var sb strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			sb.WriteByte(buf[0])
+		}
+		if err != nil {
+			break
+		}
+	}
+	return sb.String()
+}
+
+// appendKnownHost pins a host key in the known_hosts file
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to update known_hosts: %v", err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("unable to update known_hosts: %v", err)
+	}
+	fmt.Printf("✅ Pinned %s key for %s in %s\n", key.Type(), hostname, path)
+	return nil
+}
+
+// hostKeyMismatchError describes a changed host key with both fingerprints
+func hostKeyMismatchError(hostname string, key ssh.PublicKey, want []knownhosts.KnownKey) error {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("HOST KEY VERIFICATION FAILED for %s\n", hostname))
+	sb.WriteString("⚠️  The server presented a different key than the one pinned. Someone could be\n")
+	sb.WriteString("   intercepting the connection (man-in-the-middle), or the server was rebuilt.\n")
+	sb.WriteString(fmt.Sprintf("   - presented: %s %s\n", key.Type(), ssh.FingerprintSHA256(key)))
+	for _, known := range want {
+		sb.WriteString(fmt.Sprintf("   + pinned:    %s %s (%s:%d)\n", known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+	}
+	sb.WriteString("👉 If the server was rebuilt on purpose, re-pin it with: graft registry trust <name>")
+	return errors.New(sb.String())
+}
+
+// repinHostKeyCallback accepts the key a server presents after the user confirmed it and
+// then replaces the keys pinned for the host with it
+func repinHostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		path, err := ensureKnownHostsFile()
+		if err != nil {
+			return fmt.Errorf("unable to open known_hosts: %v", err)
+		}
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("unable to read known_hosts: %v", err)
+		}
+
+		err = check(hostname, remote, key)
+		if err == nil {
+			fmt.Printf("✅ %s already presents the pinned %s key, nothing to change\n", hostname, key.Type())
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if !confirmHostKey(fmt.Sprintf("Host '%s' presents a new key.", hostname), key) {
+			return fmt.Errorf("host key for %s was not trusted, the pinned key was kept", hostname)
+		}
+		return replaceKnownHost(path, hostname, key)
+	}
+}
+
+// replaceKnownHost pins key as the only key of hostname. The file is rewritten through a
+// temporary file and a rename, so it never lacks both the old and the new pin.
+func replaceKnownHost(path, hostname string, key ssh.PublicKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read known_hosts: %v", err)
+	}
+
+	target := knownhosts.Normalize(hostname)
+	var kept []string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") {
+			hosts := strings.Split(fields[0], ",")
+			if slices.Contains(hosts, target) {
+				// Keep the key for the other hosts sharing the line
+				hosts = slices.DeleteFunc(hosts, func(h string) bool { return h == target })
+				if len(hosts) == 0 {
+					continue
+				}
+				line = strings.Join(hosts, ",") + strings.TrimPrefix(line, fields[0])
+			}
+		}
+		kept = append(kept, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read known_hosts: %v", err)
+	}
+	kept = append(kept, knownhosts.Line([]string{target}, key))
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".known_hosts-*")
+	if err != nil {
+		return fmt.Errorf("unable to update known_hosts: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(kept, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to update known_hosts: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to update known_hosts: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to update known_hosts: %v", err)
+	}
+	fmt.Printf("✅ Pinned %s key for %s in %s\n", key.Type(), hostname, path)
+	return nil
+}
@@ -0,0 +1,75 @@
+package ssh
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// RunCommandPTY runs cmd in a remote pseudo-terminal connected to the local terminal.
+// The local terminal is switched to raw mode for the duration of the command so keys
+// like Ctrl+C and arrow keys reach the remote program, and window size changes are forwarded.
+// The command timeout does not apply to interactive sessions.
+func (c *Client) RunCommandPTY(cmd string) error {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	fd := int(os.Stdin.Fd())
+	width, height := 80, 24
+	if term.IsTerminal(fd) {
+		if w, h, err := term.GetSize(fd); err == nil {
+			width, height = w, h
+		}
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+	}
+
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(termType, height, width, modes); err != nil {
+		return err
+	}
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	stop := watchWindowSize(fd, func(w, h int) {
+		session.WindowChange(h, w)
+	})
+	defer stop()
+
+	if err := session.Start(cmd); err != nil {
+		return c.connectionError(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	// Ctrl+C travels through the raw terminal; the context only ends the session
+	// when graft itself is asked to stop
+	select {
+	case err := <-done:
+		return c.connectionError(err)
+	case <-c.ctx.Done():
+		session.Signal(remoteSignal(context.Cause(c.ctx)))
+		session.Close()
+		return context.Cause(c.ctx)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package ssh
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// watchWindowSize calls onResize with the new terminal size on every SIGWINCH
+// until the returned stop function is called.
+func watchWindowSize(fd int, onResize func(width, height int)) func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				if w, h, err := term.GetSize(fd); err == nil {
+					onResize(w, h)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build windows
+
+package ssh
+
+import (
+	"time"
+
+	"golang.org/x/term"
+)
+
+// watchWindowSize polls the console size, Windows has no SIGWINCH.
+// onResize is called whenever the size changes until the returned stop function is called.
+func watchWindowSize(fd int, onResize func(width, height int)) func() {
+	done := make(chan struct{})
+	lastW, lastH, _ := term.GetSize(fd)
+
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w, h, err := term.GetSize(fd)
+				if err == nil && (w != lastW || h != lastH) {
+					lastW, lastH = w, h
+					onResize(w, h)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,327 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/skssmd/graft/internal/config"
+)
+
+// SSHConfigPath returns the location of the user's OpenSSH client config
+func SSHConfigPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// sshConfigBlock is a single Host section of an ssh_config file
+type sshConfigBlock struct {
+	patterns []string
+	options  [][2]string // keyword (lower case) and value, in file order
+}
+
+// SSHConfig is a parsed ~/.ssh/config. Only Host blocks are evaluated,
+// Match blocks are skipped since they depend on runtime conditions.
+type SSHConfig struct {
+	blocks []sshConfigBlock
+}
+
+// SSHHost holds the settings ssh_config resolves for a host alias
+type SSHHost struct {
+	Alias         string
+	HostName      string
+	Port          int
+	User          string
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// LoadSSHConfig parses an ssh_config file, following Include directives
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	cfg := &SSHConfig{}
+	// Options before the first Host line apply to every host
+	cfg.blocks = append(cfg.blocks, sshConfigBlock{patterns: []string{"*"}})
+	if err := cfg.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *SSHConfig) parseFile(path string, depth int) error {
+	if depth > 8 {
+		return fmt.Errorf("too many nested Include directives in %s", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		keyword, value := splitSSHConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			cfg.blocks = append(cfg.blocks, sshConfigBlock{patterns: strings.Fields(value)})
+		case "match":
+			// Unsupported: start a block that never matches
+			cfg.blocks = append(cfg.blocks, sshConfigBlock{})
+		case "include":
+			for _, pattern := range strings.Fields(value) {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(SSHConfigPath()), pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, m := range matches {
+					if err := cfg.parseFile(m, depth+1); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+		default:
+			last := &cfg.blocks[len(cfg.blocks)-1]
+			last.options = append(last.options, [2]string{keyword, value})
+		}
+	}
+	return scanner.Err()
+}
+
+// splitSSHConfigLine returns the lower-cased keyword and the unquoted value of a config line
+func splitSSHConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+
+	// Keyword and value are separated by whitespace and/or a single '='
+	idx := strings.IndexAny(line, " \t=")
+	if idx < 0 {
+		return strings.ToLower(line), ""
+	}
+	keyword := strings.ToLower(line[:idx])
+	value := strings.TrimSpace(line[idx:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return keyword, value
+}
+
+// matches reports whether the block applies to alias, honouring negated (!) patterns
+func (b sshConfigBlock) matches(alias string) bool {
+	matched := false
+	for _, pattern := range b.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := filepath.Match(strings.TrimPrefix(pattern, "!"), alias)
+		if ok && negated {
+			return false
+		}
+		if ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Resolve evaluates the config for alias. Like ssh, the first value found for an option wins,
+// except IdentityFile which accumulates.
+func (cfg *SSHConfig) Resolve(alias string) SSHHost {
+	host := SSHHost{Alias: alias}
+	seen := make(map[string]bool)
+
+	for _, block := range cfg.blocks {
+		if !block.matches(alias) {
+			continue
+		}
+		for _, opt := range block.options {
+			keyword, value := opt[0], opt[1]
+			if keyword == "identityfile" {
+				host.IdentityFiles = append(host.IdentityFiles, value)
+				continue
+			}
+			if seen[keyword] {
+				continue
+			}
+			seen[keyword] = true
+
+			switch keyword {
+			case "hostname":
+				host.HostName = value
+			case "port":
+				host.Port, _ = strconv.Atoi(value)
+			case "user":
+				host.User = value
+			case "proxyjump":
+				host.ProxyJump = value
+			}
+		}
+	}
+
+	if host.HostName == "" {
+		host.HostName = alias
+	} else {
+		host.HostName = strings.ReplaceAll(host.HostName, "%h", alias)
+	}
+	if host.Port == 0 {
+		host.Port = 22
+	}
+	if host.User == "" {
+		host.User = currentUser()
+	}
+	for i, id := range host.IdentityFiles {
+		host.IdentityFiles[i] = expandSSHTokens(id, host)
+	}
+	return host
+}
+
+// Aliases returns the concrete host aliases defined in the config (no wildcard patterns)
+func (cfg *SSHConfig) Aliases() []string {
+	var aliases []string
+	seen := make(map[string]bool)
+	for _, block := range cfg.blocks {
+		for _, pattern := range block.patterns {
+			if strings.ContainsAny(pattern, "*?!") || seen[pattern] {
+				continue
+			}
+			seen[pattern] = true
+			aliases = append(aliases, pattern)
+		}
+	}
+	return aliases
+}
+
+// expandSSHTokens expands ~ and the common % tokens in an IdentityFile path
+func expandSSHTokens(path string, host SSHHost) string {
+	home, _ := os.UserHomeDir()
+	replacer := strings.NewReplacer(
+		"%d", home,
+		"%h", host.HostName,
+		"%n", host.Alias,
+		"%p", strconv.Itoa(host.Port),
+		"%r", host.User,
+		"%u", currentUser(),
+		"%%", "%",
+	)
+	return expandHome(replacer.Replace(path))
+}
+
+// currentUser returns the local user name, which ssh uses when no User is configured
+func currentUser() string {
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+	return os.Getenv("USERNAME")
+}
+
+// ServerConfig turns the resolved host into a registry server config.
+// The first existing IdentityFile is used; without one the running ssh-agent is preferred.
+func (h SSHHost) ServerConfig(cfg *SSHConfig) (config.ServerConfig, error) {
+	srv := config.ServerConfig{
+		Host:     h.HostName,
+		Port:     h.Port,
+		User:     h.User,
+		SSHAlias: h.Alias,
+	}
+
+	for _, id := range h.IdentityFiles {
+		if _, err := os.Stat(id); err == nil {
+			srv.KeyPath = id
+			srv.AuthMethod = config.AuthKey
+			break
+		}
+	}
+	if srv.KeyPath == "" {
+		if os.Getenv("SSH_AUTH_SOCK") != "" {
+			srv.AuthMethod = config.AuthAgent
+		} else if key := defaultIdentityFile(); key != "" {
+			srv.KeyPath = key
+			srv.AuthMethod = config.AuthKey
+		}
+	}
+
+	if h.ProxyJump != "" && !strings.EqualFold(h.ProxyJump, "none") {
+		jumps, err := config.ParseJumpHosts(h.ProxyJump)
+		if err != nil {
+			return srv, fmt.Errorf("ProxyJump for %s: %v", h.Alias, err)
+		}
+		for i, jump := range jumps {
+			// Jump hosts are frequently aliases themselves
+			resolved := cfg.Resolve(jump.Host)
+			jumpSrv, err := resolved.ServerConfig(&SSHConfig{})
+			if err != nil {
+				return srv, err
+			}
+			jumps[i].Host = resolved.HostName
+			if jump.Port == 0 {
+				jumps[i].Port = resolved.Port
+			}
+			if jump.User == "" {
+				jumps[i].User = resolved.User
+			}
+			jumps[i].KeyPath = jumpSrv.KeyPath
+			jumps[i].AuthMethod = jumpSrv.AuthMethod
+		}
+		srv.JumpHosts = jumps
+	}
+	return srv, nil
+}
+
+// defaultIdentityFile returns the first of ssh's default key files that exists
+func defaultIdentityFile() string {
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		path := expandHome(filepath.Join("~", ".ssh", name))
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// ResolveServer fills a registry entry that references an ssh_config alias with the
+// settings from its ssh_config file (~/.ssh/config unless the entry names another one).
+// Values set explicitly on the entry take precedence.
+func ResolveServer(srv config.ServerConfig) (config.ServerConfig, error) {
+	if srv.SSHAlias == "" {
+		return srv, nil
+	}
+
+	path := srv.SSHConfigFile
+	if path == "" {
+		path = SSHConfigPath()
+	}
+	cfg, err := LoadSSHConfig(path)
+	if err != nil {
+		return srv, fmt.Errorf("unable to read ssh config for alias '%s': %v", srv.SSHAlias, err)
+	}
+	resolved, err := cfg.Resolve(srv.SSHAlias).ServerConfig(cfg)
+	if err != nil {
+		return srv, err
+	}
+
+	if srv.Host == "" {
+		srv.Host = resolved.Host
+	}
+	if srv.Port == 0 {
+		srv.Port = resolved.Port
+	}
+	if srv.User == "" {
+		srv.User = resolved.User
+	}
+	if srv.KeyPath == "" && srv.AuthMethod == "" {
+		srv.KeyPath = resolved.KeyPath
+		srv.AuthMethod = resolved.AuthMethod
+	}
+	if len(srv.JumpHosts) == 0 {
+		srv.JumpHosts = resolved.JumpHosts
+	}
+	return srv, nil
+}
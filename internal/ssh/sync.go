@@ -0,0 +1,662 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skssmd/graft/internal/shell"
+)
+
+// Essential hardcoded exclusions (always excluded regardless of .gitignore)
+var essentialExcludes = []string{
+	//".git",
+	"node_modules",
+	".next",
+
+	"*.log",
+}
+
+// ManifestEntry describes one synced file as last written to the server
+type ManifestEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`          // unix seconds of the local file
+	Mode    uint32 `json:"mode,omitempty"` // permission bits, 0 when unknown (Windows)
+	Hash    string `json:"sha256"`
+	Link    string `json:"link,omitempty"` // symlink target, if the entry is a symlink
+}
+
+// Manifest maps slash-separated paths relative to the synced directory to their entries
+type Manifest map[string]ManifestEntry
+
+// SyncPlan lists what a directory sync changes on the server
+type SyncPlan struct {
+	Upload    []string
+	Delete    []string
+	Unchanged int
+	Bytes     int64
+
+	local    Manifest
+	remote   Manifest
+	localDir string
+	dirs     map[string]bool
+}
+
+// manifestPath returns where the manifest for remoteDir is stored. It lives next to the
+// directory instead of inside it so it never ends up in a docker build context.
+func manifestPath(remoteDir string) string {
+	remoteDir = path.Clean(remoteDir)
+	return path.Join(path.Dir(remoteDir), ".graft-sync", path.Base(remoteDir)+".json")
+}
+
+// SyncDirectory makes remoteDir mirror localDir over SFTP. Only files whose size, mtime
+// and hash differ from the remote manifest are uploaded, and files removed locally are
+// deleted on the server. Files changed or removed on the server since the last sync are
+// uploaded again. Excluded paths (see essentialExcludes and .gitignore) are left alone.
+func (c *Client) SyncDirectory(localDir, remoteDir string, stdout, stderr io.Writer) error {
+	plan, err := c.PlanSync(localDir, remoteDir)
+	if err != nil {
+		return err
+	}
+	return c.applySync(plan, remoteDir, stdout)
+}
+
+// PlanSync compares localDir against the remote manifest without changing anything
+func (c *Client) PlanSync(localDir, remoteDir string) (*SyncPlan, error) {
+	matcher := newExcludeMatcher(append(append([]string{}, essentialExcludes...), parseGitignore(filepath.Join(localDir, ".gitignore"))...))
+
+	local, dirs, err := scanLocal(localDir, matcher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %v", localDir, err)
+	}
+
+	remote, err := c.loadManifest(remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &SyncPlan{local: Manifest{}, remote: remote, localDir: localDir, dirs: dirs}
+	for _, rel := range sortedKeys(local) {
+		entry := local[rel]
+		prev, exists := remote[rel]
+
+		sameMode := entry.Mode == 0 || entry.Mode == prev.Mode
+		if exists && entry.Link == "" && prev.Link == "" && prev.Size == entry.Size && prev.ModTime == entry.ModTime && sameMode && prev.Hash != "" {
+			plan.local[rel] = prev
+			plan.Unchanged++
+			continue
+		}
+
+		// Size or mtime changed (or unknown): decide by content
+		if entry.Link == "" {
+			hash, err := hashFile(filepath.Join(localDir, filepath.FromSlash(rel)))
+			if err != nil {
+				return nil, err
+			}
+			entry.Hash = hash
+		}
+		plan.local[rel] = entry
+
+		if exists && prev.Hash == entry.Hash && prev.Link == entry.Link && sameMode {
+			plan.Unchanged++
+			continue
+		}
+		plan.Upload = append(plan.Upload, rel)
+		plan.Bytes += entry.Size
+	}
+
+	for _, rel := range sortedKeys(remote) {
+		if _, keep := local[rel]; keep || matcher.excludedPath(rel) {
+			continue
+		}
+		plan.Delete = append(plan.Delete, rel)
+	}
+	return plan, nil
+}
+
+// HashDirectory returns a content hash of localDir: the paths, permissions and contents of
+// every file a SyncDirectory would upload, with the same exclusions
+func HashDirectory(localDir string) (string, error) {
+	matcher := newExcludeMatcher(append(append([]string{}, essentialExcludes...), parseGitignore(filepath.Join(localDir, ".gitignore"))...))
+	files, _, err := scanLocal(localDir, matcher)
+	if err != nil {
+		return "", fmt.Errorf("failed to scan %s: %v", localDir, err)
+	}
+
+	h := sha256.New()
+	for _, rel := range sortedKeys(files) {
+		entry := files[rel]
+		if entry.Link == "" {
+			if entry.Hash, err = hashFile(filepath.Join(localDir, filepath.FromSlash(rel))); err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%s\x00%s\n", rel, entry.Mode, entry.Link, entry.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *Client) applySync(plan *SyncPlan, remoteDir string, stdout io.Writer) (err error) {
+	// Record progress even if the transfer fails half way
+	written := Manifest{}
+	for rel, entry := range plan.remote {
+		written[rel] = entry
+	}
+	defer func() {
+		if serr := c.saveManifest(remoteDir, written); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+
+	if err := c.sftp.MkdirAll(remoteDir); err != nil {
+		return fmt.Errorf("failed to create %s: %v", remoteDir, err)
+	}
+
+	start := time.Now()
+	for _, rel := range plan.Upload {
+		entry := plan.local[rel]
+		fmt.Fprintf(stdout, "  ⬆️  %s\n", rel)
+		if err := c.uploadEntry(plan.localDir, remoteDir, rel, entry); err != nil {
+			return fmt.Errorf("failed to upload %s: %v", rel, err)
+		}
+		written[rel] = entry
+	}
+
+	for _, rel := range plan.Delete {
+		fmt.Fprintf(stdout, "  🗑️  %s\n", rel)
+		if err := c.sftp.Remove(path.Join(remoteDir, rel)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %v", rel, err)
+		}
+		delete(written, rel)
+	}
+	c.removeEmptyDirs(remoteDir, plan.Delete, plan.dirs)
+
+	// Unchanged files may have a refreshed mtime or hash. The server copy gets the new mtime
+	// too, which verifyManifest relies on.
+	for rel, entry := range plan.local {
+		if prev, ok := plan.remote[rel]; ok && entry.Link == "" && prev.ModTime != entry.ModTime {
+			mtime := time.Unix(entry.ModTime, 0)
+			if err := c.sftp.Chtimes(path.Join(remoteDir, rel), mtime, mtime); err != nil {
+				continue
+			}
+		}
+		written[rel] = entry
+	}
+
+	fmt.Fprintf(stdout, "✅ %d uploaded (%s), %d deleted, %d unchanged in %s\n",
+		len(plan.Upload), formatBytes(plan.Bytes), len(plan.Delete), plan.Unchanged, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// uploadEntry writes a single file or symlink and restores its mode and mtime
+func (c *Client) uploadEntry(localDir, remoteDir, rel string, entry ManifestEntry) error {
+	localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+	remotePath := path.Join(remoteDir, rel)
+
+	if err := c.sftp.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+
+	if entry.Link != "" {
+		c.sftp.Remove(remotePath)
+		return c.sftp.Symlink(entry.Link, remotePath)
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := c.sftp.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// Windows has no meaningful unix permissions, keep the server default there
+	if runtime.GOOS != "windows" {
+		if err := c.sftp.Chmod(remotePath, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return c.sftp.Chtimes(remotePath, info.ModTime(), info.ModTime())
+}
+
+// removeEmptyDirs removes directories left empty by deletions that no longer exist locally
+func (c *Client) removeEmptyDirs(remoteDir string, deleted []string, localDirs map[string]bool) {
+	candidates := make(map[string]bool)
+	for _, rel := range deleted {
+		for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if !localDirs[dir] {
+				candidates[dir] = true
+			}
+		}
+	}
+
+	// Deepest first, RemoveDirectory fails harmlessly on non-empty directories
+	dirs := sortedKeys(candidates)
+	sort.Slice(dirs, func(i, j int) bool { return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/") })
+	for _, dir := range dirs {
+		c.sftp.RemoveDirectory(path.Join(remoteDir, dir))
+	}
+}
+
+// loadManifest reads the remote manifest. Without one (first sync, or a directory
+// previously uploaded by rsync) it is rebuilt from the files on the server.
+func (c *Client) loadManifest(remoteDir string) (Manifest, error) {
+	f, err := c.sftp.Open(manifestPath(remoteDir))
+	if err == nil {
+		defer f.Close()
+		var manifest Manifest
+		if err := json.NewDecoder(f).Decode(&manifest); err == nil && manifest != nil {
+			return c.verifyManifest(remoteDir, manifest)
+		}
+	}
+	return c.buildRemoteManifest(remoteDir)
+}
+
+// verifyManifest catches files that were changed or removed on the server since the last
+// sync: changed files lose their hash, so they are uploaded again (or deleted when they are
+// gone locally), removed files are dropped. Every synced file carries the mtime of the local
+// file, so a different size, mtime or mode gives a change away.
+func (c *Client) verifyManifest(remoteDir string, manifest Manifest) (Manifest, error) {
+	found := make(map[string]os.FileInfo)
+	walker := c.sftp.Walk(remoteDir)
+	for walker.Step() {
+		if walker.Err() != nil {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remoteDir), "/")
+		if rel != "" && !walker.Stat().IsDir() {
+			found[rel] = walker.Stat()
+		}
+	}
+
+	for rel, entry := range manifest {
+		info, ok := found[rel]
+		switch {
+		case !ok:
+			delete(manifest, rel)
+		case entry.Link != "":
+			if info.Mode()&os.ModeSymlink == 0 {
+				entry.Hash = ""
+			}
+		case !info.Mode().IsRegular() || info.Size() != entry.Size || info.ModTime().Unix() != entry.ModTime ||
+			(entry.Mode != 0 && uint32(info.Mode().Perm()) != entry.Mode):
+			entry.Hash = ""
+		}
+		if ok {
+			manifest[rel] = entry
+		}
+	}
+	return manifest, nil
+}
+
+// buildRemoteManifest indexes and hashes the existing files on the server
+func (c *Client) buildRemoteManifest(remoteDir string) (Manifest, error) {
+	manifest := Manifest{}
+
+	walker := c.sftp.Walk(remoteDir)
+	for walker.Step() {
+		if walker.Err() != nil {
+			continue
+		}
+		info := walker.Stat()
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remoteDir), "/")
+		if rel == "" || !info.Mode().IsRegular() {
+			continue
+		}
+		manifest[rel] = ManifestEntry{Size: info.Size(), ModTime: info.ModTime().Unix(), Mode: uint32(info.Mode().Perm())}
+	}
+	if len(manifest) == 0 {
+		return manifest, nil
+	}
+
+	var out, errOut bytes.Buffer
+	dir := shell.Quote(remoteDir)
+	cmd := fmt.Sprintf("if [ -d %s ]; then cd %s && find . -type f -exec sha256sum {} +; fi", dir, dir)
+	if err := c.RunCommand(cmd, &out, &errOut); err != nil {
+		return nil, fmt.Errorf("failed to index %s: %v %s", remoteDir, err, strings.TrimSpace(errOut.String()))
+	}
+
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// "<hash>  ./relative/path"
+		line := scanner.Text()
+		if len(line) < 67 {
+			continue
+		}
+		rel := strings.TrimPrefix(line[66:], "./")
+		if entry, ok := manifest[rel]; ok {
+			entry.Hash = line[:64]
+			manifest[rel] = entry
+		}
+	}
+	return manifest, scanner.Err()
+}
+
+func (c *Client) saveManifest(remoteDir string, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	p := manifestPath(remoteDir)
+	if err := c.sftp.MkdirAll(path.Dir(p)); err != nil {
+		return fmt.Errorf("failed to save sync manifest: %v", err)
+	}
+	f, err := c.sftp.Create(p)
+	if err != nil {
+		return fmt.Errorf("failed to save sync manifest: %v", err)
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// PullDirectory downloads remoteDir into localDir, skipping files that already match
+// in size and mtime. Local files are never deleted.
+func (c *Client) PullDirectory(remoteDir, localDir string, stdout, stderr io.Writer) error {
+	walker := c.sftp.Walk(remoteDir)
+	count := 0
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			fmt.Fprintf(stderr, "⚠️  %v\n", err)
+			continue
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remoteDir), "/")
+		info := walker.Stat()
+		if rel == "" {
+			continue
+		}
+		if info.IsDir() && info.Name() == ".graft-sync" {
+			walker.SkipDir()
+			continue
+		}
+
+		localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+		if info.IsDir() {
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if existing, err := os.Stat(localPath); err == nil && existing.Size() == info.Size() && existing.ModTime().Unix() == info.ModTime().Unix() {
+			continue
+		}
+
+		fmt.Fprintf(stdout, "  ⬇️  %s\n", rel)
+		if err := c.DownloadFile(walker.Path(), localPath); err != nil {
+			return fmt.Errorf("failed to download %s: %v", rel, err)
+		}
+		os.Chmod(localPath, info.Mode().Perm())
+		os.Chtimes(localPath, info.ModTime(), info.ModTime())
+		count++
+	}
+
+	fmt.Fprintf(stdout, "✅ %d file(s) downloaded\n", count)
+	return nil
+}
+
+// scanLocal walks localDir and returns its files (without hashes) and directories
+func scanLocal(localDir string, matcher *excludeMatcher) (Manifest, map[string]bool, error) {
+	files := Manifest{}
+	dirs := make(map[string]bool)
+
+	err := filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if matcher.excluded(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case info.IsDir():
+			dirs[rel] = true
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			files[rel] = ManifestEntry{Link: filepath.ToSlash(target), Hash: "symlink"}
+		case info.Mode().IsRegular():
+			entry := ManifestEntry{Size: info.Size(), ModTime: info.ModTime().Unix()}
+			if runtime.GOOS != "windows" {
+				entry.Mode = uint32(info.Mode().Perm())
+			}
+			files[rel] = entry
+		}
+		return nil
+	})
+	return files, dirs, err
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// parseGitignore reads a .gitignore file and returns rsync-compatible exclude patterns
+func parseGitignore(gitignorePath string) []string {
+	var excludes []string
+
+	file, err := os.Open(gitignorePath)
+	if err != nil {
+		// If .gitignore doesn't exist, return empty list
+		return excludes
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Remove leading slash for rsync compatibility
+		pattern := strings.TrimPrefix(line, "/")
+
+		// Skip negation patterns (rsync handles them differently)
+		if strings.HasPrefix(pattern, "!") {
+			continue
+		}
+
+		excludes = append(excludes, pattern)
+	}
+
+	return excludes
+}
+
+// excludeMatcher applies rsync --exclude semantics: a pattern without a slash matches
+// the last path component at any depth, a pattern with a slash matches the end of the
+// path, a leading slash anchors it to the sync root and a trailing slash matches directories only.
+type excludeMatcher struct {
+	rules []excludeRule
+}
+
+type excludeRule struct {
+	re       *regexp.Regexp
+	anchored bool
+	fullPath bool
+	dirOnly  bool
+}
+
+func newExcludeMatcher(patterns []string) *excludeMatcher {
+	m := &excludeMatcher{}
+	for _, pattern := range patterns {
+		rule := excludeRule{}
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		if strings.HasPrefix(pattern, "/") {
+			rule.anchored = true
+			pattern = strings.TrimLeft(pattern, "/")
+		}
+		if pattern == "" {
+			continue
+		}
+		rule.fullPath = rule.anchored || strings.Contains(pattern, "/") || strings.Contains(pattern, "**")
+		re, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+		if err != nil {
+			continue
+		}
+		rule.re = re
+		m.rules = append(m.rules, rule)
+	}
+	return m
+}
+
+// excluded reports whether the path itself matches an exclude rule
+func (m *excludeMatcher) excluded(rel string, isDir bool) bool {
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		switch {
+		case rule.anchored:
+			if rule.re.MatchString(rel) {
+				return true
+			}
+		case rule.fullPath:
+			// Unanchored: may match any trailing run of path components
+			parts := strings.Split(rel, "/")
+			for i := range parts {
+				if rule.re.MatchString(strings.Join(parts[i:], "/")) {
+					return true
+				}
+			}
+		default:
+			if rule.re.MatchString(path.Base(rel)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludedPath reports whether a file or any of its parent directories is excluded
+func (m *excludeMatcher) excludedPath(rel string) bool {
+	if m.excluded(rel, false) {
+		return true
+	}
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if m.excluded(dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp translates an rsync wildcard pattern into a regular expression
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch ch {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// ForwardLocal listens on localAddr and forwards every accepted connection through the
+// SSH connection to remoteAddr (as seen from the server), like ssh -L. It blocks until
+// ctx is cancelled or the SSH connection is lost.
+func (c *Client) ForwardLocal(ctx context.Context, localAddr, remoteAddr string, stdout io.Writer) error {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", localAddr, err)
+	}
+	defer listener.Close()
+
+	lost := make(chan struct{})
+	go func() {
+		c.client.Wait()
+		close(lost)
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-lost:
+		}
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-lost:
+				return c.connectionError(fmt.Errorf("ssh connection closed"))
+			default:
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer local.Close()
+
+			remote, err := c.client.Dial("tcp", remoteAddr)
+			if err != nil {
+				fmt.Fprintf(stdout, "⚠️  %s: unable to reach %s: %v\n", local.RemoteAddr(), remoteAddr, err)
+				return
+			}
+			defer remote.Close()
+
+			fmt.Fprintf(stdout, "🔌 Connection from %s\n", local.RemoteAddr())
+			pipe(local, remote, ctx)
+		}()
+	}
+}
+
+// pipe copies data in both directions until either side closes or ctx is cancelled
+func pipe(a, b net.Conn, ctx context.Context) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}